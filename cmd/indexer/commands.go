@@ -3,12 +3,14 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	h "github.com/pmshoot/repoindexer/internal/handler"
@@ -18,20 +20,49 @@ var (
 	err                                   error
 	repoPath                              string
 	flagFullIndex, flagDebug, flagVersion bool
+	workers                               int
+	keyPath                               string
+	outFormat                             string
+	flagYes, flagNoInput                  bool
+	flagUnsigned                          bool
+	execRule                              string
+	apiToken                              string
+	deltas                                int
 )
 
 // STDINWAIT период времени для таймера ожидания ввода с stdin
 const STDINWAIT = time.Millisecond * 50
 
+// exitInputRequired код завершения, если операция требует ввода оператора в неинтерактивном режиме
+const exitInputRequired = 3
+
 type conf struct {
-	Repo string `json:"repo"`
+	Repo     string `json:"repo"`
+	Workers  int    `json:"workers"`
+	Key      string `json:"key"`
+	ExecRule string `json:"exec_rule"`
+	Deltas   *int   `json:"deltas"`
+	APIToken string `json:"api_token"`
 }
 
 func init() {
 	log.SetFlags(0)
 	var rp string
+	var wc int
+	var er string
+	kp := defaultKeyPath()
+	dc := h.DefaultDeltas
 	if cnf, err := readConfFromJSON(); err == nil {
 		rp = cnf.Repo
+		wc = cnf.Workers
+		er = cnf.ExecRule
+		apiToken = cnf.APIToken
+		if cnf.Key != "" {
+			kp = cnf.Key
+		}
+		if cnf.Deltas != nil {
+			dc = *cnf.Deltas
+		}
 	} else {
 		fmt.Println(err)
 	}
@@ -40,6 +71,14 @@ func init() {
 	flag.BoolVar(&flagDebug, "d", false, "режим отладки")
 	flag.BoolVar(&flagFullIndex, "f", false, "режим принудительной полной индексации")
 	flag.BoolVar(&flagVersion, "v", false, "версия программы")
+	flag.IntVar(&workers, "w", wc, "количество потоков подсчета контрольных сумм при индексации (по-умолчанию - по числу процессоров)")
+	flag.StringVar(&keyPath, "k", kp, "путь к файлу закрытого ключа подписи индекс-файла")
+	flag.BoolVar(&flagUnsigned, "allow-unsigned", false, "разрешение выгрузки неподписанного индекс-файла вместо подписанного при отсутствии ключа")
+	flag.StringVar(&outFormat, "o", h.OutputTable, "формат вывода команд status, regl, list, alias show, exec show, index --dry-run, verify -files, audit: table | json")
+	flag.BoolVar(&flagYes, "yes", false, "подтверждение всех операций без запроса")
+	flag.BoolVar(&flagNoInput, "no-input", false, "неинтерактивный режим: stdin не читается, запросы подтверждения отклоняются (если не указан -yes)")
+	flag.IntVar(&deltas, "deltas", dc, "количество предыдущих выгрузок, от которых формируются разностные файлы индекса (0 - не формируются)")
+	flag.StringVar(&execRule, "exec-rule", er, "правило выбора исполняемого файла при нескольких найденных: "+strings.Join(h.ExecRuleNames(), " | ")+" (по-умолчанию ask)")
 	flag.Usage = usage
 	flag.Parse()
 }
@@ -61,10 +100,24 @@ func run() {
 		log.Fatalln("не указана команда")
 	}
 
-	fmt.Println("репозиторий:", repoPath)
+	if err = h.SetOutputFormat(outFormat); err != nil {
+		fatal(err)
+	}
+	if err = h.SetExecRule(execRule); err != nil {
+		fatal(err)
+	}
+	h.SetInputPolicy(flagYes, flagNoInput)
+	// в режиме JSON и при выгрузке конфигурации на стандартный вывод выводится только документ
+	if !h.OutputIsJSON() && !(flag.NArg() == 2 && flag.Arg(0) == "config" && flag.Arg(1) == "export") {
+		fmt.Println("репозиторий:", repoPath)
+	}
 
 	// обработка команд, не требующих подключения к БД
 	cmd := flag.Args()[0]
+	var (
+		verifySample string   // параметр выборки команды verify
+		verifyPacks  []string // пакеты команды verify
+	)
 	switch cmd {
 	// инициализация репозитория
 	case "init":
@@ -76,15 +129,77 @@ func run() {
 	// on|off режим регламента
 	case "regl", "reglament":
 		var mode string
-		cmdRegl := newFlagSet("reglament")
+		cmdRegl := flag.NewFlagSet("reglament", flag.ExitOnError)
+		reason := cmdRegl.String("reason", "", "причина (описание) работ")
+		ttl := cmdRegl.Duration("ttl", 0, "ожидаемая продолжительность работ (30m, 2h), после которой блокировка считается просроченной")
+		force := cmdRegl.Bool("force", false, "снятие блокировки, установленной другим пользователем")
+		parseFlagSet(cmdRegl)
 		if len(cmdRegl.Args()) != 0 {
 			mode = cmdRegl.Arg(0)
+			// флаги допускаются и после режима: regl off -force
+			if err = cmdRegl.Parse(cmdRegl.Args()[1:]); err != nil {
+				log.Fatalf("ошибка установки flagset %v", err)
+			}
 		}
 		// установка режима регламента
-		if err = h.SetReglamentMode(repoPath, mode); err != nil {
+		if err = h.SetReglamentMode(repoPath, mode, *reason, *ttl, *force); err != nil {
 			fatal(err)
 		}
 		return // выходим, чтобы не инициализировать подключение к БД
+
+	// восстановление БД и индекс-файла из резервной копии
+	case "restore":
+		cmdRestore := newFlagSet("restore")
+		if err = h.Restore(repoPath, cmdRestore.Arg(0)); err != nil {
+			fatal(err)
+		}
+		return // выходим, чтобы не открывать заменяемую БД
+
+	// восстановление БД по опубликованному индекс-файлу
+	case "recover-db":
+		cmdRecover := flag.NewFlagSet("recover-db", flag.ExitOnError)
+		from := cmdRecover.String("from", "", "индекс-файл (по-умолчанию index.gz репозитория)")
+		force := cmdRecover.Bool("force", false, "пересоздание исправной БД")
+		pubPath := cmdRecover.String("pub", keyPath+".pub", "путь к доверенному открытому ключу для проверки подписи индекс-файла")
+		parseFlagSet(cmdRecover)
+		rRepo, err := h.NewRepo(repoPath)
+		if err != nil {
+			fatal(err)
+		}
+		rRepo.SetWorkers(workers)
+		rRepo.SetKeyFile(keyPath)
+		rRepo.SetDeltas(deltas)
+		if err = h.RecoverDB(rRepo, *from, *pubPath, *force); err != nil {
+			fatal(err)
+		}
+		return // выходим, чтобы не открывать заменяемую БД
+
+	// управление ключом подписи индекс-файла
+	case "key":
+		cmdKey := newFlagSet("key")
+		if err = h.Key(keyPath, cmdKey.Arg(0)); err != nil {
+			fatal(err)
+		}
+		return
+
+	// проверка подписи опубликованного индекс-файла или файлов пакетов
+	case "verify":
+		cmdVerify := flag.NewFlagSet("verify", flag.ExitOnError)
+		files := cmdVerify.Bool("files", false, "проверка контрольных сумм файлов пакетов")
+		pubPath := cmdVerify.String("pub", keyPath+".pub", "путь к доверенному открытому ключу")
+		sample := cmdVerify.String("sample", "", "выборочная проверка: количество (500) или доля (10%) файлов пакета")
+		parseFlagSet(cmdVerify)
+		if !*files {
+			if *sample != "" || cmdVerify.NArg() > 0 {
+				log.Fatalln("выборка и пакеты указываются только для проверки файлов: verify -files")
+			}
+			if err = h.VerifyIndex(repoPath, *pubPath); err != nil {
+				fatal(err)
+			}
+			return
+		}
+		// проверка файлов пакетов выполняется после подключения к БД
+		verifySample, verifyPacks = *sample, cmdVerify.Args()
 	}
 
 	// инициализация и подключение к БД
@@ -92,6 +207,10 @@ func run() {
 	if err != nil {
 		fatal(err)
 	}
+	pRepo.SetWorkers(workers)
+	pRepo.SetKeyFile(keyPath)
+	pRepo.SetAllowUnsigned(flagUnsigned)
+	pRepo.SetDeltas(deltas)
 	if err = pRepo.OpenDB(); err != nil {
 		fatal(err)
 	}
@@ -104,7 +223,10 @@ func run() {
 	switch cmd {
 	//индексация файлов репозитория с записью в БД
 	case "index":
-		cmdIndex := newFlagSet("index")
+		cmdIndex := flag.NewFlagSet("index", flag.ExitOnError)
+		dryRun := cmdIndex.Bool("dry-run", false, "вывод изменений без записи в БД")
+		metaOnly := cmdIndex.Bool("meta", false, "при --dry-run сверка только по размеру и дате файлов, без подсчета контрольных сумм")
+		parseFlagSet(cmdIndex)
 
 		//todo Добавить проверку на существование пакета в репозитории #2
 
@@ -122,13 +244,37 @@ func run() {
 				}
 			}
 		}
-		if err = h.Index(pRepo, flagFullIndex, packs); err != nil {
+		if *dryRun {
+			err = h.IndexDryRun(pRepo, flagFullIndex, *metaOnly, packs)
+		} else {
+			err = h.Index(pRepo, flagFullIndex, packs)
+		}
+		if err != nil {
 			fatal(err)
 		}
 
 	// выгрузка данных индексации из БД в Index.gz
 	case "pop", "populate":
-		if err = h.Populate(pRepo); err != nil {
+		cmdPop := flag.NewFlagSet("populate", flag.ExitOnError)
+		rollback := cmdPop.Bool("rollback", false, "восстановление предыдущей версии индекс-файла")
+		format := cmdPop.String("format", "", "формат индекс-файла: v1 - для клиентов прежних версий | v2 (по-умолчанию - формат опубликованного индекс-файла)")
+		parseFlagSet(cmdPop)
+		if *rollback {
+			err = h.RollbackIndex(pRepo)
+		} else {
+			err = h.Populate(pRepo, *format)
+		}
+		if err != nil {
+			fatal(err)
+		}
+
+	// регламентные работы: индексация, проверка исполняемых файлов, выгрузка индекс-файла
+	case "publish":
+		cmdPublish := flag.NewFlagSet("publish", flag.ExitOnError)
+		reason := cmdPublish.String("reason", "", "причина (описание) работ для данных блокировки")
+		ttl := cmdPublish.Duration("ttl", 0, "ожидаемая продолжительность работ (30m, 2h)")
+		parseFlagSet(cmdPublish)
+		if err = h.Publish(pRepo, flagFullIndex, *reason, *ttl); err != nil {
 			fatal(err)
 		}
 
@@ -180,7 +326,7 @@ func run() {
 		} else {
 			cmd = cmdAlias.Args()[0]
 			aliases = cmdAlias.Args()[1:]
-			if len(aliases) == 0 {
+			if len(aliases) == 0 && cmd != "show" {
 				// from stdin
 				aliases = readDataFromStdin()
 				if len(aliases) == 0 {
@@ -192,16 +338,85 @@ func run() {
 			fatal(err)
 		}
 
+	// журнал операций с репозиторием
+	case "audit":
+		var cmd string
+		cmdAudit := flag.NewFlagSet("audit", flag.ExitOnError)
+		since := cmdAudit.String("since", "", "начало периода: продолжительность (24h, 7d) или дата (2006-01-02)")
+		pack := cmdAudit.String("pack", "", "записи указанного пакета")
+		parseFlagSet(cmdAudit)
+		if len(cmdAudit.Args()) != 0 {
+			cmd = cmdAudit.Arg(0)
+			// флаги допускаются и после команды: audit show -since 7d
+			if err = cmdAudit.Parse(cmdAudit.Args()[1:]); err != nil {
+				log.Fatalf("ошибка установки flagset %v", err)
+			}
+		}
+		if err = h.Audit(pRepo, cmd, *since, *pack); err != nil {
+			fatal(err)
+		}
+
+	// выгрузка/применение конфигурации репозитория
+	case "config":
+		var cmd, file string
+		cmdConfig := flag.NewFlagSet("config", flag.ExitOnError)
+		prune := cmdConfig.Bool("prune", false, "удаление записей, отсутствующих в разделах файла")
+		dryRun := cmdConfig.Bool("dry-run", false, "вывод изменений без применения")
+		parseFlagSet(cmdConfig)
+		if len(cmdConfig.Args()) == 0 {
+			log.Fatal("укажите команду: export | import")
+		}
+		cmd = cmdConfig.Arg(0)
+		// флаги допускаются после команды и после файла: config import -prune repo.json,
+		// config import repo.json -prune
+		if err = cmdConfig.Parse(cmdConfig.Args()[1:]); err != nil {
+			log.Fatalf("ошибка установки flagset %v", err)
+		}
+		if len(cmdConfig.Args()) > 0 {
+			file = cmdConfig.Arg(0)
+			if err = cmdConfig.Parse(cmdConfig.Args()[1:]); err != nil {
+				log.Fatalf("ошибка установки flagset %v", err)
+			}
+		}
+		if err = h.Config(pRepo, cmd, file, *prune, *dryRun); err != nil {
+			fatal(err)
+		}
+
+	// добавление/удаление/отображение шаблонов исключения файлов
+	case "ignore":
+		var cmd string
+		var patterns []string
+		cmdIgnore := newFlagSet("ignore")
+
+		if len(cmdIgnore.Args()) == 0 {
+			cmd = "show"
+		} else {
+			cmd = cmdIgnore.Args()[0]
+			patterns = cmdIgnore.Args()[1:]
+			if len(patterns) == 0 && cmd != "show" {
+				// from stdin
+				patterns = readDataFromStdin()
+				if len(patterns) == 0 {
+					log.Fatal("укажите по крайней мере один шаблон")
+				}
+			}
+		}
+		if err = h.Ignore(pRepo, cmd, patterns); err != nil {
+			fatal(err)
+		}
+
 	// вывод перечня и статус пакетов в репозитории
 	case "list":
 		var cmd string
+		var packs []string
 		cmdList := newFlagSet("list")
 		if len(cmdList.Args()) == 0 {
 			cmd = "all"
 		} else {
 			cmd = cmdList.Args()[0]
+			packs = cmdList.Args()[1:]
 		}
-		if err = h.List(pRepo, cmd); err != nil {
+		if err = h.List(pRepo, cmd, packs); err != nil {
 			fatal(err)
 		}
 
@@ -233,9 +448,80 @@ func run() {
 			fatal(err)
 		}
 
+	// пересчет контрольных сумм по указанному алгоритму
+	case "rehash":
+		cmdRehash := newFlagSet("rehash")
+		if err = h.Rehash(pRepo, cmdRehash.Arg(0)); err != nil {
+			fatal(err)
+		}
+
+	// политика сравнения имен пакетов и путей файлов
+	case "case":
+		cmdCase := newFlagSet("case")
+		if err = h.CasePolicy(pRepo, cmdCase.Arg(0)); err != nil {
+			fatal(err)
+		}
+
+	// сверка файлов пакетов с контрольными суммами в БД
+	case "verify":
+		if err = h.Verify(pRepo, verifySample, verifyPacks); err != nil {
+			fatal(err)
+		}
+
+	// HTTP сервер репозитория
+	case "serve":
+		cmdServe := flag.NewFlagSet("serve", flag.ExitOnError)
+		addr := cmdServe.String("addr", ":8080", "адрес и порт HTTP сервера")
+		api := cmdServe.Bool("api", false, "API управления репозиторием (токен - параметр api_token файла настроек)")
+		parseFlagSet(cmdServe)
+		token := ""
+		if *api {
+			if apiToken == "" {
+				log.Fatal("не задан токен API: параметр api_token файла настроек")
+			}
+			token = apiToken
+		}
+		log.SetFlags(log.LstdFlags)
+		if err = h.Serve(pRepo, *addr, token); err != nil {
+			fatal(err)
+		}
+
+	// отслеживание изменений пакетов с автоматической индексацией и выгрузкой
+	case "watch":
+		cmdWatch := flag.NewFlagSet("watch", flag.ExitOnError)
+		interval := cmdWatch.Duration("interval", time.Minute, "период опроса файлов пакетов")
+		debounce := cmdWatch.Duration("debounce", 30*time.Second, "задержка индексации после последнего изменения файлов пакета")
+		window := cmdWatch.String("window", "", "окно регламента ЧЧ:ММ-ЧЧ:ММ (22:00-06:00); по-умолчанию - в любое время")
+		notify := cmdWatch.Bool("notify", false, "уведомления файловой системы об изменениях (inotify, только Linux)")
+		parseFlagSet(cmdWatch)
+		log.SetFlags(log.LstdFlags)
+		if err = h.Watch(pRepo, *interval, *debounce, *window, *notify); err != nil {
+			fatal(err)
+		}
+
+	// резервная копия БД и индекс-файла
+	case "backup":
+		var dest string
+		cmdBackup := flag.NewFlagSet("backup", flag.ExitOnError)
+		keep := cmdBackup.Int("keep", 0, "количество хранимых последних копий (0 - без удаления)")
+		parseFlagSet(cmdBackup)
+		if len(cmdBackup.Args()) != 0 {
+			dest = cmdBackup.Arg(0)
+			// флаги допускаются и после каталога: backup D:\backup -keep 10
+			if err = cmdBackup.Parse(cmdBackup.Args()[1:]); err != nil {
+				log.Fatalf("ошибка установки flagset %v", err)
+			}
+		}
+		if err = h.Backup(pRepo, dest, *keep); err != nil {
+			fatal(err)
+		}
+
 	// миграция БД
 	case "migrate":
-		if err = h.MigrateDB(pRepo); err != nil {
+		cmdMigrate := flag.NewFlagSet("migrate", flag.ExitOnError)
+		dryRun := cmdMigrate.Bool("dry-run", false, "вывод шагов миграции без изменения БД")
+		parseFlagSet(cmdMigrate)
+		if err = h.MigrateDB(pRepo, *dryRun); err != nil {
 			fatal(err)
 		}
 
@@ -245,6 +531,10 @@ func run() {
 }
 
 func readDataFromStdin() []string {
+	// в неинтерактивном режиме данные из stdin не читаются
+	if h.InputDisabled() {
+		return nil
+	}
 	ch := make(chan string)
 	go func(chan string) {
 		scanner := bufio.NewScanner(os.Stdin)
@@ -272,10 +562,21 @@ func readDataFromStdin() []string {
 
 func newFlagSet(name string) *flag.FlagSet {
 	f := flag.NewFlagSet(name, flag.ErrorHandling(1))
+	parseFlagSet(f)
+	return f
+}
+
+// parseFlagSet разбирает аргументы команды набором флагов f
+func parseFlagSet(f *flag.FlagSet) {
 	if err = f.Parse(flag.Args()[1:]); err != nil {
 		log.Fatalf("ошибка установки flagset %v", err)
 	}
-	return f
+}
+
+// defaultKeyPath возвращает путь к файлу ключа подписи по-умолчанию - рядом с программой
+func defaultKeyPath() string {
+	curFilePath, _ := os.Executable()
+	return filepath.Join(filepath.Dir(curFilePath), "indexer.key")
 }
 
 // проверка файла-конфигурации ,чтение настроек
@@ -314,16 +615,30 @@ func printUsage() {
 
 	commands := [][]string{
 		{"init", "инициализация репозитория"},
-		{"regl [on|off]", "статус, активация, деактивация режима регламента"},
-		{"index [packname, ...]", "индексирование репозитория или указанных пакетов"},
+		{"regl [on [-reason text] [-ttl 2h]] | [off [-force]]", "статус, активация, деактивация режима регламента; -force - снятие блокировки другого пользователя"},
+		{"index [--dry-run [-meta]] [packname, ...]", "индексирование репозитория или указанных пакетов; --dry-run - вывод изменений без записи в БД"},
+		{"publish [-reason text] [-ttl 2h]", "регламентные работы: regl on, index, exec check, pop (при наличии изменений), regl off"},
 		{"exec [check|set|del|show [packname]]", "поиск, установка, удаление, вывод исполняемого файла для пакета[ов]"},
-		{"pop", "выгрузка данных в индекс-файл"},
+		{"pop [-format v1|v2] [-rollback]", "выгрузка данных в индекс-файл; -format v1 - формат для клиентов прежних версий; -rollback - восстановление предыдущей версии индекс-файла"},
+		{"key [show|generate|rotate]", "вывод, создание, замена ключа подписи индекс-файла"},
+		{"verify [-pub file]", "проверка подписи и хэш-суммы опубликованного индекс-файла доверенным открытым ключом"},
+		{"verify -files [-sample N|N%] [packname, ...]", "проверка контрольных сумм файлов пакетов: поврежденные, измененные, отсутствующие, лишние файлы"},
 		{"enable packname [packname, ...] | <(stdin)", "активация заблокированного пакета[ов] "},
 		{"disable packname [packname, ...] | <(stdin)", "блокировка пакета[ов]"},
 		{"alias [show] | [set packname=alias,... | <(stdin)] | [del alias,... | <(stdin)]]", "вывод, установка, удаление псевдонимов для пакетов"},
-		{"list", "вывод перечня и статуса пакетов в репозитории"},
+		{"ignore [show] | [add pattern,... | <(stdin)] | [del pattern,... | <(stdin)]", "вывод, добавление, удаление шаблонов исключения файлов"},
+		{"audit [show] [-since 24h|7d|2006-01-02] [-pack packname]", "вывод журнала операций: оператор, время, команда, значения до и после изменения"},
+		{"config export [file] | import file [-prune] [--dry-run]", "выгрузка и применение конфигурации репозитория: псевдонимы, блокировки, исполняемые файлы, шаблоны исключения"},
+		{"list [all|indexed|noindexed|blocked] | [ignored packname, ...]", "вывод перечня и статуса пакетов в репозитории, исключенных файлов пакета"},
 		{"status", "вывод информации о состоянии репозитория"},
-		{"migrate", "миграция данных БД при изменении версии"},
+		{"backup [dest] [-keep N]", "резервная копия БД, индекс-файла и файла режима регламента в архив (по-умолчанию в каталог <репозиторий>-backup)"},
+		{"restore archive", "восстановление БД и индекс-файла из резервной копии с проверкой целостности и версии БД"},
+		{"recover-db [-from index.gz] [-pub key.pub] [-force]", "восстановление БД по индекс-файлу: пакеты, файлы, псевдонимы, исполняемые файлы; подсчет контрольных сумм только измененных файлов"},
+		{"migrate [--dry-run]", "миграция данных БД при изменении версии; --dry-run - вывод шагов миграции"},
+		{"rehash [" + strings.Join(h.HashAlgoNames(), "|") + "]", "пересчет контрольных сумм репозитория по указанному алгоритму (по-умолчанию " + h.DefaultHashAlgo + ")"},
+		{"case [" + h.CaseSensitive + "|" + h.CaseInsensitive + "]", "вывод или установка политики сравнения имен пакетов и файлов: с учетом или без учета регистра символов"},
+		{"watch [-interval 1m] [-debounce 30s] [-window 22:00-06:00] [-notify]", "отслеживание изменений пакетов: индексация измененных пакетов и выгрузка индекс-файла в окне регламента"},
+		{"serve [-addr host:port] [-api]", "HTTP сервер индекс-файла и файлов пакетов репозитория (по-умолчанию :8080); -api - API управления"},
 		{"clean", "упаковка и переиндексация данных в БД"},
 		{"cleardb index|alias|status|all", "очистка БД от данных индекса, псевдонимов, блокировок или всех данных"},
 	}
@@ -334,14 +649,20 @@ func printUsage() {
 }
 
 func fatal(e error) {
+	code := 1
+	if errors.Is(e, h.ErrInputRequired) {
+		code = exitInputRequired
+	}
 	switch e.(type) {
 	case *h.InternalError:
 		if flagDebug {
 			msg := fmt.Sprintf("%s\n", e.(*h.InternalError).Text)
 			msg += fmt.Sprintf("Caller: %s\n", e.(*h.InternalError).Caller)
 			msg += fmt.Sprintf("Original error: %v\n", e.(*h.InternalError).Err)
-			log.Fatal(msg)
+			log.Print(msg)
+			os.Exit(code)
 		}
 	}
-	log.Fatalln(e)
+	log.Println(e)
+	os.Exit(code)
 }
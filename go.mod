@@ -2,4 +2,8 @@ module github.com/pmshoot/repoindexer
 
 go 1.15
 
-require github.com/mattn/go-sqlite3 v1.14.4
+require (
+	github.com/mattn/go-sqlite3 v1.14.4
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	golang.org/x/text v0.3.4
+)
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// команды журнала операций
+const (
+	auditDisable     = "disable"
+	auditEnable      = "enable"
+	auditAliasSet    = "alias set"
+	auditAliasDel    = "alias del"
+	auditExecSet     = "exec set"
+	auditExecDel     = "exec del"
+	auditIndex       = "index"
+	auditPop         = "pop"
+	auditPopRollback = "pop -rollback"
+	auditClearDB     = "cleardb"
+	auditMigrate     = "migrate"
+	auditRecoverDB   = "recover-db"
+	auditRestore     = "restore"
+)
+
+// AuditEntry запись журнала операций с репозиторием
+type AuditEntry struct {
+	Time     time.Time `json:"time"`              // время операции
+	Operator string    `json:"operator"`          // пользователь ОС
+	Host     string    `json:"host"`              // имя компьютера
+	Command  string    `json:"command"`           // команда
+	Package  string    `json:"package,omitempty"` // пакет
+	Before   string    `json:"before"`            // значение до изменения
+	After    string    `json:"after"`             // значение после изменения
+}
+
+// audit записывает операцию в журнал. Ошибка записи в журнал не отменяет выполненную операцию
+func (r *Repo) audit(command, pack, before, after string) {
+	r.auditDB(r.db, command, pack, before, after)
+}
+
+// auditDB записывает операцию в журнал через db: в транзакции запись отменяется вместе с операцией
+func (r *Repo) auditDB(db dbExecutor, command, pack, before, after string) {
+	host, operator := currentOwner()
+	if _, err := db.Exec("INSERT INTO audit (stamp, operator, host, command, package, old_value, new_value) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?);", time.Now().Unix(), operator, host, command, pack, before, after); err != nil {
+		fmt.Printf("! ошибка записи в журнал операций: %v\n", err)
+	}
+}
+
+// auditEntries возвращает записи журнала операций, начиная с указанного времени,
+// для указанного пакета (пустая строка - всех)
+func (r *Repo) auditEntries(since time.Time, pack string) ([]AuditEntry, error) {
+	rows, err := r.db.Query("SELECT stamp, operator, host, command, package, old_value, new_value "+
+		"FROM audit WHERE stamp>=? ORDER BY id;", since.Unix())
+	if err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка чтения журнала операций",
+			Caller: "Manager::AuditEntries",
+			Err:    err,
+		}
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var stamp int64
+		if err = rows.Scan(&stamp, &e.Operator, &e.Host, &e.Command, &e.Package, &e.Before, &e.After); err != nil {
+			return nil, &InternalError{
+				Text:   "ошибка чтения журнала операций",
+				Caller: "Manager::AuditEntries::Scan",
+				Err:    err,
+			}
+		}
+		if pack != "" && !r.sameName(e.Package, pack) {
+			continue
+		}
+		e.Time = time.Unix(stamp, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// copyAudit переносит в журнал операций БД db записи журнала прежней БД fpFrom, отсутствующие в db.
+// Запись определяется идентификатором и данными: одинаковые операции, выполненные в одну секунду,
+// не объединяются. Идентификатор записи сохраняется, если не занят в db.
+// Возвращает количество перенесенных записей
+func copyAudit(db *sql.DB, fpFrom string) (int, error) {
+	const columns = "stamp, operator, host, command, package, old_value, new_value"
+	type auditRow struct {
+		id, stamp                                    int64
+		operator, host, command, pack, before, after string
+	}
+	readRows := func(db *sql.DB) ([]auditRow, error) {
+		rows, err := db.Query("SELECT id, " + columns + " FROM audit ORDER BY id;")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var list []auditRow
+		for rows.Next() {
+			var e auditRow
+			if err = rows.Scan(&e.id, &e.stamp, &e.operator, &e.host, &e.command, &e.pack, &e.before, &e.after); err != nil {
+				return nil, err
+			}
+			list = append(list, e)
+		}
+		return list, rows.Err()
+	}
+
+	from, err := newConnection(fpFrom)
+	if err != nil {
+		return 0, err
+	}
+	defer from.Close()
+	rows, err := readRows(from)
+	if err != nil {
+		return 0, &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения журнала операций БД %s", fpFrom),
+			Caller: "Audit::copy",
+			Err:    err,
+		}
+	}
+	current, err := readRows(db)
+	if err != nil {
+		return 0, &InternalError{
+			Text:   "ошибка чтения журнала операций",
+			Caller: "Audit::copy",
+			Err:    err,
+		}
+	}
+	exists := map[auditRow]bool{}
+	ids := map[int64]bool{}
+	for _, e := range current {
+		exists[e] = true
+		ids[e.id] = true
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, &InternalError{
+			Text:   "ошибка начала транзакции",
+			Caller: "Audit::copy",
+			Err:    err,
+		}
+	}
+	var count int
+	for _, e := range rows {
+		if exists[e] {
+			continue
+		}
+		// занятый идентификатор - запись другой операции: назначается новый
+		var id interface{}
+		if !ids[e.id] {
+			id, ids[e.id] = e.id, true
+		}
+		res, err := tx.Exec("INSERT INTO audit (id, "+columns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+			id, e.stamp, e.operator, e.host, e.command, e.pack, e.before, e.after)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, &InternalError{
+				Text:   "ошибка записи в журнал операций",
+				Caller: "Audit::copy",
+				Err:    err,
+			}
+		}
+		if id == nil {
+			newID, _ := res.LastInsertId()
+			ids[newID] = true
+		}
+		count++
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, &InternalError{
+			Text:   "ошибка фиксации транзакции",
+			Caller: "Audit::copy",
+			Err:    err,
+		}
+	}
+	return count, nil
+}
+
+// packSummaries возвращает описание данных пакетов в БД для журнала операций
+func (r *Repo) packSummaries() map[string]string {
+	summaries := map[string]string{}
+	rows, err := r.db.Query("SELECT name, hash, size, fcnt FROM packages;")
+	if err != nil {
+		return summaries
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, hash string
+		var size, count int64
+		if err = rows.Scan(&name, &hash, &size, &count); err == nil {
+			summaries[name] = fmt.Sprintf("файлов: %d, размер: %d, хэш: %s", count, size, hash)
+		}
+	}
+	return summaries
+}
+
+// auditPackChanges записывает в журнал изменения данных пакетов по описаниям до и после операции
+func (r *Repo) auditPackChanges(command string, before, after map[string]string) {
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if before[name] != after[name] {
+			r.audit(command, name, before[name], after[name])
+		}
+	}
+}
+
+// parseSince разбирает начало периода журнала операций: продолжительность до текущего
+// момента (24h, 7d) или дата (2006-01-02, 2006-01-02 15:04). Пустая строка - весь журнал
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		var days int
+		if _, err := fmt.Sscanf(s, "%dd", &days); err == nil && days >= 0 {
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, &InternalError{
+		Text:   fmt.Sprintf("неверное начало периода %q. укажите продолжительность (24h, 7d) или дату (2006-01-02)", s),
+		Caller: "Audit::parseSince",
+	}
+}
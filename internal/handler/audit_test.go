@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCopyAudit(t *testing.T) {
+	const insert = "INSERT INTO audit (id, stamp, operator, host, command) VALUES (?, 1792307277, 'op', 'host', ?);"
+	type row struct {
+		id      int64
+		command string
+	}
+	tests := []struct {
+		name     string
+		from, to []row
+		want     int
+		wantIDs  []int64
+	}{
+		{"пустой журнал", []row{{1, "pop"}, {2, "pop"}}, nil, 2, []int64{1, 2}},
+		{"одинаковые операции в одну секунду", []row{{1, "pop"}, {2, "pop"}, {3, "pop"}}, []row{{1, "pop"}}, 2, []int64{1, 2, 3}},
+		{"общая история", []row{{1, "index"}, {2, "pop"}, {3, "alias"}}, []row{{1, "index"}, {2, "pop"}}, 1, []int64{1, 2, 3}},
+		{"записи перенесены", []row{{1, "index"}, {2, "pop"}}, []row{{1, "index"}, {2, "pop"}}, 0, []int64{1, 2}},
+		{"идентификатор занят", []row{{1, "index"}, {2, "pop"}}, []row{{1, "index"}, {2, "restore"}}, 1, []int64{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := newTestRepo(t), newTestRepo(t)
+			for _, e := range tt.from {
+				if _, err := from.db.Exec(insert, e.id, e.command); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, e := range tt.to {
+				if _, err := to.db.Exec(insert, e.id, e.command); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n, err := copyAudit(to.db, pathDB(from.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want {
+				t.Errorf("перенесено записей %d, ожидается %d", n, tt.want)
+			}
+			rows, err := to.db.Query("SELECT id FROM audit ORDER BY id;")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var ids []int64
+			for rows.Next() {
+				var id int64
+				if err = rows.Scan(&id); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("записи журнала %v, ожидается %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// политики сравнения имен пакетов и путей файлов
+const (
+	CaseSensitive   = "sensitive"   // с учетом регистра символов
+	CaseInsensitive = "insensitive" // без учета регистра: репозиторий на файловой системе Windows
+)
+
+// caseInsensitive кэширует политику репозитория и проверяет, сравниваются ли имена без учета регистра.
+// В БД версии ниже 1.11 политика не хранится - имена сравниваются с учетом регистра
+func (r *Repo) caseInsensitive() bool {
+	if r.casePolicy == "" {
+		if err := r.db.QueryRow("SELECT case_policy FROM info WHERE id=1;").Scan(&r.casePolicy); err != nil {
+			r.casePolicy = CaseSensitive
+		}
+	}
+	return r.casePolicy == CaseInsensitive
+}
+
+// setCasePolicy сохраняет политику сравнения имен репозитория в БД
+func (r *Repo) setCasePolicy(policy string) error {
+	if _, err := r.db.Exec("UPDATE info SET case_policy=? WHERE id=1;", policy); err != nil {
+		return &InternalError{
+			Text:   "ошибка сохранения политики сравнения имен",
+			Caller: "Manager::SetCasePolicy",
+			Err:    err,
+		}
+	}
+	r.casePolicy = policy
+	return nil
+}
+
+// nameKey возвращает ключ сравнения имени пакета или пути файла согласно политике репозитория
+func (r *Repo) nameKey(name string) string {
+	if r.caseInsensitive() {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// sameName сравнивает имена пакетов или пути файлов согласно политике репозитория
+func (r *Repo) sameName(a, b string) bool {
+	return a == b || r.caseInsensitive() && r.nameKey(a) == r.nameKey(b)
+}
+
+// comparePaths сравнивает пути файлов согласно политике репозитория: -1, 0, +1.
+// Согласовано с порядком сортировки sortPaths
+func (r *Repo) comparePaths(a, b string) int {
+	if ka, kb := r.nameKey(a), r.nameKey(b); ka < kb {
+		return -1
+	} else if ka > kb {
+		return 1
+	}
+	return 0
+}
+
+// sortPaths упорядочивает список по ключам сравнения путей; пути с одинаковым ключом
+// следуют в порядке байтового сравнения
+func (r *Repo) sortPaths(list []*FileInfo, path func(*FileInfo) string) {
+	keys := make(map[*FileInfo]string, len(list))
+	for _, fi := range list {
+		keys[fi] = path(fi)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if c := r.comparePaths(keys[list[i]], keys[list[j]]); c != 0 {
+			return c < 0
+		}
+		return keys[list[i]] < keys[list[j]]
+	})
+}
+
+// packName возвращает имя пакета в репозитории или в БД, соответствующее указанному имени.
+// При сравнении с учетом регистра, а также если пакет не найден, имя возвращается без изменений
+func (r *Repo) packName(name string) string {
+	if !r.caseInsensitive() {
+		return name
+	}
+	lists := [][]string{r.ActivePacks(), r.disabledPacks(), r.packages()}
+	for _, list := range lists {
+		for _, pack := range list {
+			if pack == name {
+				return pack
+			}
+		}
+	}
+	for _, list := range lists {
+		for _, pack := range list {
+			if r.sameName(pack, name) {
+				return pack
+			}
+		}
+	}
+	return name
+}
+
+// packNames возвращает имена пакетов в репозитории или в БД, соответствующие указанным
+func (r *Repo) packNames(names []string) []string {
+	packs := make([]string, 0, len(names))
+	for _, name := range names {
+		packs = append(packs, r.packName(name))
+	}
+	return packs
+}
+
+// nameCollisions возвращает группы имен, различающихся только регистром символов
+func nameCollisions(names []string) [][]string {
+	groups := map[string][]string{}
+	var keys []string
+	for _, name := range names {
+		key := strings.ToLower(name)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], name)
+	}
+	sort.Strings(keys)
+	var collisions [][]string
+	for _, key := range keys {
+		if len(groups[key]) > 1 {
+			collisions = append(collisions, groups[key])
+		}
+	}
+	return collisions
+}
+
+// caseCollisions возвращает имена пакетов, псевдонимов и пути файлов пакетов,
+// различающиеся только регистром символов
+func (r *Repo) caseCollisions() ([]string, error) {
+	var report []string
+	for _, names := range nameCollisions(r.repoDirs()) {
+		report = append(report, fmt.Sprintf("пакеты %q", names))
+	}
+	var aliases []string
+	for _, pair := range r.aliases() {
+		aliases = append(aliases, pair[1])
+	}
+	for _, names := range nameCollisions(aliases) {
+		report = append(report, fmt.Sprintf("псевдонимы %q", names))
+	}
+
+	for _, pack := range r.ActivePacks() {
+		files, err := r.filesPackRepo(pack)
+		if err != nil {
+			return nil, err
+		}
+		root := filepath.Join(r.path, pack)
+		paths := make([]string, 0, len(files))
+		for _, fi := range files {
+			paths = append(paths, relPath(root, fi.Path))
+		}
+		for _, names := range nameCollisions(paths) {
+			report = append(report, fmt.Sprintf("файлы пакета %q %q", pack, names))
+		}
+	}
+	return report, nil
+}
+
+// packCollisions проверяет наличие в репозитории пакетов, имена которых различаются
+// только регистром символов, при сравнении имен без учета регистра
+func (r *Repo) packCollisions() error {
+	if !r.caseInsensitive() {
+		return nil
+	}
+	if collisions := nameCollisions(r.repoDirs()); len(collisions) > 0 {
+		return &InternalError{
+			Text:   fmt.Sprintf("имена пакетов различаются только регистром символов: %q", collisions[0]),
+			Caller: "Manager::PackCollisions",
+		}
+	}
+	return nil
+}
+
+// repoDirs возвращает список каталогов пакетов в репозитории, включая заблокированные
+func (r *Repo) repoDirs() []string {
+	ch := make(chan string)
+	go dirList(r.path, ch)
+	var dirs []string
+	for name := range ch {
+		dirs = append(dirs, name)
+	}
+	return dirs
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestComparePaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		a, b   string
+		want   int
+	}{
+		{"равны", CaseSensitive, "bin/app.exe", "bin/app.exe", 0},
+		{"меньше", CaseSensitive, "a.txt", "b.txt", -1},
+		{"больше", CaseSensitive, "b.txt", "a.txt", 1},
+		{"регистр учитывается", CaseSensitive, "App.exe", "app.exe", -1},
+		{"регистр не учитывается", CaseInsensitive, "App.exe", "app.exe", 0},
+		{"порядок без учета регистра", CaseInsensitive, "B.txt", "a.txt", 1},
+		{"порядок с учетом регистра", CaseSensitive, "B.txt", "a.txt", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Repo{casePolicy: tt.policy}
+			if got := r.comparePaths(tt.a, tt.b); got != tt.want {
+				t.Errorf("comparePaths(%q, %q) = %d, ожидается %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		dirs    []string
+		wantErr bool
+	}{
+		{"без совпадений", CaseInsensitive, []string{"PackA", "PackB"}, false},
+		{"совпадение без учета регистра", CaseInsensitive, []string{"PackA", "packa"}, true},
+		{"совпадение при учете регистра", CaseSensitive, []string{"PackA", "packa"}, false},
+		{"служебный каталог", CaseInsensitive, []string{"PackA", ".delta", ".DELTA"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, d := range tt.dirs {
+				if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+					t.Skipf("файловая система не различает регистр: %v", err)
+				}
+			}
+			r := &Repo{path: dir, casePolicy: tt.policy}
+			if err := r.packCollisions(); (err != nil) != tt.wantErr {
+				t.Errorf("ошибка %v, ожидается ошибка: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPackFileInfo(t *testing.T) {
+	r := newTestRepo(t)
+	for _, q := range []string{
+		`INSERT INTO packages (id, name, hash) VALUES (1, 'PackA', ''), (2, 'Пакет', ''), (3, 'Blocked', '');`,
+		`INSERT INTO files (package_id, path, size, mdate, hash) VALUES
+			(1, 'Bin/App.exe', 1, 1, 'a'), (2, 'Док/Файл.txt', 1, 1, 'b'), (3, 'f.txt', 1, 1, 'c');`,
+		`INSERT INTO excludes (Name) VALUES ('blocked');`,
+	} {
+		if _, err := r.db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name        string
+		insensitive bool
+		pack, path  string
+		wantPack    string
+		wantPath    string
+	}{
+		{"точное совпадение", false, "PackA", "Bin/App.exe", "PackA", "Bin/App.exe"},
+		{"регистр учитывается", false, "packa", "bin/app.exe", "", ""},
+		{"регистр не учитывается", true, "packa", "bin/app.exe", "PackA", "Bin/App.exe"},
+		{"кириллица без учета регистра", true, "ПАКЕТ", "док/файл.TXT", "Пакет", "Док/Файл.txt"},
+		{"файл не найден", true, "PackA", "bin/missing.exe", "", ""},
+		{"заблокированный пакет с учетом регистра", false, "Blocked", "f.txt", "Blocked", "f.txt"},
+		{"заблокированный пакет без учета регистра", true, "Blocked", "f.txt", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pack, fd, err := r.packFileInfo(tt.pack, tt.path, tt.insensitive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var path string
+			if fd != nil {
+				path = fd.Path
+			}
+			if pack != tt.wantPack || path != tt.wantPath {
+				t.Errorf("packFileInfo(%q, %q) = %q, %q, ожидается %q, %q", tt.pack, tt.path, pack, path, tt.wantPack, tt.wantPath)
+			}
+		})
+	}
+}
@@ -22,11 +22,11 @@ func Alias(r *Repo, cmd string, aliases []string) error {
 					Caller: "Alias",
 				}
 			}
-			if err = r.setAlias(alias); err != nil {
+			if err = r.setAlias(r.db, alias); err != nil {
 				return err
 			}
 		}
-		fmt.Println(doPopMsg)
+		fmt.Print(doPopMsg)
 	case "del":
 		for _, alias := range aliases {
 			als := strings.Split(alias, "=")
@@ -40,19 +40,22 @@ func Alias(r *Repo, cmd string, aliases []string) error {
 					Caller: "Alias",
 				}
 			}
-			if err = r.delAlias(alias); err != nil {
+			if err = r.delAlias(r.db, alias); err != nil {
 				return err
 			}
 		}
-		fmt.Println(doPopMsg)
+		fmt.Print(doPopMsg)
 	case "", "show":
 		// show alias info
-		aliases := r.aliases()
+		aliases := AliasDoc(r)
+		if OutputIsJSON() {
+			return printJSON(aliases)
+		}
 		if len(aliases) == 0 {
 			fmt.Println("Список псевдонимов пуст")
 		} else {
-			for _, aliasPair := range aliases {
-				fmt.Printf("%v=%v\n", aliasPair[0], aliasPair[1])
+			for _, alias := range aliases {
+				fmt.Printf("%v=%v\n", alias.Package, alias.Alias)
 			}
 		}
 	default:
@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiPrefix префикс URL API управления репозиторием
+const apiPrefix = "/api/"
+
+// apiRequest параметры запроса API управления
+type apiRequest struct {
+	Packages []string          `json:"packages"` // пакеты
+	Aliases  map[string]string `json:"aliases"`  // пакет: псевдоним (alias/set)
+	Names    []string          `json:"names"`    // псевдонимы (alias/del)
+	Full     bool              `json:"full"`     // полная индексация (index)
+	Rollback bool              `json:"rollback"` // восстановление предыдущей версии индекс-файла (pop)
+	Mode     string            `json:"mode"`     // on | off (regl)
+	Reason   string            `json:"reason"`   // причина работ (regl on)
+	TTL      string            `json:"ttl"`      // ожидаемая продолжительность работ: 30m, 2h (regl on)
+	Force    bool              `json:"force"`    // снятие блокировки другого пользователя (regl off)
+	List     string            `json:"-"`        // all | indexed | noindexed | blocked (GET list?cmd=)
+}
+
+// apiResponse результат выполнения операции API управления
+type apiResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ErrLocked репозиторий заблокирован режимом регламента, установленным другим процессом
+var ErrLocked = errors.New("репозиторий заблокирован")
+
+// apiServer обработчик запросов API управления репозиторием.
+// Все операции выполняются последовательно: объект Repo кэширует списки пакетов
+// и не предназначен для одновременного использования. Операции изменения выполняются
+// в режиме регламента, исключающем одновременную работу других процессов с репозиторием
+type apiServer struct {
+	r     *Repo
+	token string
+	mu    sync.Mutex
+}
+
+// apiHandler функция обработки запроса API; возвращает документ ответа
+type apiHandler func(req *apiRequest) (interface{}, error)
+
+// newAPIHandler возвращает обработчик запросов API управления с авторизацией по токену
+func newAPIHandler(r *Repo, token string) http.Handler {
+	as := &apiServer{r: r, token: token}
+	// операции чтения
+	get := map[string]apiHandler{
+		"status": func(*apiRequest) (interface{}, error) { return StatusDoc(as.r) },
+		"list":   func(req *apiRequest) (interface{}, error) { return ListDoc(as.r, req.List, req.Packages) },
+		"alias":  func(*apiRequest) (interface{}, error) { return AliasDoc(as.r), nil },
+		"exec":   func(req *apiRequest) (interface{}, error) { return ExecDoc(as.r, req.Packages) },
+		"regl":   func(*apiRequest) (interface{}, error) { return ReglamentDoc(as.r.path) },
+	}
+	// операции изменения
+	post := map[string]apiHandler{
+		"enable":     as.setStatus(PackStatusActive),
+		"disable":    as.setStatus(PackStatusBlocked),
+		"alias/set":  as.aliasSet,
+		"alias/del":  func(req *apiRequest) (interface{}, error) { return nil, Alias(as.r, "del", req.Names) },
+		"exec/check": as.execFile("check"),
+		"exec/set":   as.execFile("set"),
+		"index":      as.index,
+		"pop": func(req *apiRequest) (interface{}, error) {
+			if req.Rollback {
+				return nil, RollbackIndex(as.r)
+			}
+			return nil, Populate(as.r, as.r.publishedFormat())
+		},
+		"regl": as.regl,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !as.authorized(req) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="indexer"`)
+			writeAPIError(w, http.StatusUnauthorized, "требуется авторизация")
+			return
+		}
+		name := strings.Trim(strings.TrimPrefix(req.URL.Path, apiPrefix), "/")
+		var handlers map[string]apiHandler
+		switch req.Method {
+		case http.MethodGet:
+			handlers = get
+		case http.MethodPost:
+			handlers = post
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+			return
+		}
+		fn, ok := handlers[name]
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, fmt.Sprintf("неизвестная операция %q", name))
+			return
+		}
+		apiReq := new(apiRequest)
+		if req.Method == http.MethodGet {
+			query := req.URL.Query()
+			apiReq.Packages = query["pack"]
+			if apiReq.List = query.Get("cmd"); apiReq.List == "" {
+				apiReq.List = "all"
+			}
+		} else if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(apiReq); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("неверный формат запроса: %v", err))
+				return
+			}
+		}
+		as.call(w, fn, apiReq, req.Method == http.MethodPost && name != "regl")
+	})
+}
+
+// authorized проверяет токен авторизации запроса
+func (as *apiServer) authorized(req *http.Request) bool {
+	const bearer = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearer) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, bearer)), []byte(as.token)) == 1
+}
+
+// call выполняет операцию с исключительным доступом к репозиторию и выводит результат.
+// modify - операция изменения: выполняется в режиме регламента
+func (as *apiServer) call(w http.ResponseWriter, fn apiHandler, req *apiRequest, modify bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	// данные могли быть изменены другим процессом
+	as.r.resetCache()
+
+	var (
+		doc     interface{}
+		err     error
+		release = func() error { return nil }
+	)
+	if modify {
+		release, err = as.acquire()
+	}
+	if err == nil {
+		doc, err = fn(req)
+		if e := release(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Printf("API: %v", err)
+		code := http.StatusUnprocessableEntity
+		if errors.Is(err, ErrInputRequired) || errors.Is(err, ErrLocked) {
+			code = http.StatusConflict
+		}
+		writeAPIError(w, code, strings.TrimSpace(err.Error()))
+		return
+	}
+	if doc == nil {
+		doc = apiResponse{OK: true}
+	}
+	writeAPIJSON(w, http.StatusOK, doc)
+}
+
+// acquire устанавливает режим регламента на время операции изменения и возвращает функцию его снятия.
+// Режим, установленный через API этим процессом, сохраняется; установленный другим процессом
+// (командная строка, publish, watch) - операция отклоняется
+func (as *apiServer) acquire() (func() error, error) {
+	lock, err := readReglamentLock(as.r.path)
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		if lock.Legacy == "" && !lock.foreign() && lock.PID == os.Getpid() {
+			return func() error { return nil }, nil
+		}
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("режим регламента установлен другим процессом: %s", lock.owner()),
+			Caller: "API::acquire",
+			Err:    ErrLocked,
+		}
+	}
+	if err = writeReglamentLock(as.r.path, newReglamentLock("api", 0)); err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка установки режима регламента",
+			Caller: "API::acquire",
+			Err:    ErrLocked,
+		}
+	}
+	return func() error { return releaseReglamentLock(as.r.path) }, nil
+}
+
+// execFile возвращает обработчик проверки или установки исполняемых файлов пакетов;
+// без пакетов обрабатываются все активные. Выбор исполняемого файла оператором через API
+// недоступен: правило выбора задается параметром -exec-rule при запуске сервера
+func (as *apiServer) execFile(cmd string) apiHandler {
+	return func(req *apiRequest) (interface{}, error) {
+		if execRule == ExecRuleAsk {
+			return nil, &InternalError{
+				Text:   "правило выбора исполняемого файла не задано. Запустите сервер с параметром -exec-rule",
+				Caller: "API::execFile",
+				Err:    ErrInputRequired,
+			}
+		}
+		packs := req.Packages
+		if len(packs) == 0 {
+			packs = as.r.ActivePacks()
+		}
+		return nil, ExecFile(as.r, cmd, packs)
+	}
+}
+
+// setStatus возвращает обработчик активации или блокировки пакетов
+func (as *apiServer) setStatus(status int) apiHandler {
+	return func(req *apiRequest) (interface{}, error) {
+		if len(req.Packages) == 0 {
+			return nil, &InternalError{Text: "укажите по крайней мере один пакет", Caller: "API::setStatus"}
+		}
+		return nil, SetPackStatus(as.r, status, req.Packages)
+	}
+}
+
+// aliasSet устанавливает псевдонимы пакетов
+func (as *apiServer) aliasSet(req *apiRequest) (interface{}, error) {
+	if len(req.Aliases) == 0 {
+		return nil, &InternalError{Text: "укажите по крайней мере 1 пару ПАКЕТ: ПСЕВДОНИМ", Caller: "API::aliasSet"}
+	}
+	aliases := make([]string, 0, len(req.Aliases))
+	for pack, alias := range req.Aliases {
+		aliases = append(aliases, pack+"="+alias)
+	}
+	sort.Strings(aliases)
+	return nil, Alias(as.r, "set", aliases)
+}
+
+// regl активирует или деактивирует режим регламента
+func (as *apiServer) regl(req *apiRequest) (interface{}, error) {
+	if req.Mode != "on" && req.Mode != "off" {
+		return nil, &InternalError{Text: "укажите режим регламента: on | off", Caller: "API::regl"}
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			return nil, &InternalError{
+				Text:   fmt.Sprintf("неверная продолжительность работ %q", req.TTL),
+				Caller: "API::regl",
+				Err:    err,
+			}
+		}
+	}
+	return nil, SetReglamentMode(as.r.path, req.Mode, req.Reason, ttl, req.Force)
+}
+
+// index индексирует указанные или все активные пакеты
+func (as *apiServer) index(req *apiRequest) (interface{}, error) {
+	packs := req.Packages
+	if len(packs) == 0 {
+		packs = as.r.ActivePacks()
+	}
+	for _, pack := range packs {
+		if !as.r.PackIsActive(pack) {
+			return nil, &InternalError{
+				Text:   fmt.Sprintf("пакет %q заблокирован или отсутствует в репозитории", pack),
+				Caller: "API::index",
+			}
+		}
+	}
+	return nil, Index(as.r, req.Full, packs)
+}
+
+// writeAPIJSON выводит документ ответа API
+func writeAPIJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// writeAPIError выводит ответ API с ошибкой
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	writeAPIJSON(w, code, apiResponse{Error: msg})
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"fmt"
+)
+
+// Audit обрабатывает команду audit
+// show - выводит журнал операций с репозиторием: блокировка и активация пакетов,
+// псевдонимы, исполняемые файлы, индексация, выгрузка, очистка и миграция БД.
+// since - начало периода (24h, 7d, 2006-01-02); pack - записи указанного пакета
+func Audit(r *Repo, cmd, since, pack string) error {
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	switch cmd {
+	case "", "show":
+	default:
+		return &InternalError{
+			Text:   fmt.Sprintf("неверная команда %q. укажите 'show'", cmd),
+			Caller: "Audit",
+		}
+	}
+	from, err := parseSince(since)
+	if err != nil {
+		return err
+	}
+	entries, err := r.auditEntries(from, pack)
+	if err != nil {
+		return err
+	}
+	if OutputIsJSON() {
+		return printJSON(entries)
+	}
+	if len(entries) == 0 {
+		fmt.Println("Журнал операций пуст")
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Printf("%s  %s@%s  %s", e.Time.Format("2006-01-02 15:04:05"), e.Operator, e.Host, e.Command)
+		if e.Package != "" {
+			fmt.Printf(" [ %s ]", e.Package)
+		}
+		fmt.Println()
+		if e.Before != "" {
+			fmt.Printf("    было:  %s\n", e.Before)
+		}
+		if e.After != "" {
+			fmt.Printf("    стало: %s\n", e.After)
+		}
+	}
+	return nil
+}
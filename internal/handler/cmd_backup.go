@@ -0,0 +1,655 @@
+package handler
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	fnBackupInfo       = "backup.json"     // описание резервной копии в архиве
+	backupStampLayout  = "20060102-150405" // метка времени в имени архива
+	backupDirSuffix    = "-backup"         // суффикс каталога резервных копий по-умолчанию
+	backupArchiveExt   = ".zip"
+	backupDisplayStamp = "2006-01-02 15:04:05"
+	backupReadAttempts = 3 // попыток согласованного чтения опубликованного индекс-файла
+)
+
+// backupFile содержимое и дата изменения файла репозитория для резервной копии
+type backupFile struct {
+	data  []byte
+	mtime time.Time
+}
+
+// backupInfo описание резервной копии
+type backupInfo struct {
+	Created   time.Time `json:"created"`    // время создания
+	Repo      string    `json:"repo"`       // путь к репозиторию
+	DBVersion string    `json:"db_version"` // версия БД
+	Files     []string  `json:"files"`      // файлы репозитория в архиве
+}
+
+// Backup обрабатывает команду `backup`
+// создает в каталоге dest архив с согласованной копией БД (VACUUM INTO), опубликованным индекс-файлом,
+// его подписью и хэш-файлом и файлом режима регламента. Индекс-файл, подпись и хэш-файл читаются согласованно
+// с выгрузкой другим процессом. Имя архива содержит имя репозитория и время создания.
+// Каталог по-умолчанию - `<репозиторий>-backup` рядом с каталогом репозитория; внутри репозитория не допускается.
+// keep > 0 - хранить указанное количество последних копий, более старые удаляются
+func Backup(r *Repo, dest string, keep int) error {
+	if keep < 0 {
+		return &InternalError{
+			Text:   "количество хранимых копий не может быть отрицательным",
+			Caller: "Backup",
+		}
+	}
+	repoPath, err := filepath.Abs(r.path)
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка определения пути к репозиторию",
+			Caller: "Backup",
+			Err:    err,
+		}
+	}
+	if dest == "" {
+		dest = repoPath + backupDirSuffix
+	}
+	if dest, err = filepath.Abs(dest); err != nil {
+		return &InternalError{
+			Text:   "ошибка определения пути к каталогу резервных копий",
+			Caller: "Backup",
+			Err:    err,
+		}
+	}
+	// каталог внутри репозитория был бы принят за пакет
+	if rel, err := filepath.Rel(repoPath, dest); err == nil && !strings.HasPrefix(rel, "..") {
+		return &InternalError{
+			Text:   fmt.Sprintf("каталог резервных копий %q не должен находиться в репозитории", dest),
+			Caller: "Backup",
+		}
+	}
+	if err = os.MkdirAll(dest, 0755); err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка создания каталога резервных копий %q", dest),
+			Caller: "Backup",
+			Err:    err,
+		}
+	}
+
+	vMaj, vMin, err := r.versionDB()
+	if err != nil {
+		return err
+	}
+	info := backupInfo{
+		Created:   time.Now().Truncate(time.Second),
+		Repo:      repoPath,
+		DBVersion: fmt.Sprintf("%d.%d", vMaj, vMin),
+	}
+	prefix := filepath.Base(repoPath) + "-"
+	fpArchive := filepath.Join(dest, prefix+info.Created.Format(backupStampLayout)+backupArchiveExt)
+	if fileExists(fpArchive) {
+		return &InternalError{
+			Text:   fmt.Sprintf("резервная копия %q уже существует", fpArchive),
+			Caller: "Backup",
+		}
+	}
+
+	fmt.Print("Создание резервной копии: ")
+	// копия БД создается средствами SQLite и согласована при одновременной записи другим процессом
+	fpDB := filepath.Join(dest, fileDBName+suffixTmp)
+	_ = os.Remove(fpDB)
+	defer os.Remove(fpDB)
+	if _, err = r.db.Exec("VACUUM INTO ?;", fpDB); err != nil {
+		fmt.Println("ошибка")
+		return &InternalError{
+			Text:   "ошибка создания копии БД",
+			Caller: "Backup::VacuumInto",
+			Err:    err,
+		}
+	}
+	files := map[string]string{fileDBName: fpDB}
+	// индекс-файл, подпись и хэш-файл могут заменяться выгрузкой другого процесса:
+	// в архив записываются копии файлов, прочитанные согласованно
+	published, err := readPublishedFiles(repoPath)
+	if err != nil {
+		fmt.Println("ошибка")
+		return err
+	}
+	for name, bf := range published {
+		fp := filepath.Join(dest, name+suffixTmp)
+		if err = writeFileSync(fp, bf.data); err == nil {
+			err = os.Chtimes(fp, bf.mtime, bf.mtime)
+		}
+		defer os.Remove(fp)
+		if err != nil {
+			fmt.Println("ошибка")
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка копирования файла %s", name),
+				Caller: "Backup",
+				Err:    err,
+			}
+		}
+		files[name] = fp
+	}
+	for name := range files {
+		info.Files = append(info.Files, name)
+	}
+	sort.Strings(info.Files)
+
+	if err = writeBackupArchive(fpArchive, &info, files); err != nil {
+		fmt.Println("ошибка")
+		return err
+	}
+	fmt.Println("OK")
+	fmt.Printf("  %s\n  файлы: %s\n", fpArchive, strings.Join(info.Files, ", "))
+
+	if keep > 0 {
+		return removeOldBackups(dest, prefix, keep)
+	}
+	return nil
+}
+
+// readPublishedFiles читает опубликованный индекс-файл, его хэш-файл, подпись и файл режима регламента.
+// Выгрузка публикует индекс-файл, подпись, затем хэш-файл, поэтому файлы читаются в обратном порядке:
+// если хэш-сумма индекс-файла совпадает с хэш-файлом, прочитанная между ними подпись соответствует
+// индекс-файлу. При несовпадении (выгрузка во время чтения) чтение повторяется
+func readPublishedFiles(repoPath string) (map[string]*backupFile, error) {
+	read := func(name string) (*backupFile, error) {
+		fp := filepath.Join(repoPath, name)
+		fi, err := os.Stat(fp)
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(fp)
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &backupFile{data: data, mtime: fi.ModTime()}, nil
+	}
+
+	for attempt := 0; attempt < backupReadAttempts; attempt++ {
+		files := map[string]*backupFile{}
+		var err error
+		for _, name := range append(indexHashFileNames(), IndexSig, IndexGZ, fnReglament) {
+			var bf *backupFile
+			if bf, err = read(name); err != nil {
+				break
+			} else if bf != nil {
+				files[name] = bf
+			}
+		}
+		if err != nil {
+			return nil, &InternalError{
+				Text:   "ошибка чтения опубликованного индекс-файла",
+				Caller: "Backup::readPublished",
+				Err:    err,
+			}
+		}
+		index, ok := files[IndexGZ]
+		if !ok {
+			// индекс-файл не опубликован: подпись и хэш-файлы не имеют смысла
+			for _, name := range append(indexHashFileNames(), IndexSig) {
+				delete(files, name)
+			}
+			return files, nil
+		}
+		// хэш-файлы, не соответствующие индекс-файлу, остаются от прежнего алгоритма
+		matched, hashed := false, false
+		for _, name := range HashAlgoNames() {
+			fn := hashFileName(hashAlgos[name])
+			if bf, ok := files[fn]; ok {
+				hashed = true
+				if strings.TrimSpace(string(bf.data)) == hashSum(hashAlgos[name], string(index.data)) {
+					matched = true
+				} else {
+					delete(files, fn)
+				}
+			}
+		}
+		if matched || !hashed {
+			return files, nil
+		}
+		time.Sleep(time.Second)
+	}
+	return nil, &InternalError{
+		Text:   "индекс-файл изменяется во время резервного копирования. Повторите команду или установите режим регламента",
+		Caller: "Backup::readPublished",
+	}
+}
+
+// indexHashFileNames возвращает имена хэш-файлов индекс-файла всех алгоритмов
+func indexHashFileNames() []string {
+	var names []string
+	for _, name := range HashAlgoNames() {
+		names = append(names, hashFileName(hashAlgos[name]))
+	}
+	return names
+}
+
+// Restore обрабатывает команду `restore`
+// восстанавливает БД, индекс-файл, его подпись и хэш-файл из архива резервной копии.
+// Перед заменой проверяются целостность и версия БД архива; текущая БД сохраняется с суффиксом .prev,
+// записи ее журнала операций переносятся в восстановленную БД. При ошибке замены любого файла
+// восстанавливаются прежние файлы.
+// Файл режима регламента из архива не восстанавливается. Выполняется в режиме регламента
+func Restore(repoPath, fpArchive string) error {
+	if err = checkRegl(repoPath); err != nil {
+		return err
+	}
+	if fpArchive == "" {
+		return &InternalError{
+			Text:   "укажите файл резервной копии",
+			Caller: "Restore",
+		}
+	}
+	zr, err := zip.OpenReader(fpArchive)
+	if err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка открытия резервной копии %q", fpArchive),
+			Caller: "Restore",
+			Err:    err,
+		}
+	}
+	defer zr.Close()
+
+	// файлы архива распаковываются во временные файлы в каталоге репозитория
+	var info backupInfo
+	restored := map[string]string{}
+	defer func() {
+		for _, fp := range restored {
+			_ = os.Remove(fp)
+		}
+	}()
+	for _, zf := range zr.File {
+		if zf.Name == fnBackupInfo {
+			if err = readBackupInfo(zf, &info); err != nil {
+				return err
+			}
+			continue
+		}
+		if !isBackupFile(zf.Name) || zf.Name == fnReglament {
+			continue
+		}
+		fp := filepath.Join(repoPath, zf.Name+suffixTmp)
+		if err = extractZipFile(zf, fp); err != nil {
+			return err
+		}
+		restored[zf.Name] = fp
+	}
+	if _, ok := restored[fileDBName]; !ok {
+		return &InternalError{
+			Text:   fmt.Sprintf("в архиве %q отсутствует файл БД %s", fpArchive, fileDBName),
+			Caller: "Restore",
+		}
+	}
+	migrate, err := checkBackupDB(restored[fileDBName])
+	if err != nil {
+		return err
+	}
+
+	if !info.Created.IsZero() {
+		fmt.Printf("Резервная копия от %s, версия БД %s\n", info.Created.Local().Format(backupDisplayStamp), info.DBVersion)
+	}
+	if !userAccept("Данные БД и опубликованный индекс-файл будут заменены данными резервной копии") {
+		return nil
+	}
+	restoreAudit(restored[fileDBName], pathDB(repoPath), fpArchive, &info)
+
+	fmt.Print("Восстановление из резервной копии: ")
+	fpDB := pathDB(repoPath)
+	// индекс-файл публикуется последним: до его замены клиенты получают прежнюю версию целиком
+	var names []string
+	for name := range restored {
+		if name != IndexGZ {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := restored[IndexGZ]; ok {
+		names = append(names, IndexGZ)
+	}
+	if err = replaceFiles(repoPath, names, restored); err != nil {
+		fmt.Println("ошибка")
+		return err
+	}
+	// копия заменяемой БД сохраняется как предыдущая версия
+	if fileExists(fpDB + suffixOrig) {
+		if err = os.Rename(fpDB+suffixOrig, fpDB+suffixPrev); err != nil {
+			fmt.Printf("ошибка\n! предыдущая БД сохранена: %s\n", fpDB+suffixOrig)
+			return &InternalError{
+				Text:   "ошибка сохранения текущей БД",
+				Caller: "Restore::Rename",
+				Err:    err,
+			}
+		}
+	}
+	// подпись и хэш-файлы, отсутствующие в копии, не соответствуют восстановленному индекс-файлу
+	if containsString(names, IndexGZ) {
+		if !containsString(names, IndexSig) {
+			_ = os.Remove(filepath.Join(repoPath, IndexSig))
+		}
+		for _, name := range names {
+			if isIndexHashFile(name) {
+				removeHashFiles(repoPath, path.Join(repoPath, name))
+			}
+		}
+		// разностные файлы сформированы к замененному индекс-файлу
+		if err = removeDeltas(repoPath); err != nil {
+			fmt.Printf("\n! каталог %s не удален: %v\n", DeltaDir, err)
+		}
+	}
+	fmt.Println("OK")
+	fmt.Printf("  файлы: %s\n  предыдущая БД сохранена: %s\n", strings.Join(names, ", "), fpDB+suffixPrev)
+	if migrate {
+		fmt.Println("\n\tТребуется миграция БД репозитория командой 'migrate'")
+	}
+	return nil
+}
+
+// replaceFiles заменяет файлы репозитория names временными файлами tmp в указанном порядке.
+// Перед заменой создаются копии текущих файлов с суффиксом .orig; при ошибке замененные файлы
+// восстанавливаются из копий. Копия БД сохраняется, копии остальных файлов удаляются
+func replaceFiles(repoPath string, names []string, tmp map[string]string) error {
+	var saved, replaced []string
+	rollback := func() {
+		for i := len(replaced) - 1; i >= 0; i-- {
+			fp := filepath.Join(repoPath, replaced[i])
+			if containsString(saved, replaced[i]) {
+				_ = os.Rename(fp+suffixOrig, fp)
+			} else {
+				_ = os.Remove(fp)
+			}
+		}
+		for _, name := range saved {
+			_ = os.Remove(filepath.Join(repoPath, name+suffixOrig))
+		}
+	}
+	for _, name := range names {
+		fp := filepath.Join(repoPath, name)
+		if !fileExists(fp) {
+			continue
+		}
+		_ = os.Remove(fp + suffixOrig)
+		if err := linkFile(fp, fp+suffixOrig); err != nil {
+			rollback()
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка сохранения файла %s", name),
+				Caller: "Restore::replaceFiles",
+				Err:    err,
+			}
+		}
+		saved = append(saved, name)
+	}
+	for _, name := range names {
+		if err := os.Rename(tmp[name], filepath.Join(repoPath, name)); err != nil {
+			rollback()
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка восстановления файла %s. Восстановлены прежние файлы", name),
+				Caller: "Restore::replaceFiles",
+				Err:    err,
+			}
+		}
+		replaced = append(replaced, name)
+		delete(tmp, name)
+	}
+	for _, name := range saved {
+		if name != fileDBName {
+			_ = os.Remove(filepath.Join(repoPath, name+suffixOrig))
+		}
+	}
+	return nil
+}
+
+// restoreAudit переносит в журнал операций восстанавливаемой БД fp записи журнала текущей БД fpCur,
+// сделанные после создания резервной копии, и записывает в журнал операцию восстановления.
+// Ошибка не прерывает восстановление
+func restoreAudit(fp, fpCur, fpArchive string, info *backupInfo) {
+	db, err := newConnection(fp)
+	if err != nil {
+		fmt.Printf("! журнал операций не перенесен: %v\n", err)
+		return
+	}
+	defer db.Close()
+	if fileExists(fpCur) {
+		if _, err = copyAudit(db, fpCur); err != nil {
+			fmt.Printf("! журнал операций текущей БД не перенесен: %v\n", err)
+		}
+	}
+	after := "архив " + fpArchive
+	if !info.Created.IsZero() {
+		after += " от " + info.Created.Local().Format(backupDisplayStamp)
+	}
+	(&Repo{db: db}).audit(auditRestore, "", "", after)
+}
+
+// backupFileNames возвращает имена файлов репозитория, сохраняемых в резервной копии, кроме БД
+func backupFileNames() []string {
+	return append([]string{IndexGZ, IndexSig, fnReglament}, indexHashFileNames()...)
+}
+
+// isBackupFile проверяет, является ли имя файла архива файлом репозитория
+func isBackupFile(name string) bool {
+	if name == fileDBName {
+		return true
+	}
+	return containsString(backupFileNames(), name)
+}
+
+// containsString проверяет наличие строки в списке
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBackupDB проверяет целостность и версию БД резервной копии.
+// Возвращает true, если БД требуется миграция на версию программы
+func checkBackupDB(fp string) (bool, error) {
+	db, err := newConnection(fp)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	r := &Repo{db: db}
+	if err = r.checkDB(); err != nil {
+		return false, err
+	}
+	vMaj, vMin, err := r.versionDB()
+	if err != nil {
+		return false, err
+	}
+	if vMaj == DBVersionMajor && vMin == DBVersionMinor {
+		return false, nil
+	}
+	if vMaj > DBVersionMajor || (vMaj == DBVersionMajor && vMin > DBVersionMinor) {
+		return false, &InternalError{
+			Text: fmt.Sprintf("версия БД резервной копии [%d.%d] старше требуемой [%d.%d]; возможно вы используете старую версию программы",
+				vMaj, vMin, DBVersionMajor, DBVersionMinor),
+			Caller: "Restore::checkDB",
+		}
+	}
+	if _, err = migrationPlan(vMaj, vMin); err != nil {
+		return false, &InternalError{
+			Text:   fmt.Sprintf("версия БД резервной копии [%d.%d] не поддерживается", vMaj, vMin),
+			Caller: "Restore::checkDB",
+			Err:    err,
+		}
+	}
+	return true, nil
+}
+
+// writeBackupArchive записывает архив резервной копии во временный файл и переименовывает его
+func writeBackupArchive(fpArchive string, info *backupInfo, files map[string]string) error {
+	tmp := fpArchive + suffixTmp
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка создания архива резервной копии",
+			Caller: "Backup::writeArchive",
+			Err:    err,
+		}
+	}
+	defer os.Remove(tmp)
+	zw := zip.NewWriter(f)
+	err = func() error {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fnBackupInfo, Method: zip.Deflate, Modified: info.Created})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		for _, name := range info.Files {
+			if err = addZipFile(zw, name, files[name]); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}()
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, fpArchive)
+	}
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка записи архива резервной копии",
+			Caller: "Backup::writeArchive",
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// addZipFile добавляет файл fp в архив под именем name
+func addZipFile(zw *zip.Writer, name, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// readBackupInfo читает описание резервной копии из архива
+func readBackupInfo(zf *zip.File, info *backupInfo) error {
+	rc, err := zf.Open()
+	if err == nil {
+		var data []byte
+		if data, err = ioutil.ReadAll(rc); err == nil {
+			err = json.Unmarshal(data, info)
+		}
+		_ = rc.Close()
+	}
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка чтения описания резервной копии",
+			Caller: "Restore::readInfo",
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// extractZipFile распаковывает файл архива в файл fp
+func extractZipFile(zf *zip.File, fp string) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения файла %s из архива", zf.Name),
+			Caller: "Restore::extract",
+			Err:    err,
+		}
+	}
+	defer rc.Close()
+	f, err := os.Create(fp)
+	if err == nil {
+		if _, err = io.Copy(f, rc); err == nil {
+			err = f.Sync()
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err == nil {
+			err = os.Chtimes(fp, zf.Modified, zf.Modified)
+		}
+	}
+	if err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка распаковки файла %s", zf.Name),
+			Caller: "Restore::extract",
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// removeOldBackups удаляет архивы резервных копий репозитория, кроме keep последних
+func removeOldBackups(dest, prefix string, keep int) error {
+	list, err := filepath.Glob(filepath.Join(dest, prefix+"*"+backupArchiveExt))
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка поиска резервных копий",
+			Caller: "Backup::removeOld",
+			Err:    err,
+		}
+	}
+	var archives []string
+	for _, fp := range list {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fp), prefix), backupArchiveExt)
+		if _, err := time.Parse(backupStampLayout, stamp); err == nil {
+			archives = append(archives, fp)
+		}
+	}
+	// метка времени в имени упорядочивает архивы по времени создания
+	sort.Strings(archives)
+	for len(archives) > keep {
+		if err = os.Remove(archives[0]); err != nil {
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка удаления резервной копии %q", archives[0]),
+				Caller: "Backup::removeOld",
+				Err:    err,
+			}
+		}
+		fmt.Printf("  удалена устаревшая копия: %s\n", archives[0])
+		archives = archives[1:]
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"fmt"
+)
+
+// CasePolicy обрабатывает команду `case`
+// без параметров выводит политику сравнения имен пакетов и путей файлов репозитория
+// и имена, различающиеся только регистром символов.
+// sensitive - сравнение с учетом регистра (по-умолчанию)
+// insensitive - сравнение без учета регистра: для репозитория на файловой системе Windows,
+// где `Pack` и `pack` - один каталог. Устанавливается в режиме регламента
+// при отсутствии имен, различающихся только регистром
+func CasePolicy(r *Repo, policy string) error {
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	switch policy {
+	case "", "show":
+		fmt.Println("Сравнение имен пакетов и файлов:", r.casePolicyName())
+		report, err := r.caseCollisions()
+		if err != nil {
+			return err
+		}
+		if len(report) > 0 {
+			fmt.Println("\nИмена, различающиеся только регистром символов:")
+			for _, line := range report {
+				fmt.Printf("  %s\n", line)
+			}
+		}
+		return nil
+	case CaseSensitive, CaseInsensitive:
+	default:
+		return &InternalError{
+			Text:   fmt.Sprintf("неверная политика %q. укажите одну из [ '%s' | '%s' ]", policy, CaseSensitive, CaseInsensitive),
+			Caller: "CasePolicy",
+		}
+	}
+
+	if err = checkRegl(r.path); err != nil {
+		return err
+	}
+	if policy == CaseInsensitive {
+		report, err := r.caseCollisions()
+		if err != nil {
+			return err
+		}
+		if len(report) > 0 {
+			for _, line := range report {
+				fmt.Printf("  %s\n", line)
+			}
+			return &InternalError{
+				Text:   "имена различаются только регистром символов. Переименуйте пакеты, псевдонимы или файлы",
+				Caller: "CasePolicy",
+			}
+		}
+	}
+	if err = r.setCasePolicy(policy); err != nil {
+		return err
+	}
+	fmt.Println("Установлено сравнение имен пакетов и файлов:", r.casePolicyName())
+	fmt.Print(doIndexMsg, doPopMsg)
+	return nil
+}
+
+// casePolicyName возвращает описание политики сравнения имен репозитория
+func (r *Repo) casePolicyName() string {
+	if r.caseInsensitive() {
+		return CaseInsensitive + " (без учета регистра)"
+	}
+	return CaseSensitive + " (с учетом регистра)"
+}
@@ -22,9 +22,11 @@ func ClearDB(r *Repo, cmd string) error {
 			return nil
 		}
 		fmt.Print("Очистка данных индексации пакетов...")
+		count := len(r.packages())
 		if err = r.cleanPackagesDB(); err != nil {
 			return err
 		}
+		r.audit(auditClearDB+" index", "", fmt.Sprintf("пакетов: %d", count), "пакетов: 0")
 		fmt.Println("OK")
 		if cmd != "all" {
 			break
@@ -35,9 +37,11 @@ func ClearDB(r *Repo, cmd string) error {
 			return nil
 		}
 		fmt.Print("Очистка данных псевдонимов...")
+		count := len(r.aliases())
 		if err = r.cleanAliasesDB(); err != nil {
 			return err
 		}
+		r.audit(auditClearDB+" alias", "", fmt.Sprintf("псевдонимов: %d", count), "псевдонимов: 0")
 		fmt.Println("OK")
 		if cmd != "all" {
 			break
@@ -48,9 +52,11 @@ func ClearDB(r *Repo, cmd string) error {
 			return nil
 		}
 		fmt.Print("Очистка данных блокировки...")
+		count := len(r.disabledPacks())
 		if err = r.cleanStatusDB(); err != nil {
 			return err
 		}
+		r.audit(auditClearDB+" status", "", fmt.Sprintf("блокировок: %d", count), "блокировок: 0")
 		fmt.Println("OK")
 	default:
 		return &InternalError{
@@ -59,9 +65,9 @@ func ClearDB(r *Repo, cmd string) error {
 		}
 	}
 	if cmd == "alias" {
-		fmt.Println(doPopMsg)
+		fmt.Print(doPopMsg)
 	} else {
-		fmt.Println(doIndexMsg)
+		fmt.Print(doIndexMsg)
 	}
 	return nil
 }
@@ -0,0 +1,384 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// configVersion версия формата документа конфигурации
+const configVersion = 1
+
+// ConfigDocument конфигурация репозитория: псевдонимы, блокировки, исполняемые файлы
+// и шаблоны исключения файлов. Отсутствующий в документе раздел при импорте не изменяется
+type ConfigDocument struct {
+	Version int               `json:"version"` // версия формата документа
+	Aliases map[string]string `json:"aliases"` // псевдонимы: пакет - псевдоним
+	Blocked []string          `json:"blocked"` // заблокированные пакеты
+	Exec    map[string]string `json:"exec"`    // исполняемые файлы: пакет - файл | noexec
+	Ignore  []string          `json:"ignore"`  // шаблоны исключения файлов
+}
+
+// configChange изменение конфигурации репозитория при импорте
+type configChange struct {
+	op      byte                      // '+' - добавление, '-' - удаление, '~' - изменение, 0 - служебный шаг
+	section string                    // раздел конфигурации
+	name    string                    // пакет или шаблон
+	before  string                    // значение до изменения
+	after   string                    // значение после изменения
+	apply   func(db dbExecutor) error // применение изменения в транзакции импорта
+}
+
+// String возвращает описание изменения для предварительного просмотра
+func (c configChange) String() string {
+	s := fmt.Sprintf("%c %-8s %s", c.op, c.section, c.name)
+	switch c.op {
+	case '~':
+		s += fmt.Sprintf(": %s -> %s", c.before, c.after)
+	case '+':
+		if c.after != "" {
+			s += "=" + c.after
+		}
+	case '-':
+		if c.before != "" {
+			s += "=" + c.before
+		}
+	}
+	return s
+}
+
+// Config обрабатывает команду `config`
+// export - выгружает конфигурацию репозитория в файл fp (без указания файла - на стандартный вывод)
+// import - применяет конфигурацию из файла fp: выводит изменения и после подтверждения применяет их.
+// prune - удаление псевдонимов, блокировок, исполняемых файлов и шаблонов, отсутствующих в разделах файла;
+// dryRun - вывод изменений без применения
+func Config(r *Repo, cmd, fp string, prune, dryRun bool) error {
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	switch cmd {
+	case "export":
+		doc, err := r.configDocument()
+		if err != nil {
+			return err
+		}
+		if fp == "" {
+			return printJSON(doc)
+		}
+		data, _ := json.MarshalIndent(doc, "", "  ")
+		if err = writeFileSync(fp, append(data, '\n')); err != nil {
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка записи файла конфигурации %s", fp),
+				Caller: "Config::export",
+				Err:    err,
+			}
+		}
+		fmt.Println("Конфигурация репозитория выгружена в файл", fp)
+	case "import":
+		doc, err := readConfigDocument(fp)
+		if err != nil {
+			return err
+		}
+		changes, warnings, err := r.configPlan(doc, prune)
+		if err != nil {
+			return err
+		}
+		for _, w := range warnings {
+			fmt.Printf("  ! %s\n", w)
+		}
+		if len(changes) == 0 {
+			fmt.Println("Конфигурация репозитория соответствует файлу")
+			return nil
+		}
+		fmt.Println("Изменения конфигурации:")
+		for _, c := range changes {
+			if c.op != 0 {
+				fmt.Printf("  %v\n", c)
+			}
+		}
+		if dryRun || !userAccept("\nПрименить изменения") {
+			return nil
+		}
+		fmt.Println()
+		return r.applyConfig(changes)
+	default:
+		return &InternalError{
+			Text:   fmt.Sprintf("неверная команда %q. укажите одну из [ 'export' | 'import' ]", cmd),
+			Caller: "Config",
+		}
+	}
+	return nil
+}
+
+// configDocument возвращает текущую конфигурацию репозитория
+func (r *Repo) configDocument() (*ConfigDocument, error) {
+	doc := &ConfigDocument{
+		Version: configVersion,
+		Aliases: map[string]string{},
+		Blocked: append([]string{}, r.disabledPacks()...),
+		Exec:    map[string]string{},
+		Ignore:  append([]string{}, r.ignorePatterns()...),
+	}
+	sort.Strings(doc.Blocked)
+	for _, pair := range r.aliases() {
+		doc.Aliases[pair[0]] = pair[1]
+	}
+	for _, pack := range r.packages() {
+		execFile, err := r.execFileInfo(pack)
+		if err != nil {
+			return nil, err
+		}
+		if execFile != "" {
+			doc.Exec[pack] = execFile
+		}
+	}
+	return doc, nil
+}
+
+// readConfigDocument читает документ конфигурации; неизвестные поля считаются ошибкой
+func readConfigDocument(fp string) (*ConfigDocument, error) {
+	if fp == "" {
+		return nil, &InternalError{
+			Text:   "укажите файл конфигурации",
+			Caller: "Config::import",
+		}
+	}
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения файла конфигурации %s", fp),
+			Caller: "Config::import",
+			Err:    err,
+		}
+	}
+	doc := new(ConfigDocument)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(doc); err != nil {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка разбора файла конфигурации %s", fp),
+			Caller: "Config::import",
+			Err:    err,
+		}
+	}
+	if doc.Version != configVersion {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("версия файла конфигурации %d не поддерживается", doc.Version),
+			Caller: "Config::import",
+		}
+	}
+	return doc, nil
+}
+
+// configPlan сравнивает конфигурацию репозитория с документом и возвращает список изменений
+// в порядке применения: шаблоны исключения, блокировки, псевдонимы, исполняемые файлы.
+// Записи для пакетов, отсутствующих в репозитории, пропускаются с предупреждением
+func (r *Repo) configPlan(doc *ConfigDocument, prune bool) (changes []configChange, warnings []string, err error) {
+	if doc.Ignore != nil {
+		current := r.ignorePatterns()
+		for _, p := range doc.Ignore {
+			p := p
+			if containsString(current, p) {
+				continue
+			}
+			if err := validIgnorePattern(p); err != nil {
+				warnings = append(warnings, fmt.Sprintf("шаблон %q: %v", p, err))
+				continue
+			}
+			changes = append(changes, configChange{op: '+', section: "ignore", name: p,
+				apply: func(db dbExecutor) error { return r.addIgnore(db, p) }})
+		}
+		if prune {
+			for _, p := range current {
+				p := p
+				if !containsString(doc.Ignore, p) {
+					changes = append(changes, configChange{op: '-', section: "ignore", name: p,
+						apply: func(db dbExecutor) error { return r.delIgnore(db, p) }})
+				}
+			}
+		}
+	}
+
+	// пакеты, блокируемые при импорте, не учитываются в разделах псевдонимов и исполняемых файлов
+	blocking := map[string]bool{}
+	if doc.Blocked != nil {
+		var blocked []string
+		for _, name := range doc.Blocked {
+			pack := r.packName(name)
+			blocked = append(blocked, pack)
+			if r.packIsBlocked(pack) {
+				continue
+			}
+			if !r.PackIsActive(pack) {
+				warnings = append(warnings, fmt.Sprintf("blocked: пакет %q не найден", name))
+				continue
+			}
+			blocking[pack] = true
+			changes = append(changes, configChange{op: '+', section: "blocked", name: pack,
+				apply: func(db dbExecutor) error { return r.disablePack(db, pack) }})
+		}
+		if prune {
+			for _, pack := range r.disabledPacks() {
+				pack := pack
+				if !containsString(blocked, pack) {
+					changes = append(changes, configChange{op: '-', section: "blocked", name: pack,
+						apply: func(db dbExecutor) error { return r.enablePack(db, pack) }})
+				}
+			}
+		}
+	}
+
+	if doc.Aliases != nil {
+		current := map[string]string{}
+		for _, pair := range r.aliases() {
+			current[pair[0]] = pair[1]
+		}
+		// освобождаемые псевдонимы удаляются до установки новых: при изменении псевдонима
+		// прежний удаляется служебным шагом, не выводимым в списке изменений
+		var dels, sets []configChange
+		wanted := map[string]bool{}
+		for _, name := range sortedKeys(doc.Aliases) {
+			pack, alias := r.packName(name), doc.Aliases[name]
+			wanted[pack] = true
+			before := current[pack]
+			if before == alias {
+				continue
+			}
+			if !r.PackIsActive(pack) || blocking[pack] {
+				warnings = append(warnings, fmt.Sprintf("aliases: пакет %q не найден или заблокирован", name))
+				continue
+			}
+			if before != "" {
+				dels = append(dels, configChange{apply: func(db dbExecutor) error { return r.delAlias(db, before) }})
+				sets = append(sets, configChange{op: '~', section: "alias", name: pack, before: before, after: alias,
+					apply: func(db dbExecutor) error { return r.setAlias(db, []string{pack, alias}) }})
+				continue
+			}
+			sets = append(sets, configChange{op: '+', section: "alias", name: pack, after: alias,
+				apply: func(db dbExecutor) error { return r.setAlias(db, []string{pack, alias}) }})
+		}
+		if prune {
+			for _, pack := range sortedKeys(current) {
+				alias := current[pack]
+				if !wanted[pack] {
+					dels = append(dels, configChange{op: '-', section: "alias", name: pack, before: alias,
+						apply: func(db dbExecutor) error { return r.delAlias(db, alias) }})
+				}
+			}
+		}
+		changes = append(changes, dels...)
+		changes = append(changes, sets...)
+	}
+
+	if doc.Exec != nil {
+		wanted := map[string]bool{}
+		for _, name := range sortedKeys(doc.Exec) {
+			pack, execFile := r.packName(name), doc.Exec[name]
+			wanted[pack] = true
+			if !r.packIsIndexed(pack) || blocking[pack] {
+				warnings = append(warnings, fmt.Sprintf("exec: пакет %q не проиндексирован или заблокирован", name))
+				continue
+			}
+			before, err := r.execFileInfo(pack)
+			if err != nil {
+				return nil, nil, err
+			}
+			if before == execFile {
+				continue
+			}
+			if ok, err := r.execFileValid(pack, execFile); err != nil {
+				return nil, nil, err
+			} else if !ok {
+				warnings = append(warnings, fmt.Sprintf("exec: файл %q не найден в пакете %q", execFile, name))
+				continue
+			}
+			op := byte('~')
+			if before == "" {
+				op = '+'
+			}
+			changes = append(changes, configChange{op: op, section: "exec", name: pack, before: before, after: execFile,
+				apply: func(db dbExecutor) error { return r.setExecFileValue(db, pack, execFile) }})
+		}
+		if prune {
+			for _, pack := range r.packages() {
+				pack := pack
+				if wanted[pack] || blocking[pack] {
+					continue
+				}
+				before, err := r.execFileInfo(pack)
+				if err != nil {
+					return nil, nil, err
+				}
+				if before != "" {
+					changes = append(changes, configChange{op: '-', section: "exec", name: pack, before: before,
+						apply: func(db dbExecutor) error { return r.setExecFileValue(db, pack, "") }})
+				}
+			}
+		}
+	}
+	return changes, warnings, nil
+}
+
+// applyConfig применяет изменения конфигурации в одной транзакции:
+// при ошибке любого изменения отменяются все изменения импорта
+func (r *Repo) applyConfig(changes []configChange) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка начала транзакции",
+			Caller: "Config::apply",
+			Err:    err,
+		}
+	}
+	var reindex, blocked bool
+	for _, c := range changes {
+		if err = c.apply(tx); err != nil {
+			_ = tx.Rollback()
+			r.resetCache()
+			fmt.Println("! изменения конфигурации отменены")
+			return err
+		}
+		switch c.section {
+		case "ignore":
+			reindex = true
+		case "blocked":
+			reindex = true
+			blocked = blocked || c.op == '+'
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		r.resetCache()
+		return &InternalError{
+			Text:   "ошибка фиксации транзакции: изменения конфигурации отменены",
+			Caller: "Config::apply::Commit",
+			Err:    err,
+		}
+	}
+	r.resetCache()
+	// очистка БД от данных заблокированных пакетов
+	if blocked {
+		if err = r.cleanPacks(); err != nil {
+			return err
+		}
+	}
+	if reindex {
+		fmt.Print(doIndexMsg)
+	}
+	if len(r.nullExecFilesList()) > 0 {
+		showEmptyExecFiles(r)
+	}
+	fmt.Print(doPopMsg)
+	return nil
+}
+
+// sortedKeys возвращает упорядоченный список ключей
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -11,6 +11,7 @@ import (
 // del - удаление данных об исполняемом файле
 // show - вывод информации об установленных исполняемых файлах пакета
 func ExecFile(r *Repo, cmd string, packs []string) error {
+	packs = r.packNames(packs)
 	packsCount := len(packs)
 
 	var force bool
@@ -47,16 +48,15 @@ func ExecFile(r *Repo, cmd string, packs []string) error {
 			}
 		}
 	case "show":
-		if packsCount == 0 {
-			packs = r.ActivePacks()
+		execFiles, err := ExecDoc(r, packs)
+		if err != nil {
+			return err
 		}
-
-		for _, pack := range packs {
-			execFile, err := r.execFileInfo(pack)
-			if err != nil {
-				return err
-			}
-			fmt.Printf("\t%v: %v\n", pack, execFile)
+		if OutputIsJSON() {
+			return printJSON(execFiles)
+		}
+		for _, ef := range execFiles {
+			fmt.Printf("\t%v: %v\n", ef.Package, ef.Exec)
 		}
 	default:
 		return &InternalError{
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"fmt"
+)
+
+// Ignore обрабатывает команду `ignore`
+// без параметров выводит список шаблонов исключения файлов репозитория
+// add - добавляет шаблоны исключения (формат .gitignore)
+// del - удаляет шаблоны исключения
+// шаблоны из файла .indexignore в корне пакета применяются только к этому пакету
+func Ignore(r *Repo, cmd string, patterns []string) error {
+	switch cmd {
+	case "add":
+		for _, pattern := range patterns {
+			if err = r.addIgnore(r.db, pattern); err != nil {
+				return err
+			}
+		}
+		fmt.Print(doIndexMsg)
+	case "del":
+		for _, pattern := range patterns {
+			if err = r.delIgnore(r.db, pattern); err != nil {
+				return err
+			}
+		}
+		fmt.Print(doIndexMsg)
+	case "", "show":
+		patterns := r.ignorePatterns()
+		if len(patterns) == 0 {
+			fmt.Println("Список шаблонов исключения пуст")
+		} else {
+			for _, pattern := range patterns {
+				fmt.Println(pattern)
+			}
+		}
+	default:
+		return &InternalError{
+			Text:   fmt.Sprintf("неверная команда %q. укажите одну из [ 'add' | 'del' | 'show' ]", cmd),
+			Caller: "Ignore",
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"path/filepath"
+	"strings"
 )
 
 // Index обработка команды `index` - индексация пакетов в репозитории
@@ -11,23 +12,64 @@ import (
 // при указании имен пакетов, выполняет индексацию указанных
 // имена пакетов содержащие пробел следует передавать в кавычках
 func Index(r *Repo, fullmode bool, packs []string) error {
-	if err = r.checkDBVersion(); err != nil {
+	// пакеты с зафиксированными изменениями и пакеты с отмененными изменениями
+	committed, rolledBack, err := indexPacks(r, fullmode, packs)
+	if err != nil {
 		return err
 	}
 	// флаг наличия изменений в пакете
-	var changed bool
+	changed := len(committed) > 0
+
+	if len(committed) > 0 {
+		fmt.Printf("Изменения зафиксированы: %s\n", strings.Join(committed, ", "))
+	}
+	if len(rolledBack) > 0 {
+		fmt.Printf("Изменения отменены: %s\n", strings.Join(rolledBack, ", "))
+	}
+
+	// вывод данных о неустановленных исполняемых файлах
+	showEmptyExecFiles(r)
+
+	if changed {
+		fmt.Print(doPopMsg)
+	} else {
+		fmt.Print(noChangeMsg)
+	}
+	if len(rolledBack) > 0 {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка индексации пакетов: %d", len(rolledBack)),
+			Caller: "Index",
+		}
+	}
+	return nil
+}
+
+// indexPacks индексирует пакеты и удаляет из БД данные заблокированных и удаленных пакетов.
+// Возвращает пакеты с зафиксированными и с отмененными изменениями
+func indexPacks(r *Repo, fullmode bool, packs []string) (committed, rolledBack []string, err error) {
+	if err = r.checkDBVersion(); err != nil {
+		return nil, nil, err
+	}
 	// проверка установки режима регламента
 	if err = checkRegl(r.path); err != nil {
-		return err
+		return nil, nil, err
+	}
+	if err = r.checkRehash(); err != nil {
+		return nil, nil, err
 	}
 	// проверка на готовность БД
 	if err = r.setPrepare(); err != nil {
-		return err
+		return nil, nil, err
+	}
+	if err = r.packCollisions(); err != nil {
+		return nil, nil, err
 	}
+	// данные пакетов до индексации для журнала операций
+	before := r.packSummaries()
 
-	for _, pack := range packs {
+	for _, pack := range r.packNames(packs) {
 		if pack == "" {
-			return &InternalError{
+			return nil, nil, &InternalError{
 				Text:   "задано пустое имя пакета",
 				Caller: "Index",
 			}
@@ -35,55 +77,185 @@ func Index(r *Repo, fullmode bool, packs []string) error {
 		fmt.Println("[", pack, "]")
 		done, err := processPackIndex(r, fullmode, pack)
 		if err != nil {
-			return err
+			fmt.Printf("  ! изменения пакета отменены: %v\n", err)
+			rolledBack = append(rolledBack, pack)
+			continue
 		}
-		if done && !changed {
-			changed = true
+		if done {
+			committed = append(committed, pack)
 		}
 	}
 	fmt.Println()
-	if err = r.cleanPacks(); err != nil {
-		return err
-	}
-
-	// вывод данных о неустановленных исполняемых файлах
-	showEmptyExecFiles(r)
-
-	if changed {
-		fmt.Println(doPopMsg)
-	} else {
-		fmt.Println(noChangeMsg)
+	err = r.cleanPacks()
+	r.auditPackChanges(auditIndex, before, r.packSummaries())
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+	return committed, rolledBack, nil
 }
 
-// processPackIndex обрабатывает (индексирует) файлы в указанном пакете
-func processPackIndex(r *Repo, fullmode bool, pack string) (bool, error) {
+// processPackIndex обрабатывает (индексирует) файлы в указанном пакете.
+// Данные пакета читаются и контрольные суммы файлов подсчитываются до начала транзакции,
+// изменения данных пакета в БД выполняются в одной транзакции:
+// при ошибке данные пакета остаются в исходном состоянии
+func processPackIndex(r *Repo, fullmode bool, pack string) (packChanged bool, err error) {
 	var (
-		fsInd, dbInd             int         // counters
-		packID                   int64       // ID пакета
-		dbData, fInfo            *FileInfo   // указатель на объект с данными файла
-		fsList, dbList           []*FileInfo // список файлов пакета в БД
-		packChanged, fileChanged bool        // package has changes
-		fpRel                    string      // путь к файлу относительно пакета
+		packID  int64        // ID пакета
+		newPack bool         // пакет не проиндексирован
+		tasks   []*indexTask // список операций с файлами пакета
+		ptx     *packTx      // транзакция индексации пакета
 	)
 
 	packID, err = r.packageID(pack)
 	if err != nil && err.(*InternalError).Err == sql.ErrNoRows { // нет такого пакета
-		if packID, err = r.newPackage(pack); err != nil {
+		packID, newPack = 0, true
+	} else if err != nil {
+		return false, err
+	}
+	if tasks, err = r.indexTasks(fullmode, packID, pack); err != nil {
+		return false, err
+	}
+
+	// описание пакета проверяется до изменения данных файлов
+	ign, err := r.ignoreRules(pack)
+	if err != nil {
+		return false, err
+	}
+	manifest, err := readManifest(filepath.Join(r.path, pack), ign)
+	if err != nil {
+		return false, err
+	}
+	manifestDB, err := r.packManifest(r.db, packID)
+	if err != nil {
+		return false, err
+	}
+
+	// контрольные суммы новых и измененных файлов подсчитываются параллельно
+	// и сохраняются в порядке следования файлов
+	paths := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		if task.op != opFileDel && !task.attr {
+			paths = append(paths, task.fPath)
+		}
+	}
+	done := make(chan struct{})
+	defer close(done)
+	hashes := hashFiles(r.hashAlgo(), paths, r.workers, done)
+	for _, task := range tasks {
+		if task.op != opFileDel && !task.attr {
+			res := <-<-hashes
+			if res.err != nil {
+				return false, res.err
+			}
+			task.fInfo.Hash = res.hash
+		}
+	}
+
+	if ptx, err = r.beginPackTx(); err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			_ = ptx.Rollback()
+		}
+	}()
+
+	if newPack {
+		if packID, err = r.newPackage(ptx, pack); err != nil {
 			return false, err
 		}
-	} else if err != nil {
+		// у нового пакета в БД нет файлов: все операции - добавление
+		for _, task := range tasks {
+			task.fInfo.ID = packID
+		}
+	} else if renamed, err := r.renamePack(ptx, packID, pack); err != nil {
+		// каталог пакета переименован с изменением регистра символов
 		return false, err
+	} else if renamed {
+		fmt.Println("  * имя пакета")
+		packChanged = true
 	}
 
-	fsList = r.filesPackRepo(pack)
+	for _, task := range tasks {
+		switch task.op {
+		case opFileAdd:
+			err = r.addFileData(ptx, task.fInfo)
+		case opFileUpd:
+			err = r.updateFileData(ptx, task.fInfo)
+		case opFileDel:
+			err = r.removeFileData(ptx, task.fInfo)
+		}
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("  %c %s\n", task.op, task.fInfo.Path)
+		packChanged = true
+	}
+
+	if !manifest.equal(manifestDB) {
+		if err = r.updatePackManifest(ptx, packID, manifest); err != nil {
+			return false, err
+		}
+		fmt.Println("  * описание пакета")
+		packChanged = true
+	}
+
+	// пересчитываем контрольную сумму пакета при наличии изменений файлов
+	if packChanged {
+		if err = r.updatePackData(ptx, packID); err != nil {
+			return false, err
+		}
+	}
+	if err = ptx.Commit(); err != nil {
+		return false, &InternalError{
+			Text:   "ошибка фиксации транзакции",
+			Caller: "Index::Commit",
+			Err:    err,
+		}
+	}
+	return packChanged, nil
+}
+
+// indexTasks сверяет списки файлов пакета в репозитории и в БД
+// и возвращает список операций для приведения данных БД в актуальное состояние
+func (r *Repo) indexTasks(fullmode bool, packID int64, pack string) ([]*indexTask, error) {
+	var (
+		fsInd, dbInd   int         // counters
+		dbData, fInfo  *FileInfo   // указатель на объект с данными файла
+		fsList, dbList []*FileInfo // список файлов пакета в репозитории и в БД
+		fileChanged    bool        // file has changes
+		fpRel          string      // путь к файлу относительно пакета
+		tasks          []*indexTask
+	)
+
+	if fsList, err = r.filesPackRepo(pack); err != nil {
+		return nil, err
+	}
 	if dbList, err = r.filesPackDB(packID); err != nil {
-		return false, err
+		return nil, err
 	}
 
 	fsMaxInd := len(fsList) - 1
 	dbMaxInd := len(dbList) - 1
+	packRoot := filepath.Join(r.path, pack)
+
+	// разные имена файлов, совпадающие после нормализации пути, в БД не различимы;
+	// без учета регистра не различимы и имена, отличающиеся только регистром символов
+	for i := 1; i <= fsMaxInd; i++ {
+		prev, cur := relPath(packRoot, fsList[i-1].Path), relPath(packRoot, fsList[i].Path)
+		if prev == cur {
+			return nil, &InternalError{
+				Text:   fmt.Sprintf("файлы %q и %q имеют одинаковый путь после нормализации", fsList[i-1].Path, fsList[i].Path),
+				Caller: "Index::indexTasks",
+			}
+		}
+		if r.comparePaths(prev, cur) == 0 {
+			return nil, &InternalError{
+				Text:   fmt.Sprintf("файлы %q и %q различаются только регистром символов", fsList[i-1].Path, fsList[i].Path),
+				Caller: "Index::indexTasks",
+			}
+		}
+	}
 
 	for {
 		// завершили обход списков
@@ -92,132 +264,263 @@ func processPackIndex(r *Repo, fullmode bool, pack string) (bool, error) {
 		}
 
 		// Вариант1: Новый пакет или пакет удален
-		// пакета нет в БД - добавить
+		// файла нет в БД - добавить
 		if dbInd > dbMaxInd {
-			// добавляем запись о файле в БД
 			fInfo = fsList[fsInd]
-			fInfo.ID = packID
-			if fInfo.Hash, err = getFileHash(fInfo.Path); err != nil {
-				return false, err
-			}
-			fpRel, _ = filepath.Rel(filepath.Join(r.path, pack), fInfo.Path)
-			fInfo.Path = fpRel
-
-			if err = r.addFileData(fInfo); err != nil {
-				return false, err
-			}
-
-			fmt.Println("  +", fInfo.Path)
-			fsInd++
-			if !packChanged {
-				packChanged = true
-			}
+			fpRel = relPath(packRoot, fInfo.Path)
+			tasks = append(tasks, newAddTask(packID, fInfo, fpRel))
 			//next path in FS list
+			fsInd++
 			continue
 		}
 
-		// пакета нет в репозитории - удаляем запись о файле из БД
+		// файла нет в репозитории - удаляем запись о файле из БД
 		if fsInd > fsMaxInd { // not in FS
-			dbData = dbList[dbInd]
-			if err = r.removeFileData(dbData); err != nil {
-				return false, err
-			}
-			fmt.Println("  -", dbData.Path)
-			// next file obj in db list
-			dbInd++
-			if !packChanged {
-				packChanged = true
-			}
+			tasks = append(tasks, &indexTask{op: opFileDel, fInfo: dbList[dbInd]})
 			//next path in DB list
+			dbInd++
 			continue
 		}
 
 		dbData = dbList[dbInd]
 		fInfo = fsList[fsInd]
-		fpRel, _ = filepath.Rel(filepath.Join(r.path, pack), fInfo.Path)
+		fpRel = relPath(packRoot, fInfo.Path)
 
 		// Вариант2: Данные пакета изменились
 		// сверка данных о файле в БД и в репозитории
 		// in FS, in db
-		if fpRel == dbData.Path {
-			fileChanged = !(fInfo.Size == dbData.Size && fInfo.MDate == dbData.MDate)
+		cmp := r.comparePaths(fpRel, dbData.Path)
+		if cmp == 0 {
+			// без учета регистра путь файла может отличаться регистром символов
+			fileChanged = !(fInfo.Size == dbData.Size && fInfo.MDate == dbData.MDate && fpRel == dbData.Path)
 
-			if fullmode || fileChanged {
+			if fullmode || fileChanged || fInfo.Mode != dbData.Mode {
+				prev := *dbData
+				dbData.Path = fpRel
 				dbData.Size = fInfo.Size
 				dbData.MDate = fInfo.MDate
-				if dbData.Hash, err = getFileHash(fInfo.Path); err != nil {
-					return false, err
-				}
-
-				if err = r.updateFileData(dbData); err != nil {
-					return false, err
-				}
-
-				fmt.Println("  .", fpRel)
-
-				if !packChanged {
-					packChanged = true
-				}
+				dbData.Mode = fInfo.Mode
+				tasks = append(tasks, &indexTask{op: opFileUpd, fInfo: dbData, fPath: fInfo.Path, prev: &prev,
+					attr: !fullmode && !fileChanged})
 			}
 			fsInd++
 			dbInd++
 
 			// in FS, not in db: add file to BD
-		} else if fpRel < dbData.Path {
-			// добавляем запись о файле в БД
-			fInfo.ID = packID
-			if fInfo.Hash, err = getFileHash(fInfo.Path); err != nil {
-				return false, err
-			}
-			fInfo.Path = fpRel
-
-			if err = r.addFileData(fInfo); err != nil {
-				return false, err
-			}
-
-			fmt.Println("  +", fpRel)
-
-			if !packChanged {
-				packChanged = true
-			}
+		} else if cmp < 0 {
+			tasks = append(tasks, newAddTask(packID, fInfo, fpRel))
 			fsInd++
 
 			// удаляем запись о файле из БД
 			// not in FS, in db
-		} else if fpRel > dbData.Path {
-			if err = r.removeFileData(dbData); err != nil {
-				return false, err
-			}
-
-			fmt.Println("  -", dbData.Path)
-
-			if !packChanged {
-				packChanged = true
-			}
+		} else if cmp > 0 {
+			tasks = append(tasks, &indexTask{op: opFileDel, fInfo: dbData})
 			dbInd++
 		} else {
 			msg := "что-то пошло не так при обходе списков файлов пакета %s"
-			return false, &InternalError{
+			return nil, &InternalError{
 				Text:   fmt.Sprintf(msg, pack),
-				Caller: "Index",
+				Caller: "Index::indexTasks",
 			}
 		}
-		continue
 	}
+	return tasks, nil
+}
 
-	// пересчитываем контрольную сумму пакета при наличии изменений файлов
-	if packChanged {
-		if err = r.updatePackData(packID); err != nil {
-			return false, err
+// newAddTask возвращает операцию добавления файла в БД
+func newAddTask(packID int64, fInfo *FileInfo, fpRel string) *indexTask {
+	task := &indexTask{op: opFileAdd, fInfo: fInfo, fPath: fInfo.Path}
+	fInfo.ID = packID
+	fInfo.Path = fpRel
+	return task
+}
+
+// IndexDryRun обрабатывает команду `index --dry-run`
+// сверяет файлы пакетов в репозитории с данными БД и выводит изменения, которые будут
+// внесены индексацией, без записи в БД. Контрольные суммы подсчитываются только для файлов
+// с совпадающим путем, чтобы отличить изменение содержимого от изменения даты.
+// metaOnly - сверка только по размеру и дате изменения файлов, без подсчета контрольных сумм
+func IndexDryRun(r *Repo, fullmode, metaOnly bool, packs []string) error {
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	doc := &IndexDiffDocument{MetaOnly: metaOnly, Packages: []PackDiff{}, Removed: []string{}}
+	var failed int
+	for _, pack := range r.packNames(packs) {
+		d, err := r.packDiff(fullmode && !metaOnly, metaOnly, pack)
+		if err != nil {
+			return err
+		}
+		if d.Error != "" {
+			failed++
+		}
+		if d.changed() {
+			doc.Packages = append(doc.Packages, *d)
 		}
 	}
-	return packChanged, nil
+	// данные заблокированных и удаленных из репозитория пакетов удаляются из БД при индексации
+	for _, pack := range r.packages() {
+		if !r.PackIsActive(pack) {
+			doc.Removed = append(doc.Removed, pack)
+		}
+	}
+
+	if OutputIsJSON() {
+		err = printJSON(doc)
+	} else {
+		printIndexDiff(doc)
+	}
+	if err == nil && failed > 0 {
+		err = &InternalError{
+			Text:   fmt.Sprintf("ошибка индексации пакетов: %d", failed),
+			Caller: "IndexDryRun",
+		}
+	}
+	return err
 }
 
-func getFileHash(fPath string) (string, error) {
-	hash, err := hashSumFile(fPath)
+// packDiff возвращает изменения пакета без записи в БД
+func (r *Repo) packDiff(fullmode, metaOnly bool, pack string) (*PackDiff, error) {
+	d := &PackDiff{
+		Package: pack,
+		Added:   []string{},
+		Changed: []string{},
+		Touched: []string{},
+		Removed: []string{},
+	}
+	packID, err := r.packageID(pack)
+	if err != nil && err.(*InternalError).Err == sql.ErrNoRows { // пакет не проиндексирован
+		packID, d.New = 0, true
+	} else if err != nil {
+		return nil, err
+	} else if err = r.db.QueryRow("SELECT name, size, fcnt FROM packages WHERE id=?;", packID).Scan(
+		&d.RenamedFrom, &d.SizeBefore, &d.FcntBefore); err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка выборки данных пакета",
+			Caller: "Index::packDiff",
+			Err:    err,
+		}
+	}
+	if d.RenamedFrom == pack {
+		d.RenamedFrom = ""
+	}
+	d.SizeAfter, d.FcntAfter = d.SizeBefore, d.FcntBefore
+
+	tasks, err := r.indexTasks(fullmode, packID, pack)
 	if err != nil {
-		return "", err
+		d.Error = err.Error()
+		return d, nil
 	}
-	return hash, nil
+
+	// контрольные суммы файлов с совпадающим путем
+	paths := []string{}
+	if !metaOnly {
+		for _, task := range tasks {
+			if task.op == opFileUpd && !task.attr {
+				paths = append(paths, task.fPath)
+			}
+		}
+	}
+	done := make(chan struct{})
+	defer close(done)
+	hashes := hashFiles(r.hashAlgo(), paths, r.workers, done)
+
+	for _, task := range tasks {
+		switch task.op {
+		case opFileAdd:
+			d.Added = append(d.Added, task.fInfo.Path)
+			d.SizeAfter += task.fInfo.Size
+			d.FcntAfter++
+		case opFileDel:
+			d.Removed = append(d.Removed, task.fInfo.Path)
+			d.SizeAfter -= task.fInfo.Size
+			d.FcntAfter--
+		case opFileUpd:
+			d.SizeAfter += task.fInfo.Size - task.prev.Size
+			if task.attr {
+				d.Touched = append(d.Touched, task.fInfo.Path)
+				continue
+			}
+			if metaOnly {
+				d.Changed = append(d.Changed, task.fInfo.Path)
+				continue
+			}
+			res := <-<-hashes
+			if res.err != nil {
+				d.Error = res.err.Error()
+				return d, nil
+			}
+			if res.hash != task.prev.Hash {
+				d.Changed = append(d.Changed, task.fInfo.Path)
+			} else if task.fInfo.Size != task.prev.Size || task.fInfo.MDate != task.prev.MDate ||
+				task.fInfo.Mode != task.prev.Mode || task.fInfo.Path != task.prev.Path {
+				d.Touched = append(d.Touched, task.fInfo.Path)
+			}
+		}
+	}
+
+	ign, err := r.ignoreRules(pack)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(filepath.Join(r.path, pack), ign)
+	if err != nil {
+		d.Error = err.Error()
+		return d, nil
+	}
+	manifestDB, err := r.packManifest(r.db, packID)
+	if err != nil {
+		return nil, err
+	}
+	d.Manifest = !manifest.equal(manifestDB)
+	return d, nil
+}
+
+// changed проверяет наличие изменений пакета
+func (d *PackDiff) changed() bool {
+	return d.New || d.Manifest || d.Error != "" || d.RenamedFrom != "" ||
+		len(d.Added)+len(d.Changed)+len(d.Touched)+len(d.Removed) > 0
+}
+
+// printIndexDiff выводит изменения, которые будут внесены индексацией
+func printIndexDiff(doc *IndexDiffDocument) {
+	for _, d := range doc.Packages {
+		if d.New {
+			fmt.Println("[", d.Package, "] (новый пакет)")
+		} else if d.RenamedFrom != "" {
+			fmt.Printf("[ %s ] (имя пакета в БД: %s)\n", d.Package, d.RenamedFrom)
+		} else {
+			fmt.Println("[", d.Package, "]")
+		}
+		for _, files := range []struct {
+			op    byte
+			paths []string
+		}{{opFileAdd, d.Added}, {opFileUpd, d.Changed}, {'~', d.Touched}, {opFileDel, d.Removed}} {
+			for _, fp := range files.paths {
+				fmt.Printf("  %c %s\n", files.op, fp)
+			}
+		}
+		if d.Manifest {
+			fmt.Println("  * описание пакета")
+		}
+		if d.Error != "" {
+			fmt.Printf("  ! индексация пакета будет отменена: %s\n", d.Error)
+			continue
+		}
+		fmt.Printf("  размер: %d -> %d (%+d), файлов: %d -> %d (%+d)\n",
+			d.SizeBefore, d.SizeAfter, d.SizeAfter-d.SizeBefore,
+			d.FcntBefore, d.FcntAfter, d.FcntAfter-d.FcntBefore)
+	}
+	for _, pack := range doc.Removed {
+		fmt.Printf("[ %s ] данные пакета будут удалены из БД\n", pack)
+	}
+	if len(doc.Packages) == 0 && len(doc.Removed) == 0 {
+		fmt.Print(noChangeMsg)
+		return
+	}
+	fmt.Printf("\nПакетов с изменениями: %d", len(doc.Packages))
+	if doc.MetaOnly {
+		fmt.Print(" (без подсчета контрольных сумм: '.' - изменен размер или дата файла)")
+	}
+	fmt.Println()
 }
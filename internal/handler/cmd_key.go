@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Key обрабатывает команду `key` - управление ключом подписи индекс-файла
+// generate - создание пары ключей
+// show - вывод открытого ключа и его отпечатка
+// rotate - замена пары ключей, предыдущие сохраняются с суффиксом .old
+func Key(keyPath, cmd string) error {
+	if keyPath == "" {
+		return &InternalError{
+			Text:   "не указан путь к файлу ключа",
+			Caller: "Key",
+		}
+	}
+	switch cmd {
+	case "generate":
+		if fileExists(keyPath) {
+			return &InternalError{
+				Text:   fmt.Sprintf("ключ %s уже существует. для замены используйте команду 'key rotate'", keyPath),
+				Caller: "Key",
+			}
+		}
+		if _, err = generateKey(keyPath); err != nil {
+			return err
+		}
+		fmt.Println("Создан ключ подписи:", keyPath)
+	case "rotate":
+		if err = rotateKeyFile(keyPath); err != nil {
+			return err
+		}
+		if _, err = generateKey(keyPath); err != nil {
+			return err
+		}
+		fmt.Println("Ключ подписи заменен:", keyPath)
+		fmt.Println("\n\tПередайте клиентам новый открытый ключ и выгрузите индекс-файл командой 'pop'")
+	case "", "show":
+	default:
+		return &InternalError{
+			Text:   fmt.Sprintf("неверная команда %q. укажите одну из [ 'generate' | 'show' | 'rotate' ]", cmd),
+			Caller: "Key",
+		}
+	}
+	priv, err := readPrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+	fmt.Println()
+	fmt.Print(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})))
+	fmt.Println("Отпечаток:", keyFingerprint(pub))
+	return nil
+}
+
+// VerifyIndex обрабатывает команду `verify`
+// проверяет подпись опубликованного индекс-файла доверенным открытым ключом
+// и соответствие хэш-файла индекс-файлу
+func VerifyIndex(repoPath, pubPath string) error {
+	pub, err := readPublicKey(pubPath)
+	if err != nil {
+		return err
+	}
+	fpIndex := filepath.Join(repoPath, IndexGZ)
+	data, err := ioutil.ReadFile(fpIndex)
+	if err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения файла %s", fpIndex),
+			Caller: "VerifyIndex",
+			Err:    err,
+		}
+	}
+	meta, err := readIndexMeta(data)
+	if err != nil {
+		return err
+	}
+
+	tmpl := "%-30s: "
+	fmt.Printf(tmpl+"%s\n", "Ключ индекс-файла", meta["key"])
+	fmt.Printf(tmpl+"%s\n", "Доверенный ключ", keyFingerprint(pub))
+
+	fmt.Printf(tmpl, "Подпись")
+	sig, err := ioutil.ReadFile(filepath.Join(repoPath, IndexSig))
+	if err != nil {
+		fmt.Println("отсутствует")
+		return &InternalError{
+			Text:   "индекс-файл не подписан",
+			Caller: "VerifyIndex",
+			Err:    err,
+		}
+	}
+	if !verifyIndexSignature(pub, meta, data, sig) {
+		fmt.Println("НЕВЕРНА")
+		return &InternalError{
+			Text:   "подпись индекс-файла не соответствует доверенному ключу",
+			Caller: "VerifyIndex",
+		}
+	}
+	fmt.Println("OK")
+
+	fmt.Printf(tmpl, "Хэш-сумма")
+	algo, err := hashAlgoByName(meta["hash"])
+	if err != nil {
+		algo = hashAlgos[HashSHA1] // индекс-файл выгружен до версии БД 1.7
+	}
+	hash, err := ioutil.ReadFile(filepath.Join(repoPath, hashFileName(algo)))
+	if err != nil || strings.TrimSpace(string(hash)) != hashSum(algo, string(data)) {
+		fmt.Println("НЕВЕРНА")
+		return &InternalError{
+			Text:   fmt.Sprintf("хэш-файл %s не соответствует индекс-файлу", hashFileName(algo)),
+			Caller: "VerifyIndex",
+			Err:    err,
+		}
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+// verifyIndexSignature проверяет подпись индекс-файла data открытым ключом pub:
+// отпечаток ключа в поле `meta:key` и подпись должны соответствовать ключу
+func verifyIndexSignature(pub ed25519.PublicKey, meta map[string]string, data, sig []byte) bool {
+	return meta["key"] == keyFingerprint(pub) && verifySignature(pub, data, sig)
+}
+
+// readIndexMeta возвращает данные поля `meta` сжатого индекс-файла
+func readIndexMeta(data []byte) (map[string]string, error) {
+	var index struct {
+		Meta map[string]string `json:"meta"`
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err == nil {
+		err = json.NewDecoder(zr).Decode(&index)
+	}
+	if err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка чтения индекс-файла",
+			Caller: "readIndexMeta",
+			Err:    err,
+		}
+	}
+	return index.Meta, nil
+}
@@ -5,40 +5,45 @@ import (
 )
 
 // List выводит на консоль информацию о статусе пакетов в репозитории
-func List(r *Repo, cmd string) error {
+// ignored - выводит список файлов указанных пакетов, исключенных из индексации
+func List(r *Repo, cmd string, packs []string) error {
 	const tmplListOut = "[%4v] %v\n"
-	switch cmd {
-	case "all":
-		ch := make(chan *ListData)
+	doc, err := ListDoc(r, cmd, packs)
+	if err != nil {
+		return err
+	}
+	if OutputIsJSON() {
+		return printJSON(doc)
+	}
+	switch list := doc.(type) {
+	case []ListEntry:
 		fmt.Printf(tmplListOut, "СТАТ", "ПАКЕТ (ПСЕВДОНИМ)")
 		fmt.Println("------", "-----------------")
-		go r.listIndexedPacks(ch)
-		for data := range ch {
+		for _, data := range list {
+			name := data.Name
+			if data.Alias != "" {
+				name = fmt.Sprintf("%v (%v)", data.Name, data.Alias)
+			}
 			switch data.Status {
-			case PackStatusBlocked:
-				fmt.Printf(tmplListOut, "блок", data.Name)
-			case PackStatusActive:
-				fmt.Printf(tmplListOut, "", data.Name)
-			case PackStatusNotIndexed:
-				fmt.Printf(tmplListOut, "!инд", data.Name)
+			case packStatusNames[PackStatusBlocked]:
+				fmt.Printf(tmplListOut, "блок", name)
+			case packStatusNames[PackStatusActive]:
+				fmt.Printf(tmplListOut, "", name)
+			case packStatusNames[PackStatusNotIndexed]:
+				fmt.Printf(tmplListOut, "!инд", name)
 			}
 		}
-	case "indexed":
-		for _, pack := range r.packages() {
-			fmt.Println(pack)
-		}
-	case "noindexed":
-		for _, pack := range r.notIndexedPacks() {
-			fmt.Println(pack)
-		}
-	case "blocked":
-		for _, pack := range r.disabledPacks() {
+	case []string:
+		for _, pack := range list {
 			fmt.Println(pack)
 		}
-	default:
-		return &InternalError{
-			Text:   fmt.Sprintf("неверно указана команда: %q", cmd),
-			Caller: "List",
+	case map[string][]string:
+		// ключи - имена пакетов в репозитории с учетом политики сравнения имен
+		for _, pack := range r.packNames(packs) {
+			fmt.Println("[", pack, "]")
+			for _, fp := range list[pack] {
+				fmt.Println("  ", fp)
+			}
 		}
 	}
 	return nil
@@ -4,29 +4,17 @@ import (
 	"fmt"
 )
 
-// TODO: алгоритм миграции с сохранением данных БД
-
 // MigrateDB обрабатывает команду `migrate`
-// сохраняет данные псевдонимов и блокировок пакетов при миграции
-// и импортирует обратно после удаления данных из БД
-// Миграция требуется при изменении структуры БД
-func MigrateDB(r *Repo) error {
-	checkRegl(r.path)
-	if !userAccept("\nДанная операция заменит файлы БД и индекса." +
-		"\nУбедитесь, что у Вас есть резервная копия") {
-		return nil
-	}
-	fmt.Println()
+// последовательно применяет шаги миграции структуры БД от версии репозитория
+// до версии программы с сохранением данных. Все шаги выполняются в одной транзакции,
+// при ошибке БД остается в исходном состоянии.
+// dryRun - вывод списка шагов миграции без изменения БД
+func MigrateDB(r *Repo, dryRun bool) error {
 	vMaj, vMin, err := r.versionDB()
 	if err != nil {
 		return err
 	}
-	if DBVersionMajor > vMaj {
-		return &InternalError{
-			Text:   "\n\tтребуется переиндексация репозитория",
-			Caller: "Migrate",
-		}
-	} else if DBVersionMajor < vMaj || DBVersionMinor < vMin {
+	if DBVersionMajor < vMaj || (DBVersionMajor == vMaj && DBVersionMinor < vMin) {
 		return &InternalError{
 			Text:   "возможно вы используете старую версию программы",
 			Caller: "Migrate",
@@ -35,54 +23,36 @@ func MigrateDB(r *Repo) error {
 		fmt.Println("миграция не требуется")
 		return nil
 	}
-	tmpl := "%-30s: "
-	//подготовка списка заблокированных пакетов
-	fmt.Printf(tmpl, "сохранение alias, blocked")
-	blocked := r.disabledPacks()
-	//подготовка списка псевдонимов
-	aliases := r.aliases()
-	fmt.Println("OK")
-
-	// close DB
-	fmt.Printf(tmpl, "Закрытие БД")
-	if err = r.Close(); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	// очистка старых файлов БД и индекса
-	fmt.Printf(tmpl, "удаление файлов БД и индекса")
-	if err = cleanForMigrate(r); err != nil {
-		return err
+	plan, err := migrationPlan(vMaj, vMin)
+	if err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("%v\n\tтребуется повторная инициализация и переиндексация репозитория", err),
+			Caller: "Migrate",
+			Err:    err,
+		}
 	}
-	fmt.Println("OK")
 
-	// инициализация репозитория
-	fmt.Printf(tmpl, "инициализация репозитория")
-	if err = InitDB(r.Path()); err != nil {
-		return err
+	fmt.Printf("Миграция БД с версии %d.%d на версию %d.%d:\n", vMaj, vMin, DBVersionMajor, DBVersionMinor)
+	if dryRun {
+		for _, m := range plan {
+			fmt.Printf("  %v\n", m)
+		}
+		return nil
 	}
 
-	// connect to DB
-	if err = r.OpenDB(); err != nil {
+	if err = checkRegl(r.path); err != nil {
 		return err
 	}
-
-	// ввод псевдонимов в БД
-	fmt.Println("восстановление alias, blocked")
-	for _, alias := range aliases {
-		if err = r.setAlias(alias); err != nil {
-			return err
-		}
+	if !userAccept("\nДанная операция изменит структуру БД." +
+		"\nУбедитесь, что у Вас есть резервная копия (команда 'backup')") {
+		return nil
 	}
-
-	// ввод заблокированных в БД
-	for _, pack := range blocked {
-		if err = r.disablePack(pack); err != nil {
-			return err
-		}
+	fmt.Println()
+	if err = r.applyMigrations(plan); err != nil {
+		return err
 	}
+	r.audit(auditMigrate, "", fmt.Sprintf("%d.%d", vMaj, vMin), fmt.Sprintf("%d.%d", DBVersionMajor, DBVersionMinor))
 	fmt.Println("Миграция завершена")
-	fmt.Println("\n\tТребуется индексация репозитория")
+	showFormatHint(r)
 	return nil
 }
@@ -7,6 +7,7 @@ import (
 // SetPackStatus активирует или блокирует пакет для индексации
 func SetPackStatus(r *Repo, status int, packs []string) error {
 	var done bool
+	packs = r.packNames(packs)
 	switch status {
 	// активация пакетов
 	case PackStatusActive:
@@ -15,14 +16,14 @@ func SetPackStatus(r *Repo, status int, packs []string) error {
 				fmt.Printf("[ %v ] уже в актуальном состоянии\n", pack)
 				continue
 			}
-			if err = r.enablePack(pack); err != nil {
+			if err = r.enablePack(r.db, pack); err != nil {
 				return err
 			}
 			done = true
 		}
 		if done {
 			fmt.Print(doIndexMsg)
-			fmt.Println(doPopMsg)
+			fmt.Print(doPopMsg)
 		}
 	// блокирование пакетов
 	case PackStatusBlocked:
@@ -35,7 +36,7 @@ func SetPackStatus(r *Repo, status int, packs []string) error {
 				fmt.Printf("[ %v ] не найден\n", pack)
 				continue
 			}
-			err = r.disablePack(pack)
+			err = r.disablePack(r.db, pack)
 			done = true
 		}
 		// очистка БД от данных заблокированных пакетов
@@ -43,7 +44,7 @@ func SetPackStatus(r *Repo, status int, packs []string) error {
 			if err = r.cleanPacks(); err != nil {
 				return err
 			}
-			fmt.Println(doPopMsg)
+			fmt.Print(doPopMsg)
 		}
 	}
 	return nil
@@ -1,13 +1,17 @@
 package handler
 
 import (
+	"bytes"
 	"compress/gzip"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,11 +21,51 @@ type indexData struct {
 	Meta  map[string]string `json:"meta"`
 }
 
-// Populate выгружает данные об индексации репозитория в индекс-файл
-func Populate(r *Repo) error {
+// hashedPackDataV1 данные пакета индекс-файла формата 1: файлы пакета - путь и контрольная сумма
+type hashedPackDataV1 struct {
+	HashedPackData
+	Files map[string]string `json:"files"`
+}
+
+// marshal возвращает данные индекс-файла в формате JSON в соответствии с версией формата meta:version
+func (d *indexData) marshal() []byte {
+	if d.Meta["version"] != IndexFormatV1 {
+		data, _ := json.MarshalIndent(d, "", "    ")
+		return data
+	}
+	packs := make(map[string]hashedPackDataV1, len(d.Packs))
+	for name, pack := range d.Packs {
+		files := make(map[string]string, len(pack.Files))
+		for fp, f := range pack.Files {
+			files[fp] = f.Hash
+		}
+		packs[name] = hashedPackDataV1{HashedPackData: pack, Files: files}
+	}
+	data, _ := json.MarshalIndent(struct {
+		Packs map[string]hashedPackDataV1 `json:"packages"`
+		Meta  map[string]string           `json:"meta"`
+	}{packs, d.Meta}, "", "    ")
+	return data
+}
+
+// Populate выгружает данные об индексации репозитория в индекс-файл формата format (v1 | v2);
+// пустое значение - формат опубликованного индекс-файла
+func Populate(r *Repo, format string) error {
 	if err = r.checkDBVersion(); err != nil {
 		return err
 	}
+	if format == "" {
+		format = r.publishedFormat()
+	}
+	if _, ok := indexMinClient[strings.TrimPrefix(format, "v")]; !ok {
+		return &InternalError{
+			Text:   fmt.Sprintf("неверный формат индекс-файла %q. укажите один из [ v1 | v2 ]", format),
+			Caller: "Populate",
+		}
+	}
+	if err = r.checkRehash(); err != nil {
+		return err
+	}
 	if err = r.checkEmptyExecFiles(); err != nil {
 		return err
 	}
@@ -32,10 +76,52 @@ func Populate(r *Repo) error {
 		return err
 	}
 
+	doc, key, err := r.indexDocument(strings.TrimPrefix(format, "v"))
+	if err != nil {
+		return err
+	}
+	// клиенты, получавшие подписанный индекс-файл, не должны незаметно остаться без подписи
+	if key == nil && !r.unsigned && fileExists(path.Join(r.path, IndexSig)) {
+		return &InternalError{
+			Text: fmt.Sprintf("опубликованный индекс-файл подписан, ключ подписи %s не найден. "+
+				"Укажите ключ параметром -k или разрешите выгрузку без подписи параметром -allow-unsigned", r.keyFile),
+			Caller: "Populate",
+		}
+	}
+	algo := r.hashAlgo()
+	doc.Meta["stamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+
+	jsonData := doc.marshal()
+
+	fpIndex := path.Join(r.path, IndexGZ)
+	fpHash := path.Join(r.path, hashFileName(algo))
+
+	// хэш-сумма опубликованного индекс-файла для журнала операций
+	before := publishedIndexHash(r.path)
+
+	// выгрузка данных во временные файлы с проверкой и последующей публикацией
+	if err = publishIndex(r.path, jsonData, fpIndex, fpHash, algo, key); err != nil {
+		return err
+	}
+
+	// удаление хэш-файлов других алгоритмов, оставшихся после смены алгоритма
+	removeHashFiles(r.path, fpHash)
+	r.audit(auditPop, "", before, publishedIndexHash(r.path))
+	fmt.Println("OK")
+	r.publishDeltas()
+	if key == nil {
+		fmt.Println("\n\tИндекс-файл не подписан. Создайте ключ подписи командой 'key generate'")
+	}
+	return nil
+}
+
+// indexDocument собирает из БД данные индекс-файла формата format (без метки времени выгрузки)
+// и возвращает их с ключом подписи индекс-файла при наличии
+func (r *Repo) indexDocument(format string) (*indexData, ed25519.PrivateKey, error) {
 	// список пакетов в из БД
 	packCh := make(chan HashedPackData)
 	go func() {
-		if err = r.hashedPackages(packCh); err != nil {
+		if err := r.hashedPackages(packCh); err != nil {
 			log.Fatal(err)
 		}
 	}()
@@ -46,82 +132,377 @@ func Populate(r *Repo) error {
 	}
 
 	if len(packDataList) == 0 {
-		return &InternalError{
+		return nil, nil, &InternalError{
 			Text:   "нет данных - требуется индексация репозитория",
 			Caller: "Populate",
 		}
 	}
 
-	var jsonData []byte
-	// jsonData, _ = json.MarshalIndent(packDataList, "", "  ")
-	jsonData, _ = json.MarshalIndent(indexData{
-		Packs: packDataList,
-		Meta: map[string]string{
-			"stamp":   strconv.FormatInt(time.Now().Unix(), 10),
-			"version": IndexFileFormatVersion,
-		},
-	}, "", "    ")
+	meta := map[string]string{
+		"version": format,
+		"hash":    r.hashAlgo().name,
+	}
+	// формат 1 выгружается без изменений для клиентов прежних версий
+	if format != IndexFormatV1 {
+		meta["format"] = "v" + format
+		meta["min_client"] = indexMinClient[format]
+	}
+	// ключ подписи индекс-файла
+	key, err := signingKey(r.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key != nil {
+		meta["key"] = keyFingerprint(key.Public().(ed25519.PublicKey))
+	}
+	return &indexData{Packs: packDataList, Meta: meta}, key, nil
+}
+
+// publishedFormat возвращает формат опубликованного индекс-файла (поле meta:version);
+// при отсутствии индекс-файла или неизвестном формате - формат по-умолчанию
+func (r *Repo) publishedFormat() string {
+	data, err := ioutil.ReadFile(path.Join(r.path, IndexGZ))
+	if err != nil {
+		return IndexFileFormatVersion
+	}
+	meta, err := readIndexMeta(data)
+	if err != nil {
+		return IndexFileFormatVersion
+	}
+	if _, ok := indexMinClient[meta["version"]]; !ok {
+		return IndexFileFormatVersion
+	}
+	return meta["version"]
+}
+
+// indexPublished проверяет, соответствует ли опубликованный индекс-файл данным БД в формате
+// опубликованного индекс-файла: совпадают данные пакетов и служебные данные, кроме метки времени выгрузки,
+// хэш-файл и подпись соответствуют индекс-файлу
+func (r *Repo) indexPublished() (bool, error) {
+	data, err := ioutil.ReadFile(path.Join(r.path, IndexGZ))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, &InternalError{
+			Text:   "ошибка чтения индекс-файла",
+			Caller: "Populate::indexPublished",
+			Err:    err,
+		}
+	}
+	var published indexData
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err == nil {
+		err = json.NewDecoder(zr).Decode(&published)
+	}
+	if err != nil {
+		// поврежденный индекс-файл подлежит замене
+		return false, nil
+	}
+	format := published.Meta["version"]
+	if _, ok := indexMinClient[format]; !ok {
+		return false, nil
+	}
+	doc, key, err := r.indexDocument(format)
+	if err != nil {
+		return false, err
+	}
+	// данные сравниваются в представлении формата индекс-файла: формат 1 не содержит размер,
+	// дату изменения и права доступа файлов
+	delete(published.Meta, "stamp")
+	if !bytes.Equal(doc.marshal(), published.marshal()) {
+		return false, nil
+	}
+	return publishedFilesValid(r.path, data, r.hashAlgo(), key), nil
+}
+
+// publishedFilesValid проверяет хэш-файл и подпись опубликованного индекс-файла data:
+// хэш-файл алгоритма algo соответствует индекс-файлу, хэш-файлы других алгоритмов отсутствуют,
+// подпись соответствует ключу key либо отсутствует, если ключ не задан
+func publishedFilesValid(repoPath string, data []byte, algo *hashAlgo, key ed25519.PrivateKey) bool {
+	fpHash := path.Join(repoPath, hashFileName(algo))
+	hash, err := ioutil.ReadFile(fpHash)
+	if err != nil || string(hash) != hashSum(algo, string(data)) {
+		return false
+	}
+	for _, a := range hashAlgos {
+		if a != algo && fileExists(path.Join(repoPath, hashFileName(a))) {
+			return false
+		}
+	}
+	sig, err := ioutil.ReadFile(path.Join(repoPath, IndexSig))
+	if key == nil {
+		return os.IsNotExist(err)
+	}
+	return err == nil && verifySignature(key.Public().(ed25519.PublicKey), data, sig)
+}
 
+// RollbackIndex обрабатывает команду `pop -rollback`
+// восстанавливает предыдущую версию индекс-файла и его хэш-файла
+func RollbackIndex(r *Repo) error {
+	if err = checkRegl(r.path); err != nil {
+		return err
+	}
 	fpIndex := path.Join(r.path, IndexGZ)
+	fpHashPrev := publishedHashFile(r.path, suffixPrev)
+	if !fileExists(fpIndex+suffixPrev) || fpHashPrev == "" {
+		return &InternalError{
+			Text:   "предыдущая версия индекс-файла отсутствует",
+			Caller: "RollbackIndex",
+		}
+	}
+	fpHash := strings.TrimSuffix(fpHashPrev, suffixPrev)
+	fpSig := path.Join(r.path, IndexSig)
 
-	// выгрузка данных из БД в json файл
-	if err = writeGzip(jsonData, fpIndex); err != nil {
+	before := publishedIndexHash(r.path)
+
+	fmt.Print("Восстановление предыдущей версии индекс-файла: ")
+	// подпись предыдущей версии при наличии, иначе удаление текущей подписи
+	if fileExists(fpSig + suffixPrev) {
+		err = os.Rename(fpSig+suffixPrev, fpSig)
+	} else if fileExists(fpSig) {
+		err = os.Remove(fpSig)
+	}
+	if err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка восстановления файла %s", fpSig),
+			Caller: "RollbackIndex::Sig",
+			Err:    err,
+		}
+	}
+	for _, fp := range []string{fpIndex, fpHash} {
+		if err = os.Rename(fp+suffixPrev, fp); err != nil {
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка восстановления файла %s", fp),
+				Caller: "RollbackIndex::Rename",
+				Err:    err,
+			}
+		}
+	}
+	removeHashFiles(r.path, fpHash)
+	r.audit(auditPopRollback, "", before, publishedIndexHash(r.path))
+	fmt.Println("OK")
+	r.publishDeltas()
+	return nil
+}
+
+// publishIndex записывает индекс-файл, его подпись (при наличии ключа key) и хэш-файл
+// под временными именами, проверяет их и публикует переименованием в порядке:
+// индекс-файл, подпись, хэш-файл. Опубликованные ранее файлы сохраняются с суффиксом .prev
+func publishIndex(repoPath string, jsonData []byte, fpIndex, fpHash string, algo *hashAlgo,
+	key ed25519.PrivateKey) error {
+	fpSig := path.Join(repoPath, IndexSig)
+	tmpIndex, tmpHash, tmpSig := fpIndex+suffixTmp, fpHash+suffixTmp, fpSig+suffixTmp
+	defer func() {
+		_ = os.Remove(tmpIndex)
+		_ = os.Remove(tmpHash)
+		_ = os.Remove(tmpSig)
+	}()
+
+	if err = writeGzip(jsonData, tmpIndex); err != nil {
+		return err
+	}
+	if err = verifyGzip(jsonData, tmpIndex); err != nil {
 		return err
 	}
 
 	// подсчет hash суммы индекс-файла
-	hash, err := hashSumFile(fpIndex)
+	hash, err := hashSumFile(algo, tmpIndex)
 	if err != nil {
 		return err
 	}
-
 	// запись хэш-суммы индекс-файла
-	if err = writeGzipHash(fpIndex, hash); err != nil {
+	if err = writeGzipHash(tmpHash, hash); err != nil {
 		return err
 	}
-	fmt.Println("OK")
+	if buf, err := ioutil.ReadFile(tmpHash); err != nil || string(buf) != hash {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка проверки файла %s", tmpHash),
+			Caller: "Populate::publishIndex::verifyHash",
+			Err:    err,
+		}
+	}
+
+	// подпись индекс-файла
+	publish := []string{fpIndex, fpHash}
+	if key != nil {
+		data, err := ioutil.ReadFile(tmpIndex)
+		if err == nil {
+			err = writeFileSync(tmpSig, signData(key, data))
+		}
+		if err != nil {
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка создания файла %s", tmpSig),
+				Caller: "Populate::publishIndex::sign",
+				Err:    err,
+			}
+		}
+		if sig, err := ioutil.ReadFile(tmpSig); err != nil ||
+			!verifySignature(key.Public().(ed25519.PublicKey), data, sig) {
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка проверки файла %s", tmpSig),
+				Caller: "Populate::publishIndex::verifySig",
+				Err:    err,
+			}
+		}
+		publish = []string{fpIndex, fpSig, fpHash}
+	}
+
+	// сохранение предыдущей версии
+	if fpHashCur := publishedHashFile(repoPath, ""); fileExists(fpIndex) && fpHashCur != "" {
+		prev := []string{fpIndex, fpHashCur}
+		if fileExists(fpSig) {
+			prev = append(prev, fpSig)
+		} else {
+			_ = os.Remove(fpSig + suffixPrev)
+		}
+		for _, fp := range prev {
+			if err = keepPrev(fp); err != nil {
+				return err
+			}
+		}
+	}
+
+	// публикация: индекс-файл, подпись, затем хэш-файл
+	if key == nil {
+		_ = os.Remove(fpSig) // подпись предыдущей версии недействительна
+	}
+	for _, fp := range publish {
+		if err = os.Rename(fp+suffixTmp, fp); err != nil {
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка публикации файла %s", fp),
+				Caller: "Populate::publishIndex::Rename",
+				Err:    err,
+			}
+		}
+	}
 	return nil
 }
 
-func writeGzipHash(fp, hash string) error {
-	indexFileHash, err := os.Create(fp + ".sha1")
+// publishedHashFile возвращает путь к существующему хэш-файлу индекса с суффиксом suffix
+func publishedHashFile(repoPath, suffix string) string {
+	for _, name := range HashAlgoNames() {
+		fp := path.Join(repoPath, hashFileName(hashAlgos[name])+suffix)
+		if fileExists(fp) {
+			return fp
+		}
+	}
+	return ""
+}
+
+// publishedIndexHash возвращает алгоритм и хэш-сумму опубликованного индекс-файла
+// в виде `алгоритм:сумма`; пустую строку при отсутствии хэш-файла
+func publishedIndexHash(repoPath string) string {
+	fp := publishedHashFile(repoPath, "")
+	if fp == "" {
+		return ""
+	}
+	buf, err := ioutil.ReadFile(fp)
 	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(path.Base(fp), IndexGZ+".") + ":" + strings.TrimSpace(string(buf))
+}
+
+// removeHashFiles удаляет хэш-файлы индекса, кроме указанного
+func removeHashFiles(repoPath, keep string) {
+	for _, a := range hashAlgos {
+		fp := path.Join(repoPath, hashFileName(a))
+		if fp != keep && fileExists(fp) {
+			_ = os.Remove(fp)
+		}
+	}
+}
+
+// keepPrev сохраняет копию файла с суффиксом .prev; опубликованный файл не изменяется
+func keepPrev(fp string) error {
+	prev := fp + suffixPrev
+	_ = os.Remove(prev)
+	if err := linkFile(fp, prev); err != nil {
 		return &InternalError{
-			Text:   fmt.Sprintf("ошибка создания файла %s", fp),
-			Caller: "Populate",
+			Text:   fmt.Sprintf("ошибка сохранения предыдущей версии файла %s", fp),
+			Caller: "Populate::keepPrev",
 			Err:    err,
 		}
 	}
-	defer func() {
-		_ = indexFileHash.Close()
-	}()
+	return nil
+}
+
+// linkFile создает жесткую ссылку dst на файл src или, если файловая система
+// не поддерживает жесткие ссылки, копию файла
+func linkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(src)
+	if err == nil {
+		err = writeFileSync(dst, buf)
+	}
+	return err
+}
 
-	if _, err = indexFileHash.Write([]byte(hash)); err != nil {
+// writeFileSync записывает данные в файл со сбросом буферов на диск
+func writeFileSync(fp string, data []byte) error {
+	f, err := os.Create(fp)
+	if err != nil {
 		return err
 	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func writeGzipHash(fp, hash string) error {
+	if err := writeFileSync(fp, []byte(hash)); err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка создания файла %s", fp),
+			Caller: "Populate::writeGzipHash",
+			Err:    err,
+		}
+	}
 	return nil
 }
 
 func writeGzip(jsonData []byte, fp string) error {
-	indexFile, err := os.Create(fp)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(jsonData)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = writeFileSync(fp, buf.Bytes())
+	}
 	if err != nil {
 		return &InternalError{
-			Text:   fmt.Sprintf("ошибка создания файла %s", fp),
+			Text:   fmt.Sprintf("ошибка сохранения файла %s", fp),
 			Caller: "Populate::writeGzip",
 			Err:    err,
 		}
 	}
-	zw := gzip.NewWriter(indexFile)
-	defer func() {
-		_ = zw.Close()
-		_ = indexFile.Close()
-	}()
+	return nil
+}
 
-	_, err = zw.Write(jsonData)
+// verifyGzip проверяет, что распакованные данные файла совпадают с исходными
+func verifyGzip(jsonData []byte, fp string) error {
+	f, err := os.Open(fp)
+	if err == nil {
+		defer f.Close()
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(f); err == nil {
+			var data []byte
+			if data, err = ioutil.ReadAll(zr); err == nil && !bytes.Equal(data, jsonData) {
+				err = fmt.Errorf("данные не совпадают")
+			}
+		}
+	}
 	if err != nil {
 		return &InternalError{
-			Text:   fmt.Sprintf("ошибка сохранения файла %s", fp),
-			Caller: "Populate::writeGzip",
+			Text:   fmt.Sprintf("ошибка проверки файла %s", fp),
+			Caller: "Populate::verifyGzip",
 			Err:    err,
 		}
 	}
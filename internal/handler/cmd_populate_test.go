@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testIndexData возвращает данные индекс-файла формата format с одним пакетом
+func testIndexData(format string) *indexData {
+	return &indexData{
+		Packs: packages{
+			"PackA": {
+				Alias: "a",
+				Hash:  "packhash",
+				Size:  3,
+				Fcnt:  2,
+				Exec:  "bin/app.exe",
+				Files: map[string]*IndexFile{
+					"bin/app.exe": {Hash: "h1", Size: 1, MTime: 1792307277, Mode: 0755},
+					"readme.txt":  {Hash: "h2", Size: 2, MTime: 1792307278, Mode: 0644},
+				},
+			},
+		},
+		Meta: map[string]string{"version": format, "hash": HashSHA256},
+	}
+}
+
+func TestIndexDataMarshal(t *testing.T) {
+	tests := []struct {
+		format string
+		file   interface{} // ожидаемое представление файла bin/app.exe
+	}{
+		{IndexFormatV1, "h1"},
+		{IndexFormatV2, map[string]interface{}{"hash": "h1", "size": 1.0, "mtime": 1792307277.0, "mode": 493.0}},
+	}
+	for _, tt := range tests {
+		t.Run("v"+tt.format, func(t *testing.T) {
+			d := testIndexData(tt.format)
+			data := d.marshal()
+
+			var raw struct {
+				Packs map[string]struct {
+					Alias string                 `json:"alias"`
+					Exec  string                 `json:"execf"`
+					Files map[string]interface{} `json:"files"`
+				} `json:"packages"`
+				Meta map[string]string `json:"meta"`
+			}
+			if err := json.Unmarshal(data, &raw); err != nil {
+				t.Fatal(err)
+			}
+			pack := raw.Packs["PackA"]
+			if pack.Alias != "a" || pack.Exec != "bin/app.exe" || raw.Meta["version"] != tt.format {
+				t.Errorf("данные пакета %+v, meta %v", pack, raw.Meta)
+			}
+			if got := pack.Files["bin/app.exe"]; !reflect.DeepEqual(got, tt.file) {
+				t.Errorf("файл %v, ожидается %v", got, tt.file)
+			}
+
+			// данные читаются обратно независимо от формата
+			var back indexData
+			if err := json.Unmarshal(data, &back); err != nil {
+				t.Fatal(err)
+			}
+			for fp, f := range d.Packs["PackA"].Files {
+				got := back.Packs["PackA"].Files[fp]
+				if got == nil || got.Hash != f.Hash {
+					t.Errorf("файл %s: %+v, ожидается контрольная сумма %s", fp, got, f.Hash)
+				}
+				if tt.format != IndexFormatV1 && *got != *f {
+					t.Errorf("файл %s: %+v, ожидается %+v", fp, got, f)
+				}
+			}
+		})
+	}
+}
+
+// readTestFile возвращает содержимое файла или пустую строку при его отсутствии
+func readTestFile(t *testing.T, fp string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// readTestIndex возвращает распакованные данные индекс-файла
+func readTestIndex(t *testing.T, fp string) string {
+	t.Helper()
+	d, err := readIndexData(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.Meta["stamp"]
+}
+
+func TestPublishIndex(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	algo := hashAlgos[HashSHA256]
+
+	tests := []struct {
+		name     string
+		key      ed25519.PrivateKey
+		wantSig  bool
+		wantPrev bool // сохранена подпись предыдущей версии
+	}{
+		{"первая выгрузка без подписи", nil, false, false},
+		{"выгрузка с подписью", key, true, false},
+		{"повторная выгрузка с подписью", key, true, true},
+		{"выгрузка без подписи", nil, false, true},
+	}
+	dir := t.TempDir()
+	fpIndex := filepath.Join(dir, IndexGZ)
+	fpHash := filepath.Join(dir, hashFileName(algo))
+	fpSig := filepath.Join(dir, IndexSig)
+	var prevIndex string
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testIndexData(IndexFormatV2)
+			d.Meta["stamp"] = string(rune('a' + i))
+			if err := publishIndex(dir, d.marshal(), fpIndex, fpHash, algo, tt.key); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(fpIndex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stamp := readTestIndex(t, fpIndex); stamp != d.Meta["stamp"] {
+				t.Errorf("опубликован индекс-файл выгрузки %q, ожидается %q", stamp, d.Meta["stamp"])
+			}
+			if hash := readTestFile(t, fpHash); hash != hashSum(algo, string(data)) {
+				t.Errorf("хэш-файл %q не соответствует индекс-файлу", hash)
+			}
+			sig := readTestFile(t, fpSig)
+			if (sig != "") != tt.wantSig {
+				t.Errorf("подпись опубликована: %v, ожидается %v", sig != "", tt.wantSig)
+			}
+			if sig != "" && !verifySignature(pub, data, []byte(sig)) {
+				t.Error("подпись не соответствует индекс-файлу")
+			}
+			if (readTestFile(t, fpSig+suffixPrev) != "") != tt.wantPrev {
+				t.Errorf("подпись предыдущей версии сохранена: %v, ожидается %v", !tt.wantPrev, tt.wantPrev)
+			}
+			if prevIndex != "" {
+				if stamp := readTestIndex(t, fpIndex+suffixPrev); stamp != prevIndex {
+					t.Errorf("предыдущая версия %q, ожидается %q", stamp, prevIndex)
+				}
+			}
+			for _, fp := range []string{fpIndex, fpHash, fpSig} {
+				if readTestFile(t, fp+suffixTmp) != "" {
+					t.Errorf("не удален временный файл %s", fp+suffixTmp)
+				}
+			}
+			prevIndex = d.Meta["stamp"]
+		})
+	}
+}
+
+func TestRollbackIndex(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algo := hashAlgos[HashSHA256]
+
+	tests := []struct {
+		name    string
+		keys    []ed25519.PrivateKey // ключи последовательных выгрузок
+		wantErr bool
+		wantSig bool
+	}{
+		{"нет предыдущей версии", []ed25519.PrivateKey{nil}, true, false},
+		{"без подписи", []ed25519.PrivateKey{nil, nil}, false, false},
+		{"подписанная версия", []ed25519.PrivateKey{key, key}, false, true},
+		{"к версии без подписи", []ed25519.PrivateKey{nil, key}, false, false},
+		{"к подписанной версии", []ed25519.PrivateKey{key, nil}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRepo(t)
+			fpIndex := filepath.Join(r.path, IndexGZ)
+			fpHash := filepath.Join(r.path, hashFileName(algo))
+			var hashes []string
+			for i, k := range tt.keys {
+				d := testIndexData(IndexFormatV2)
+				d.Meta["stamp"] = string(rune('a' + i))
+				if err := publishIndex(r.path, d.marshal(), fpIndex, fpHash, algo, k); err != nil {
+					t.Fatal(err)
+				}
+				hashes = append(hashes, readTestFile(t, fpHash))
+			}
+			err := RollbackIndex(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ошибка %v, ожидается ошибка: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if stamp := readTestIndex(t, fpIndex); stamp != "a" {
+				t.Errorf("восстановлен индекс-файл выгрузки %q, ожидается %q", stamp, "a")
+			}
+			if hash := readTestFile(t, fpHash); hash != hashes[0] {
+				t.Errorf("восстановлен хэш-файл %q, ожидается %q", hash, hashes[0])
+			}
+			data, _ := ioutil.ReadFile(fpIndex)
+			sig := readTestFile(t, filepath.Join(r.path, IndexSig))
+			if (sig != "") != tt.wantSig {
+				t.Errorf("подпись после восстановления: %v, ожидается %v", sig != "", tt.wantSig)
+			}
+			if sig != "" && !verifySignature(key.Public().(ed25519.PublicKey), data, []byte(sig)) {
+				t.Error("подпись не соответствует восстановленному индекс-файлу")
+			}
+		})
+	}
+}
+
+func TestPublishedFilesValid(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algo := hashAlgos[HashSHA256]
+
+	tests := []struct {
+		name   string
+		key    ed25519.PrivateKey // ключ выгрузки
+		check  ed25519.PrivateKey // ключ проверки
+		change func(dir string, data []byte) error
+		want   bool
+	}{
+		{"подписанный индекс-файл", key, key, nil, true},
+		{"неподписанный индекс-файл", nil, nil, nil, true},
+		{"поврежденный хэш-файл", key, key, func(dir string, _ []byte) error {
+			return ioutil.WriteFile(filepath.Join(dir, hashFileName(algo)), []byte("0"), 0644)
+		}, false},
+		{"отсутствует хэш-файл", key, key, func(dir string, _ []byte) error {
+			return os.Remove(filepath.Join(dir, hashFileName(algo)))
+		}, false},
+		{"хэш-файл другого алгоритма", key, key, func(dir string, _ []byte) error {
+			return ioutil.WriteFile(filepath.Join(dir, hashFileName(hashAlgos[HashSHA1])), []byte("0"), 0644)
+		}, false},
+		{"поврежденная подпись", key, key, func(dir string, _ []byte) error {
+			return ioutil.WriteFile(filepath.Join(dir, IndexSig), []byte("0"), 0644)
+		}, false},
+		{"подпись другим ключом", key, key, func(dir string, data []byte) error {
+			return ioutil.WriteFile(filepath.Join(dir, IndexSig), signData(other, data), 0644)
+		}, false},
+		{"отсутствует подпись", key, key, func(dir string, _ []byte) error {
+			return os.Remove(filepath.Join(dir, IndexSig))
+		}, false},
+		{"подпись без ключа", key, nil, nil, false},
+		{"смена ключа", key, other, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fpIndex := filepath.Join(dir, IndexGZ)
+			if err := publishIndex(dir, testIndexData(IndexFormatV2).marshal(), fpIndex,
+				filepath.Join(dir, hashFileName(algo)), algo, tt.key); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(fpIndex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				if err = tt.change(dir, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := publishedFilesValid(dir, data, algo, tt.check); got != tt.want {
+				t.Errorf("publishedFilesValid = %v, ожидается %v", got, tt.want)
+			}
+		})
+	}
+}
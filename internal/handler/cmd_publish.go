@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// шаги публикации
+const (
+	stepRegl  = "регламент"
+	stepIndex = "индексация"
+	stepExec  = "исполняемые файлы"
+	stepPop   = "выгрузка"
+)
+
+// publishStep результат шага публикации для итогового отчета
+type publishStep struct {
+	name   string
+	result string
+}
+
+// Publish обрабатывает команду `publish`
+// выполняет регламентные работы: установка режима регламента, индексация активных пакетов,
+// проверка исполняемых файлов (exec check), выгрузка индекс-файла и снятие режима регламента.
+// Выгрузка пропускается, если опубликованный индекс-файл соответствует данным БД,
+// и не выполняется при наличии пакетов без исполняемого файла.
+// Режим регламента, установленный командой, снимается при любом исходе;
+// установленный ранее текущим пользователем - сохраняется.
+// Прерывание (Ctrl+C) останавливает публикацию после завершения текущего шага
+func Publish(r *Repo, fullmode bool, reason string, ttl time.Duration) (err error) {
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	var steps []publishStep
+	report := func(name, format string, a ...interface{}) {
+		steps = append(steps, publishStep{name, fmt.Sprintf(format, a...)})
+	}
+	defer func() {
+		printPublishReport(steps, err)
+	}()
+
+	// прерывание выполняется между шагами, чтобы снять режим регламента;
+	// повторное прерывание - немедленный выход со снятием установленного командой режима
+	var acquired int32 // режим регламента установлен командой (atomic)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(sigCh)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-sigCh:
+		case <-done:
+			return
+		}
+		fmt.Println("\n! прерывание: публикация будет остановлена после текущего шага (повторное прерывание - выход)")
+		close(stop)
+		select {
+		case <-sigCh:
+		case <-done:
+			return
+		}
+		if atomic.LoadInt32(&acquired) == 1 {
+			_ = releaseReglamentLock(r.path)
+		}
+		os.Exit(1)
+	}()
+	interrupted := func() error {
+		select {
+		case <-stop:
+			return &InternalError{
+				Text:   "публикация прервана",
+				Caller: "Publish",
+			}
+		default:
+			return nil
+		}
+	}
+
+	// режим регламента
+	fmt.Printf("== %s\n", stepRegl)
+	lock, err := readReglamentLock(r.path)
+	if err != nil {
+		return err
+	}
+	if lock != nil {
+		if lock.foreign() {
+			lock.print()
+			report(stepRegl, "установлен другим пользователем: %s", lock.owner())
+			return &InternalError{
+				Text:   fmt.Sprintf("режим регламента установлен другим пользователем: %s", lock.owner()),
+				Caller: "Publish::regl",
+			}
+		}
+		fmt.Println("Режим регламента уже установлен текущим пользователем и не будет снят")
+		report(stepRegl, "установлен ранее, сохранен")
+	} else {
+		if reason == "" {
+			reason = "publish"
+		}
+		if err = writeReglamentLock(r.path, newReglamentLock(reason, ttl)); err != nil {
+			report(stepRegl, "ошибка установки")
+			return err
+		}
+		fmt.Println("Режим регламента активирован [on]")
+		atomic.StoreInt32(&acquired, 1)
+		defer func() {
+			atomic.StoreInt32(&acquired, 0)
+			if e := releaseReglamentLock(r.path); e != nil {
+				steps[0].result = "установлен, ошибка снятия"
+				if err == nil {
+					err = e
+				}
+				return
+			}
+			steps[0].result = "установлен и снят"
+			fmt.Println("\nРежим регламента деактивирован [off]")
+		}()
+		report(stepRegl, "установлен")
+	}
+	if err = interrupted(); err != nil {
+		return err
+	}
+
+	// индексация
+	fmt.Printf("\n== %s\n", stepIndex)
+	committed, rolledBack, err := indexPacks(r, fullmode, r.ActivePacks())
+	if err != nil {
+		report(stepIndex, "ошибка")
+		return err
+	}
+	if len(rolledBack) > 0 {
+		report(stepIndex, "изменения отменены: %s", strings.Join(rolledBack, ", "))
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка индексации пакетов: %d. Публикация отменена", len(rolledBack)),
+			Caller: "Publish::index",
+		}
+	}
+	if len(committed) > 0 {
+		report(stepIndex, "изменены пакеты: %s", strings.Join(committed, ", "))
+	} else {
+		report(stepIndex, "изменений нет")
+	}
+	if err = interrupted(); err != nil {
+		return err
+	}
+
+	// исполняемые файлы пакетов без исполняемого файла
+	fmt.Printf("== %s\n", stepExec)
+	if empty := r.nullExecFilesList(); len(empty) > 0 {
+		if err = ExecFile(r, "check", empty); err != nil {
+			report(stepExec, "ошибка")
+			return err
+		}
+		report(stepExec, "установлены: %s", strings.Join(empty, ", "))
+	} else {
+		fmt.Println("Исполняемые файлы установлены для всех пакетов")
+		report(stepExec, "OK")
+	}
+	if err = r.checkEmptyExecFiles(); err != nil {
+		report(stepExec, "не установлены: %s", strings.Join(r.nullExecFilesList(), ", "))
+		return err
+	}
+	if err = interrupted(); err != nil {
+		return err
+	}
+
+	// выгрузка индекс-файла
+	fmt.Printf("\n== %s\n", stepPop)
+	published, err := r.indexPublished()
+	if err != nil {
+		report(stepPop, "ошибка")
+		return err
+	}
+	if published {
+		fmt.Println("Индекс-файл соответствует данным БД")
+		report(stepPop, "пропущена: индекс-файл актуален")
+		return nil
+	}
+	if err = Populate(r, r.publishedFormat()); err != nil {
+		report(stepPop, "ошибка")
+		return err
+	}
+	report(stepPop, "выполнена")
+	return nil
+}
+
+// releaseReglamentLock снимает режим регламента, установленный текущим процессом
+func releaseReglamentLock(repoPath string) error {
+	lock, err := readReglamentLock(repoPath)
+	if err != nil {
+		return err
+	}
+	if lock == nil || lock.foreign() || lock.PID != os.Getpid() {
+		return &InternalError{
+			Text:   "файл режима регламента изменен другим процессом и не снят",
+			Caller: "Publish::releaseRegl",
+		}
+	}
+	if err = os.Remove(filepath.Join(repoPath, fnReglament)); err != nil {
+		return &InternalError{
+			Text:   "ошибка снятия режима регламента",
+			Caller: "Publish::releaseRegl",
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// printPublishReport выводит итоги публикации
+func printPublishReport(steps []publishStep, err error) {
+	fmt.Println("\nИтоги публикации:")
+	for _, step := range steps {
+		fmt.Printf("  %-20s%s\n", step.name+":", step.result)
+	}
+	if err != nil {
+		fmt.Println("  Публикация завершена с ошибкой")
+	}
+}
@@ -0,0 +1,381 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recoverStat результат восстановления данных пакетов из индекс-файла
+type recoverStat struct {
+	packs    int                 // восстановлено пакетов
+	trusted  int                 // файлов с контрольной суммой из индекс-файла
+	rehash   int                 // файлов, изменившихся после выгрузки, - контрольные суммы подсчитаны заново
+	missing  []string            // пакеты индекс-файла, отсутствующие в репозитории
+	notIndex []string            // пакеты репозитория, отсутствующие в индекс-файле
+	newFiles map[string][]string // файлы пакетов, отсутствующие в индекс-файле
+	failed   []string            // пакеты, данные которых не восстановлены
+}
+
+// RecoverDB обрабатывает команду `recover-db`
+// пересоздает БД репозитория по опубликованному индекс-файлу from (по-умолчанию index.gz репозитория):
+// пакеты, файлы, псевдонимы, исполняемые файлы и описания пакетов. Индекс-файл сверяется с хэш-файлом
+// и, при наличии подписи, с доверенным открытым ключом pubPath. В БД записываются только файлы индекс-файла,
+// имеющиеся в репозитории: контрольная сумма берется из индекс-файла, если файл не изменялся после выгрузки
+// (для формата 2 совпадают размер и дата изменения, для формата 1 дата изменения не позже метки времени
+// выгрузки), иначе подсчитывается заново. Файлы, отсутствующие в индекс-файле, не добавляются и выводятся:
+// шаблоны исключения файлов в индекс-файле не хранятся.
+// Исправная БД пересоздается только при force; прежняя БД сохраняется с суффиксом .prev,
+// записи ее журнала операций переносятся в новую БД, если она читается.
+// Выполняется в режиме регламента
+func RecoverDB(r *Repo, from, pubPath string, force bool) error {
+	if err = checkRegl(r.path); err != nil {
+		return err
+	}
+	fpDB := pathDB(r.path)
+	if fileExists(fpDB) && !force && dbIsValid(fpDB) {
+		return &InternalError{
+			Text:   "БД репозитория исправна. Для пересоздания БД по индекс-файлу укажите -force",
+			Caller: "RecoverDB",
+		}
+	}
+	if from == "" {
+		from = filepath.Join(r.path, IndexGZ)
+	}
+	index, algo, err := readIndexFile(from, pubPath)
+	if err != nil {
+		return err
+	}
+	// файлы индекс-файла формата 1, измененные после выгрузки, не могут быть сверены с индекс-файлом
+	stamp, err := strconv.ParseInt(index.Meta["stamp"], 10, 64)
+	if err != nil && index.Meta["version"] == IndexFormatV1 {
+		fmt.Println("! в индекс-файле отсутствует метка времени выгрузки: контрольные суммы всех файлов будут подсчитаны заново")
+		stamp = 0
+	}
+
+	fpTmp := fpDB + suffixTmp
+	_ = os.Remove(fpTmp)
+	if err = createDB(fpTmp, algo.name); err != nil {
+		return err
+	}
+	if r.db, err = newConnection(fpTmp); err != nil {
+		_ = os.Remove(fpTmp)
+		return err
+	}
+	r.algo = algo
+	done := false
+	defer func() {
+		if !done {
+			_ = r.Close()
+			_ = os.Remove(fpTmp)
+		}
+	}()
+	// журнал операций переносится из прежней БД, если она читается
+	if fileExists(fpDB) {
+		if n, err := copyAudit(r.db, fpDB); err != nil {
+			fmt.Printf("! журнал операций прежней БД не перенесен: %v\n", err)
+		} else {
+			fmt.Printf("Журнал операций прежней БД перенесен, записей: %d\n", n)
+		}
+	}
+	fmt.Printf("Восстановление БД по индекс-файлу %s:\n", from)
+	stat, err := r.recoverPacks(index, stamp*1e9)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n  пакетов: %d, файлов с контрольной суммой из индекс-файла: %d, изменены после выгрузки: %d\n\n",
+		stat.packs, stat.trusted, stat.rehash)
+	// разностные файлы формируются заново к опубликованному индекс-файлу по данным восстановленной БД
+	if fileExists(filepath.Join(r.path, IndexGZ)) {
+		r.publishDeltas()
+	} else if err = removeDeltas(r.path); err != nil {
+		fmt.Printf("! каталог %s не удален: %v\n", DeltaDir, err)
+	}
+	r.audit(auditRecoverDB, "", "", fmt.Sprintf("индекс-файл %s, пакетов: %d", from, stat.packs))
+	if err = r.Close(); err != nil {
+		return err
+	}
+	r.db = nil
+
+	if fileExists(fpDB) {
+		if err = os.Rename(fpDB, fpDB+suffixPrev); err != nil {
+			return &InternalError{
+				Text:   "ошибка сохранения текущей БД",
+				Caller: "RecoverDB::Rename",
+				Err:    err,
+			}
+		}
+		fmt.Println("Прежняя БД сохранена:", fpDB+suffixPrev)
+	}
+	if err = os.Rename(fpTmp, fpDB); err != nil {
+		return &InternalError{
+			Text:   "ошибка замены БД",
+			Caller: "RecoverDB::Rename",
+			Err:    err,
+		}
+	}
+	done = true
+	fmt.Println("БД восстановлена")
+
+	if len(stat.missing) > 0 {
+		fmt.Printf("Пакеты индекс-файла, отсутствующие в репозитории: %s\n", strings.Join(stat.missing, ", "))
+	}
+	if len(stat.notIndex) > 0 {
+		fmt.Printf("Пакеты, отсутствующие в индекс-файле (новые или заблокированные): %s\n", strings.Join(stat.notIndex, ", "))
+		fmt.Println("\tПроиндексируйте или заблокируйте пакеты командами 'index' | 'disable'")
+	}
+	if len(stat.newFiles) > 0 {
+		fmt.Println("Файлы, отсутствующие в индекс-файле (новые или исключенные из индексации), в БД не добавлены:")
+		for _, pack := range sortedListKeys(stat.newFiles) {
+			fmt.Println("[", pack, "]")
+			for _, fp := range stat.newFiles[pack] {
+				fmt.Printf("  + %s\n", fp)
+			}
+		}
+	}
+	fmt.Println("\tШаблоны исключения файлов и блокировки пакетов не хранятся в индекс-файле: восстановите их командой " +
+		"'config import' или проверьте командами 'ignore show' | 'list' до индексации")
+	if len(stat.failed) > 0 {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка восстановления пакетов: %s", strings.Join(stat.failed, ", ")),
+			Caller: "RecoverDB",
+		}
+	}
+	if stat.rehash > 0 || len(stat.missing) > 0 {
+		fmt.Print(doPopMsg)
+	}
+	return nil
+}
+
+// recoverPacks записывает в БД данные пакетов индекс-файла, имеющихся в репозитории.
+// Записываются только файлы индекс-файла; файлы, измененные после выгрузки, записываются
+// с подсчитанной заново контрольной суммой.
+// Для индекс-файла формата 1 неизменными считаются файлы с датой изменения не позже stamp (нс)
+func (r *Repo) recoverPacks(index *indexData, stamp int64) (*recoverStat, error) {
+	stat := &recoverStat{newFiles: map[string][]string{}}
+	for _, pack := range r.ActivePacks() {
+		if _, ok := index.Packs[pack]; !ok {
+			stat.notIndex = append(stat.notIndex, pack)
+		}
+	}
+	if err = r.setPrepare(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(index.Packs))
+	for name := range index.Packs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fi, err := os.Stat(filepath.Join(r.path, name)); err != nil || !fi.IsDir() {
+			stat.missing = append(stat.missing, name)
+			continue
+		}
+		fmt.Println("[", name, "]")
+		if err := r.recoverPack(name, index.Packs[name], index.Meta["version"], stamp, stat); err != nil {
+			fmt.Printf("  ! данные пакета не восстановлены: %v\n", err)
+			stat.failed = append(stat.failed, name)
+			continue
+		}
+		stat.packs++
+	}
+	return stat, nil
+}
+
+// recoverPack записывает в БД данные пакета индекс-файла формата format в отдельной транзакции.
+// Контрольные суммы измененных после выгрузки файлов подсчитываются до начала транзакции
+func (r *Repo) recoverPack(name string, data HashedPackData, format string, stamp int64, stat *recoverStat) (err error) {
+	files, err := r.filesPackRepo(name)
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(r.path, name)
+	var recovered, changed []*FileInfo
+	var paths []string
+	for _, fi := range files {
+		rel := relPath(root, fi.Path)
+		f, ok := data.Files[rel]
+		if !ok {
+			stat.newFiles[name] = append(stat.newFiles[name], rel)
+			continue
+		}
+		modified := fi.MDate > stamp
+		if format != IndexFormatV1 {
+			modified = fi.Size != f.Size || fi.MDate/1e9 != f.MTime
+		}
+		if modified {
+			changed = append(changed, fi)
+			paths = append(paths, fi.Path)
+		} else {
+			fi.Hash = f.Hash
+		}
+		fi.Path = rel
+		recovered = append(recovered, fi)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	hashes := hashFiles(r.hashAlgo(), paths, r.workers, done)
+	for _, fi := range changed {
+		res := <-<-hashes
+		if res.err != nil {
+			return res.err
+		}
+		fi.Hash = res.hash
+		fmt.Printf("  %c %s\n", opFileUpd, fi.Path)
+	}
+
+	ptx, err := r.beginPackTx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = ptx.Rollback()
+		}
+	}()
+	id, err := r.newPackage(ptx, name)
+	if err != nil {
+		return err
+	}
+	var execFile interface{}
+	if data.Exec != "" {
+		execFile = data.Exec
+	}
+	if _, err = ptx.Exec("UPDATE packages SET exec=? WHERE id=?;", execFile, id); err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка записи исполняемого файла пакета %q", name),
+			Caller: "RecoverDB::exec",
+			Err:    err,
+		}
+	}
+	if data.Alias != "" {
+		if _, err = ptx.Exec("INSERT INTO aliases (name, alias) VALUES (?, ?);", name, data.Alias); err != nil {
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка записи псевдонима пакета %q", name),
+				Caller: "RecoverDB::alias",
+				Err:    err,
+			}
+		}
+	}
+	if err = r.updatePackManifest(ptx, id, data.Manifest); err != nil {
+		return err
+	}
+	for _, fi := range recovered {
+		fi.ID = id
+		if err = r.addFileData(ptx, fi); err != nil {
+			return err
+		}
+	}
+	if err = r.updatePackData(ptx, id); err != nil {
+		return err
+	}
+	if err = ptx.Commit(); err != nil {
+		return &InternalError{
+			Text:   "ошибка фиксации транзакции",
+			Caller: "RecoverDB::Commit",
+			Err:    err,
+		}
+	}
+	stat.trusted += len(recovered) - len(changed)
+	stat.rehash += len(changed)
+	return nil
+}
+
+// sortedListKeys возвращает упорядоченный список ключей
+func sortedListKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readIndexFile читает индекс-файл и проверяет его соответствие хэш-файлу и подписи при наличии;
+// подпись проверяется доверенным открытым ключом pubPath.
+// Возвращает данные индекс-файла и алгоритм контрольных сумм
+func readIndexFile(fp, pubPath string) (*indexData, *hashAlgo, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения индекс-файла %s", fp),
+			Caller: "RecoverDB::readIndex",
+			Err:    err,
+		}
+	}
+	index := new(indexData)
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err == nil {
+		err = json.NewDecoder(zr).Decode(index)
+	}
+	if err != nil {
+		return nil, nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения данных индекс-файла %s", fp),
+			Caller: "RecoverDB::readIndex::decode",
+			Err:    err,
+		}
+	}
+	if v := index.Meta["version"]; v != IndexFormatV1 && v != IndexFormatV2 {
+		return nil, nil, &InternalError{
+			Text:   fmt.Sprintf("формат индекс-файла %q не поддерживается", v),
+			Caller: "RecoverDB::readIndex",
+		}
+	}
+	algo := hashAlgos[HashSHA1] // индекс-файл выгружен до версии БД 1.7
+	if name, ok := index.Meta["hash"]; ok {
+		if algo, err = hashAlgoByName(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	// хэш-файл располагается рядом с индекс-файлом
+	fpHash := fp + strings.TrimPrefix(hashFileName(algo), IndexGZ)
+	if hash, err := ioutil.ReadFile(fpHash); err != nil {
+		fmt.Printf("! хэш-файл %s не найден: проверка индекс-файла пропущена\n", fpHash)
+	} else if strings.TrimSpace(string(hash)) != hashSum(algo, string(data)) {
+		return nil, nil, &InternalError{
+			Text:   fmt.Sprintf("хэш-файл %s не соответствует индекс-файлу", fpHash),
+			Caller: "RecoverDB::readIndex",
+		}
+	}
+	// подпись располагается рядом с индекс-файлом
+	fpSig := fp + strings.TrimPrefix(IndexSig, IndexGZ)
+	if sig, err := ioutil.ReadFile(fpSig); err != nil {
+		if index.Meta["key"] != "" {
+			fmt.Printf("! индекс-файл подписан, файл подписи %s не найден: проверка подписи пропущена\n", fpSig)
+		}
+	} else {
+		pub, err := readPublicKey(pubPath)
+		if err != nil {
+			return nil, nil, &InternalError{
+				Text:   fmt.Sprintf("индекс-файл подписан: укажите доверенный открытый ключ параметром -pub (%v)", err),
+				Caller: "RecoverDB::readIndex",
+				Err:    err,
+			}
+		}
+		if !verifyIndexSignature(pub, index.Meta, data, sig) {
+			return nil, nil, &InternalError{
+				Text:   fmt.Sprintf("подпись %s не соответствует индекс-файлу или доверенному ключу", fpSig),
+				Caller: "RecoverDB::readIndex",
+			}
+		}
+		fmt.Println("Подпись индекс-файла проверена:", keyFingerprint(pub))
+	}
+	return index, algo, nil
+}
+
+// dbIsValid проверяет, открывается ли БД и проходит ли проверку целостности
+func dbIsValid(fp string) bool {
+	db, err := newConnection(fp)
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	return (&Repo{db: db}).checkDB() == nil
+}
@@ -2,52 +2,71 @@ package handler
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // SetReglamentMode обрабатывает команду `regl`
-// активирует/деактивирует режим регламента репозитория
-func SetReglamentMode(repoPath, mode string) error {
+// активирует/деактивирует режим регламента репозитория.
+// При активации в файл регламента записываются данные инициатора работ: компьютер, пользователь, PID,
+// время начала, причина reason и ожидаемая продолжительность ttl (0 - без ограничения),
+// по истечении которой блокировка выводится как просроченная.
+// Блокировку, установленную другим пользователем, снимает только force
+func SetReglamentMode(repoPath, mode, reason string, ttl time.Duration, force bool) error {
 	const (
 		reglOnMessage  string = "Режим регламента активирован [on]"
 		reglOffMessage string = "Режим регламента деактивирован [off]"
 	)
 	// проверка на наличие файла-флага, определение режима регламента
 	fRegl := filepath.Join(repoPath, fnReglament)
-	modeIsOn := reglIsSet(repoPath)
+	lock, err := readReglamentLock(repoPath)
+	if err != nil {
+		return err
+	}
 
 	switch mode {
 	// вывод режима регламента
 	case "", "status":
-		if modeIsOn {
+		if OutputIsJSON() {
+			return printJSON(&ReglamentDocument{Reglament: lock != nil, Lock: lock})
+		}
+		if lock != nil {
 			fmt.Println(reglOnMessage)
+			lock.print()
 		} else {
 			fmt.Println(reglOffMessage)
 		}
 		// активация режима регламента
 	case "on":
+		if ttl < 0 {
+			return &InternalError{
+				Text:   fmt.Sprintf("неверная продолжительность работ: %v", ttl),
+				Caller: "Reglament",
+			}
+		}
 		// регламент уже активирован - вывод сообщения и информации кто активировал
-		if modeIsOn {
-			owner, _ := ioutil.ReadFile(fRegl)
-			fmt.Println(reglOnMessage, string(owner))
+		if lock != nil {
+			fmt.Println(reglOnMessage)
+			lock.print()
 			// активация регламента с записью информации кто активировал
 		} else {
-			err = ioutil.WriteFile(fRegl, taskOwnerInfo(), 0644)
-			if err != nil {
-				return &InternalError{
-					Text:   "ошибка установки режима регламента",
-					Caller: "Reglament::writeFile",
-					Err:    err,
-				}
+			if err = writeReglamentLock(repoPath, newReglamentLock(reason, ttl)); err != nil {
+				return err
 			}
 			fmt.Println(reglOnMessage)
 		}
 	// деактивация режима регламента
 	case "off":
 		// регламент активирован - удаляем файл
-		if modeIsOn {
+		if lock != nil {
+			if lock.foreign() && !force {
+				lock.print()
+				return &InternalError{
+					Text:   fmt.Sprintf("режим регламента установлен другим пользователем: %s. Для снятия укажите -force", lock.owner()),
+					Caller: "Reglament::off",
+				}
+			}
 			if err = os.Remove(fRegl); err != nil {
 				return &InternalError{
 					Text:   "ошибка снятия режима регламента",
@@ -55,6 +74,9 @@ func SetReglamentMode(repoPath, mode string) error {
 					Err:    err,
 				}
 			}
+			if lock.foreign() {
+				fmt.Printf("Снята блокировка пользователя %s\n", lock.owner())
+			}
 		}
 		fmt.Println(reglOffMessage)
 	default:
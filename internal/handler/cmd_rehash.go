@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"fmt"
+)
+
+// Rehash обрабатывает команду `rehash`
+// устанавливает алгоритм подсчета контрольных сумм репозитория
+// и выполняет полную индексацию активных пакетов по новому алгоритму.
+// Новый алгоритм отмечается в БД до пересчета и сохраняется как алгоритм репозитория только
+// после успешного пересчета всех пакетов; до этого индексация и выгрузка индекс-файла не выполняются
+func Rehash(r *Repo, name string) error {
+	if name == "" {
+		name = DefaultHashAlgo
+	}
+	algo, err := hashAlgoByName(name)
+	if err != nil {
+		return err
+	}
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	if err = checkRegl(r.path); err != nil {
+		return err
+	}
+	prev := r.hashAlgo()
+	if err = r.setHashNext(algo); err != nil {
+		return err
+	}
+	fmt.Printf("Пересчет контрольных сумм: %s -> %s\n\n", prev.name, algo.name)
+
+	r.algo = algo
+	if err = Index(r, true, r.ActivePacks()); err != nil {
+		r.algo = prev
+		return &InternalError{
+			Text:   fmt.Sprintf("%v\n\n\tПересчет не завершен. Повторите команду 'rehash %s'", err, algo.name),
+			Caller: "Rehash",
+			Err:    err,
+		}
+	}
+	if err = r.setHashAlgo(algo); err != nil {
+		return err
+	}
+	fmt.Printf("Установлен алгоритм контрольных сумм: %s\n", algo.name)
+	return nil
+}
@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// параметры HTTP сервера репозитория
+const (
+	servePackPrefix  = "/packages/" // префикс URL файлов пакетов
+	serveDeltaPrefix = "/delta/"    // префикс URL перечня и разностных файлов индекса
+	serveGzipMin     = 1024         // минимальный размер файла для сжатия при передаче
+	serveRetryAfter  = "60"         // рекомендуемая задержка повторного запроса в режиме регламента, сек
+)
+
+// serveNoGzipExt расширения файлов, не сжимаемых при передаче
+var serveNoGzipExt = map[string]bool{
+	".gz": true, ".zip": true, ".7z": true, ".rar": true, ".cab": true, ".msi": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".mp3": true, ".mp4": true,
+}
+
+// repoServer обработчик HTTP запросов к репозиторию
+type repoServer struct {
+	r           *Repo
+	algo        *hashAlgo // алгоритм контрольных сумм на момент запуска сервера
+	insensitive bool      // сравнение имен без учета регистра на момент запуска сервера
+}
+
+// Serve обрабатывает команду `serve`
+// предоставляет доступ к индекс-файлу, его хэш-файлу и подписи, разностным файлам индекса,
+// а также к файлам проиндексированных пакетов по HTTP. Работает до получения сигнала прерывания.
+// apiToken - токен авторизации API управления репозиторием /api/; пустой - API отключен
+func Serve(r *Repo, addr, apiToken string) error {
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	mux := newServeMux(r)
+	if apiToken != "" {
+		// операции API не могут запрашивать подтверждение и выбор оператора
+		SetInputPolicy(false, true)
+		mux.Handle(apiPrefix, serveLog(newAPIHandler(r, apiToken)))
+	}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		log.Println("Остановка сервера")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+		close(idle)
+	}()
+
+	fmt.Printf("Сервер репозитория запущен: %s\n", addr)
+	if apiToken != "" {
+		fmt.Printf("API управления: %s\n", apiPrefix)
+	}
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return &InternalError{
+			Text:   "ошибка запуска HTTP сервера",
+			Caller: "Serve::ListenAndServe",
+			Err:    err,
+		}
+	}
+	<-idle
+	return nil
+}
+
+// newServeMux возвращает маршрутизатор запросов к репозиторию
+func newServeMux(r *Repo) *http.ServeMux {
+	// алгоритм контрольных сумм и политика сравнения имен копируются до обработки запросов:
+	// кэш Repo сбрасывается операциями API, выполняемыми параллельно с передачей файлов
+	rs := &repoServer{r: r, algo: r.hashAlgo(), insensitive: r.caseInsensitive()}
+	mux := http.NewServeMux()
+	mux.Handle("/", serveLog(rs.maintenance(http.HandlerFunc(rs.serveIndex))))
+	mux.Handle(servePackPrefix, serveLog(rs.maintenance(http.HandlerFunc(rs.servePackFile))))
+	mux.Handle(serveDeltaPrefix, serveLog(rs.maintenance(http.HandlerFunc(rs.serveDelta))))
+	return mux
+}
+
+// maintenance отвечает 503 на все запросы, пока в репозитории установлен режим регламента
+func (rs *repoServer) maintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if reglIsSet(rs.r.path) {
+			w.Header().Set("Retry-After", serveRetryAfter)
+			http.Error(w, "репозиторий в режиме регламента", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// serveIndex передает индекс-файл, его хэш-файл и подпись
+func (rs *repoServer) serveIndex(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	switch {
+	case name == IndexGZ:
+		fpHash := publishedHashFile(rs.r.path, "")
+		hash, err := ioutil.ReadFile(fpHash)
+		if fpHash == "" || err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		rs.serveFile(w, req, filepath.Join(rs.r.path, IndexGZ), string(hash))
+	case name == IndexSig || isIndexHashFile(name):
+		data, err := ioutil.ReadFile(filepath.Join(rs.r.path, name))
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("ETag", quoteETag(hashSum(rs.algo, string(data))))
+		http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(data))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// serveDelta передает перечень разностных файлов индекса и разностные файлы по пути /delta/<файл>
+func (rs *repoServer) serveDelta(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, serveDeltaPrefix)
+	isDelta := strings.HasPrefix(name, deltaPrefix) && strings.HasSuffix(name, ".gz")
+	if name != DeltaManifest && name != DeltaManifestSig && !isDelta || strings.ContainsAny(name, `/\`) {
+		http.NotFound(w, req)
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(rs.r.path, DeltaDir, name))
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	switch {
+	case isDelta:
+		w.Header().Set("Content-Type", "application/gzip")
+	case name == DeltaManifestSig:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("ETag", quoteETag(hashSum(rs.algo, string(data))))
+	http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(data))
+}
+
+// servePackFile передает файл пакета по пути /packages/<пакет>/<путь файла в пакете>.
+// Передаются только файлы незаблокированных пакетов, имеющиеся в БД; ETag - контрольная сумма файла
+func (rs *repoServer) servePackFile(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, servePackPrefix)
+	i := strings.Index(p, "/")
+	if i < 1 || p[i+1:] == "" || path.Clean(p) != p {
+		http.NotFound(w, req)
+		return
+	}
+	pack, rel := p[:i], canonicalPath(p[i+1:])
+
+	pack, fd, err := rs.r.packFileInfo(pack, rel, rs.insensitive)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	} else if fd == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	// путь на диске строится по именам в БД: запрос может отличаться регистром символов
+	fp := filepath.Join(rs.r.path, pack, filepath.FromSlash(fd.Path))
+	info, err := os.Stat(fp)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	// файл изменен после индексации - контрольная сумма в БД недействительна
+	if info.Size() != fd.Size || info.ModTime().UnixNano() != fd.MDate {
+		w.Header().Set("Retry-After", serveRetryAfter)
+		http.Error(w, "файл изменен после индексации", http.StatusServiceUnavailable)
+		return
+	}
+
+	if fd.Size >= serveGzipMin && !serveNoGzipExt[strings.ToLower(filepath.Ext(fp))] &&
+		req.Header.Get("Range") == "" && acceptsGzip(req) {
+		rs.serveGzip(w, req, fp, fd.Hash)
+		return
+	}
+	rs.serveFile(w, req, fp, fd.Hash)
+}
+
+// serveFile передает файл с поддержкой условных запросов и запросов диапазона (Range)
+func (rs *repoServer) serveFile(w http.ResponseWriter, req *http.Request, fp, hash string) {
+	f, err := os.Open(fp)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", quoteETag(hash))
+	http.ServeContent(w, req, filepath.Base(fp), info.ModTime(), f)
+}
+
+// serveGzip передает файл, сжатый gzip. Сжатое представление имеет собственный ETag
+func (rs *repoServer) serveGzip(w http.ResponseWriter, req *http.Request, fp, hash string) {
+	etag := quoteETag(hash + "-gzip")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", etag)
+	if match := req.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if req.Method == http.MethodHead {
+		return
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := io.Copy(zw, f); err != nil {
+		log.Printf("ошибка передачи файла %s: %v", fp, err)
+	}
+	_ = zw.Close()
+}
+
+// isIndexHashFile проверяет, является ли имя именем хэш-файла индекса одного из алгоритмов
+func isIndexHashFile(name string) bool {
+	for _, a := range hashAlgos {
+		if name == hashFileName(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip проверяет, принимает ли клиент данные, сжатые gzip
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if enc == "gzip" || (strings.HasPrefix(enc, "gzip;") && !strings.HasSuffix(enc, "q=0")) {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteETag возвращает значение заголовка ETag
+func quoteETag(s string) string {
+	return `"` + s + `"`
+}
+
+// statusWriter сохраняет код ответа для журнала запросов
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// serveLog выводит в журнал данные о запросе и код ответа
+func serveLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, req)
+		log.Printf("%s %s %s %d", req.RemoteAddr, req.Method, req.URL.Path, sw.status)
+	})
+}
@@ -8,23 +8,36 @@ import (
 // выводит актуальную информацию о репозитории
 func RepoStatus(r *Repo) error {
 	const timeLayout = "2006-01-02 15:04:05"
+	if OutputIsJSON() {
+		doc, err := StatusDoc(r)
+		if err != nil {
+			return err
+		}
+		return printJSON(doc)
+	}
 	rData, err := r.repoStatus()
 	if err != nil {
 		return err
 	}
 
-	var reglStatus string
-	switch reglIsSet(r.path) {
-	case true:
+	lock, err := readReglamentLock(r.path)
+	if err != nil {
+		return err
+	}
+	reglStatus := "off"
+	if lock != nil {
 		reglStatus = "on"
-	default:
-		reglStatus = "off"
 	}
 
 	unIndexed := rData.TotalCnt - (rData.IndexedCnt + rData.BlockedCnt)
 	template := "%-40s%v\n"
 
 	fmt.Printf(template, "Статус регламента", reglStatus)
+	if lock != nil {
+		lock.print()
+	}
+	fmt.Printf(template, "Алгоритм контрольных сумм", rData.HashAlgo)
+	fmt.Printf(template, "Сравнение имен пакетов и файлов", rData.CasePolicy)
 	fmt.Println()
 	fmt.Printf(template, "Пакетов в репозитории", rData.TotalCnt)
 	fmt.Printf(template, "Пакетов проиндексировано", rData.IndexedCnt)
@@ -46,9 +59,9 @@ func RepoStatus(r *Repo) error {
 		fmt.Println("index.gz \t\t нет данных")
 	}
 	if rData.HashSize > -1 {
-		fmt.Printf("index.gz.sha1 \t%d\t байт от %v\n", rData.HashSize, rData.HashMDate.Format(timeLayout))
+		fmt.Printf("%s \t%d\t байт от %v\n", rData.HashFile, rData.HashSize, rData.HashMDate.Format(timeLayout))
 	} else {
-		fmt.Println("index.gz.sha1 \t\t нет данных")
+		fmt.Printf("%s \t\t нет данных\n", rData.HashFile)
 	}
 	fmt.Println()
 
@@ -68,13 +81,22 @@ func RepoStatus(r *Repo) error {
 	showEmptyExecFiles(r) // проверка на пустые исполняемый файлы
 
 	if unIndexed > 0 || unIndexed < 0 {
-		fmt.Println(doIndexMsg)
+		fmt.Print(doIndexMsg)
 	} else if rData.IndexMDate.IsZero() {
 		fmt.Print("\n\tИндекс-файл отсутствует")
-		fmt.Println(doPopMsg)
-	} else if rData.DBMDate.UnixNano() > rData.IndexMDate.UnixNano() {
-		fmt.Print("\n\tИндекс-файл старше файла БД")
-		fmt.Println(doPopMsg)
+		fmt.Print(doPopMsg)
+	} else if rData.IndexedCnt > 0 {
+		// сравниваются данные, а не даты файлов: файл БД изменяется и записью журнала операций
+		// после выгрузки, восстановления и отката индекс-файла
+		published, err := r.indexPublished()
+		if err != nil {
+			return err
+		}
+		if !published {
+			fmt.Print("\n\tИндекс-файл не соответствует данным БД")
+			fmt.Print(doPopMsg)
+		}
 	}
+	showFormatHint(r)
 	return nil
 }
@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verify обрабатывает команду `verify -files`
+// пересчитывает контрольные суммы файлов пакетов и сверяет их с данными БД.
+// Выводит по каждому пакету файлы с несовпадающей контрольной суммой при неизменных
+// размере и дате (повреждение или подмена), измененные после индексации, отсутствующие
+// и не проиндексированные файлы. При наличии расхождений возвращает ошибку.
+// sample - выборочная проверка: количество ("500") или доля ("10%") файлов каждого пакета;
+// пустая строка - проверка всех файлов
+func Verify(r *Repo, sample string, packs []string) error {
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	if err = r.checkRehash(); err != nil {
+		return err
+	}
+	count, percent, err := parseSample(sample)
+	if err != nil {
+		return err
+	}
+	packs = r.packNames(packs)
+	if len(packs) == 0 {
+		for _, pack := range r.packages() {
+			if r.PackIsActive(pack) {
+				packs = append(packs, pack)
+			}
+		}
+	}
+
+	doc := &VerifyDocument{Sample: sample, Packages: []PackVerify{}}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, pack := range packs {
+		if !r.packIsIndexed(pack) || !r.PackIsActive(pack) {
+			return &InternalError{
+				Text:   fmt.Sprintf("пакет %q не проиндексирован или заблокирован", pack),
+				Caller: "Verify",
+			}
+		}
+		pv, err := r.verifyPack(pack, count, percent, rnd)
+		if err != nil {
+			return err
+		}
+		doc.Checked += pv.Checked
+		doc.Files += pv.Files
+		doc.Discrepancies += pv.discrepancies()
+		doc.Packages = append(doc.Packages, *pv)
+	}
+
+	if OutputIsJSON() {
+		err = printJSON(doc)
+	} else {
+		printVerify(doc)
+	}
+	if err == nil && doc.Discrepancies > 0 {
+		err = &InternalError{
+			Text:   fmt.Sprintf("обнаружены расхождения: %d", doc.Discrepancies),
+			Caller: "Verify",
+		}
+	}
+	return err
+}
+
+// verifyPack сверяет файлы пакета в репозитории с данными БД
+func (r *Repo) verifyPack(pack string, count int, percent float64, rnd *rand.Rand) (*PackVerify, error) {
+	packID, err := r.packageID(pack)
+	if err != nil {
+		return nil, err
+	}
+	// полная сверка списков: все файлы с совпадающим путем попадают в список на обновление
+	tasks, err := r.indexTasks(true, packID, pack)
+	if err != nil {
+		return nil, err
+	}
+
+	pv := &PackVerify{
+		Package:  pack,
+		Corrupt:  []string{},
+		Modified: []string{},
+		Missing:  []string{},
+		Extra:    []string{},
+	}
+	var check []*indexTask
+	for _, task := range tasks {
+		switch task.op {
+		case opFileAdd:
+			pv.Extra = append(pv.Extra, task.fInfo.Path)
+		case opFileDel:
+			pv.Missing = append(pv.Missing, task.fInfo.Path)
+			pv.Files++
+		case opFileUpd:
+			pv.Files++
+			if task.fInfo.Size != task.prev.Size || task.fInfo.MDate != task.prev.MDate {
+				pv.Modified = append(pv.Modified, task.fInfo.Path)
+			} else {
+				check = append(check, task)
+			}
+		}
+	}
+
+	// выборка файлов для проверки с сохранением порядка следования
+	n := len(check)
+	if percent > 0 {
+		n = int(float64(len(check))*percent/100 + 0.5)
+	} else if count > 0 && count < n {
+		n = count
+	}
+	if n < len(check) {
+		idx := rnd.Perm(len(check))[:n]
+		sort.Ints(idx)
+		sampled := make([]*indexTask, 0, n)
+		for _, i := range idx {
+			sampled = append(sampled, check[i])
+		}
+		check = sampled
+	}
+
+	paths := make([]string, 0, len(check))
+	for _, task := range check {
+		paths = append(paths, task.fPath)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	hashes := hashFiles(r.hashAlgo(), paths, r.workers, done)
+	for _, task := range check {
+		res := <-<-hashes
+		if res.err != nil {
+			return nil, res.err
+		}
+		if res.hash != task.prev.Hash {
+			pv.Corrupt = append(pv.Corrupt, task.fInfo.Path)
+		}
+		pv.Checked++
+	}
+	return pv, nil
+}
+
+// parseSample разбирает параметр выборочной проверки: количество или доля файлов в процентах
+func parseSample(sample string) (count int, percent float64, err error) {
+	if sample == "" {
+		return 0, 0, nil
+	}
+	if strings.HasSuffix(sample, "%") {
+		percent, err = strconv.ParseFloat(strings.TrimSuffix(sample, "%"), 64)
+		if err == nil && (percent <= 0 || percent > 100) {
+			err = fmt.Errorf("доля вне диапазона")
+		}
+	} else {
+		count, err = strconv.Atoi(sample)
+		if err == nil && count <= 0 {
+			err = fmt.Errorf("количество должно быть больше 0")
+		}
+	}
+	if err != nil {
+		return 0, 0, &InternalError{
+			Text:   fmt.Sprintf("неверный параметр выборки %q. укажите количество (500) или долю (10%%) файлов пакета", sample),
+			Caller: "Verify::parseSample",
+			Err:    err,
+		}
+	}
+	return count, percent, nil
+}
+
+// discrepancies возвращает количество расхождений пакета
+func (pv *PackVerify) discrepancies() int {
+	return len(pv.Corrupt) + len(pv.Modified) + len(pv.Missing) + len(pv.Extra)
+}
+
+// printVerify выводит результаты проверки файлов
+func printVerify(doc *VerifyDocument) {
+	for _, pv := range doc.Packages {
+		fmt.Printf("[ %s ] проверено файлов: %d из %d\n", pv.Package, pv.Checked, pv.Files)
+		for _, files := range []struct {
+			mark  string
+			msg   string
+			paths []string
+		}{
+			{"!", "контрольная сумма не совпадает", pv.Corrupt},
+			{".", "изменен после индексации", pv.Modified},
+			{"-", "отсутствует", pv.Missing},
+			{"+", "не проиндексирован", pv.Extra},
+		} {
+			for _, fp := range files.paths {
+				fmt.Printf("  %s %s (%s)\n", files.mark, fp, files.msg)
+			}
+		}
+	}
+	fmt.Printf("\nПроверено файлов: %d из %d", doc.Checked, doc.Files)
+	if doc.Sample != "" {
+		fmt.Printf(" (выборка %s)", doc.Sample)
+	}
+	fmt.Printf(", расхождений: %d\n", doc.Discrepancies)
+}
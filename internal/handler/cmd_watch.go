@@ -0,0 +1,360 @@
+package handler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchCheckPeriod период проверки завершения изменений пакетов
+const watchCheckPeriod = time.Second
+
+// watchWindow окно регламента: интервал времени суток, в котором выполняется индексация.
+// Интервал может переходить через полночь (22:00-06:00)
+type watchWindow struct {
+	from, to time.Duration // смещение от начала суток
+}
+
+// packWatch состояние отслеживаемого пакета
+type packWatch struct {
+	sign    uint64    // сигнатура списка файлов пакета: пути, размеры, даты изменения
+	changed time.Time // время последнего обнаруженного изменения; нулевое - изменений нет
+}
+
+// watcher отслеживает изменения пакетов репозитория
+type watcher struct {
+	r        *Repo
+	debounce time.Duration
+	window   *watchWindow
+	packs    map[string]*packWatch
+	deferred string // инициатор работ, из-за которого отложена индексация
+}
+
+// Watch обрабатывает команду `watch`
+// отслеживает изменения файлов пакетов репозитория опросом (сравнение путей, размеров и дат
+// изменения файлов с периодом interval) и, при notify, уведомлениями файловой системы (Linux inotify).
+// Пакет индексируется после того, как его файлы не изменяются в течение debounce.
+// Индексация измененных пакетов и выгрузка индекс-файла при наличии изменений выполняются
+// в режиме регламента, устанавливаемом на время работ, в окне регламента window (22:00-06:00;
+// пустая строка - в любое время). Если режим регламента установлен другим процессом, индексация
+// откладывается. Работает до получения сигнала прерывания
+func Watch(r *Repo, interval, debounce time.Duration, window string, notify bool) error {
+	if err = r.checkDBVersion(); err != nil {
+		return err
+	}
+	if interval <= 0 || debounce < 0 {
+		return &InternalError{
+			Text:   "период опроса должен быть больше 0, задержка индексации - не меньше 0",
+			Caller: "Watch",
+		}
+	}
+	w := &watcher{r: r, debounce: debounce, packs: map[string]*packWatch{}}
+	if w.window, err = parseWatchWindow(window); err != nil {
+		return err
+	}
+	// операции в фоновом режиме не могут запрашивать подтверждение оператора
+	SetInputPolicy(true, true)
+
+	var events <-chan string
+	if notify {
+		if events, err = newNotifier(r.path); err != nil {
+			return err
+		}
+	}
+	if err = w.init(); err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	poll := time.NewTicker(interval)
+	defer poll.Stop()
+	check := time.NewTicker(watchCheckPeriod)
+	defer check.Stop()
+
+	log.Printf("Отслеживание изменений: опрос %v, задержка %v, окно регламента %s, уведомления ФС: %v",
+		interval, debounce, w.window, notify)
+	for {
+		select {
+		case <-sig:
+			log.Println("Остановка отслеживания изменений")
+			return nil
+		case <-poll.C:
+			if err = w.poll(); err != nil {
+				log.Printf("ошибка опроса пакетов: %v", err)
+			}
+		case pack := <-events:
+			// изменение продолжается - индексация пакета откладывается;
+			// новые пакеты определяются опросом
+			if pw, ok := w.packs[pack]; ok && pw.sign != 0 {
+				if pw.changed.IsZero() {
+					log.Printf("[ %s ] изменения файлов пакета", pack)
+				}
+				pw.changed = time.Now()
+			}
+			continue
+		case <-check.C:
+		}
+		if ready := w.ready(time.Now()); len(ready) > 0 {
+			w.run(ready)
+		}
+	}
+}
+
+// init запоминает состояние пакетов и отмечает измененными пакеты, данные которых
+// в БД не соответствуют файлам в репозитории, а также удаленные и заблокированные
+func (w *watcher) init() error {
+	now := time.Now()
+	for _, pack := range w.r.ActivePacks() {
+		sign, err := w.scan(pack)
+		if err != nil {
+			return err
+		}
+		pw := &packWatch{sign: sign}
+		w.packs[pack] = pw
+		if !w.r.packIsIndexed(pack) {
+			pw.changed = now
+			continue
+		}
+		packID, err := w.r.packageID(pack)
+		if err != nil {
+			return err
+		}
+		tasks, err := w.r.indexTasks(false, packID, pack)
+		if err != nil {
+			return err
+		}
+		if len(tasks) > 0 {
+			pw.changed = now
+		}
+	}
+	for _, pack := range w.r.packages() {
+		if !w.r.PackIsActive(pack) {
+			w.packs[pack] = &packWatch{changed: now}
+		}
+	}
+	if pending := w.pending(); len(pending) > 0 {
+		log.Printf("Требуется индексация: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// poll сравнивает состояние пакетов с предыдущим опросом
+func (w *watcher) poll() error {
+	// пакеты могли быть заблокированы или добавлены другим процессом
+	w.r.resetCache()
+	now := time.Now()
+	active := map[string]bool{}
+	for _, pack := range w.r.ActivePacks() {
+		active[pack] = true
+		sign, err := w.scan(pack)
+		if err != nil {
+			return err
+		}
+		pw, ok := w.packs[pack]
+		if !ok {
+			log.Printf("[ %s ] новый пакет", pack)
+			w.packs[pack] = &packWatch{sign: sign, changed: now}
+			continue
+		}
+		if pw.sign != sign {
+			if pw.changed.IsZero() {
+				log.Printf("[ %s ] изменения файлов пакета", pack)
+			}
+			pw.sign, pw.changed = sign, now
+		}
+	}
+	for pack, pw := range w.packs {
+		if !active[pack] && pw.sign != 0 {
+			log.Printf("[ %s ] пакет удален или заблокирован", pack)
+			pw.sign, pw.changed = 0, now
+		}
+	}
+	return nil
+}
+
+// scan возвращает сигнатуру списка файлов пакета
+func (w *watcher) scan(pack string) (uint64, error) {
+	files, err := w.r.filesPackRepo(pack)
+	if err != nil {
+		return 0, err
+	}
+	root := filepath.Join(w.r.path, pack)
+	h := fnv.New64a()
+	for _, fi := range files {
+		_, _ = fmt.Fprintf(h, "%s\x00%d\x00%d\n", relPath(root, fi.Path), fi.Size, fi.MDate)
+	}
+	// сигнатура пустого пакета отличается от сигнатуры отсутствующего
+	return h.Sum64() | 1, nil
+}
+
+// pending возвращает упорядоченный список пакетов с необработанными изменениями
+func (w *watcher) pending() []string {
+	var packs []string
+	for pack, pw := range w.packs {
+		if !pw.changed.IsZero() {
+			packs = append(packs, pack)
+		}
+	}
+	sort.Strings(packs)
+	return packs
+}
+
+// ready возвращает пакеты, изменения которых завершены, если время t входит в окно регламента
+func (w *watcher) ready(t time.Time) []string {
+	if !w.window.contains(t) {
+		return nil
+	}
+	var packs []string
+	for _, pack := range w.pending() {
+		if t.Sub(w.packs[pack].changed) >= w.debounce {
+			packs = append(packs, pack)
+		}
+	}
+	return packs
+}
+
+// run индексирует пакеты и выгружает индекс-файл при наличии изменений в режиме регламента.
+// Если режим регламента установлен другим процессом, индексация откладывается до следующей проверки
+func (w *watcher) run(packs []string) {
+	start := time.Now()
+	lock, err := readReglamentLock(w.r.path)
+	if err != nil {
+		log.Printf("Индексация отложена: %v", err)
+		return
+	}
+	if lock != nil {
+		// сообщение выводится однократно для каждой блокировки
+		if owner := lock.owner(); owner != w.deferred {
+			log.Printf("Индексация отложена: установлен режим регламента (%s)", owner)
+			w.deferred = owner
+		}
+		return
+	}
+	w.deferred = ""
+	log.Printf("Запуск индексации: %s", strings.Join(packs, ", "))
+	if err = writeReglamentLock(w.r.path, newReglamentLock("watch: "+strings.Join(packs, ", "), 0)); err != nil {
+		log.Printf("Индексация отложена: %v", err)
+		return
+	}
+	// повторная попытка выполняется только при следующем изменении пакетов;
+	// сигнатура обновляется, чтобы изменения, полученные уведомлениями, не были обработаны повторно
+	for _, pack := range packs {
+		pw := w.packs[pack]
+		pw.changed = time.Time{}
+		if pw.sign == 0 {
+			delete(w.packs, pack)
+		} else if sign, err := w.scan(pack); err == nil {
+			pw.sign = sign
+		}
+	}
+
+	result, err := w.publish(packs)
+	if e := releaseReglamentLock(w.r.path); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		log.Printf("Индексация завершена с ошибкой за %v: %s; %v", time.Since(start).Round(time.Millisecond), result, err)
+		return
+	}
+	log.Printf("Индексация завершена за %v: %s", time.Since(start).Round(time.Millisecond), result)
+}
+
+// publish индексирует активные пакеты из указанных, проверяет исполняемые файлы
+// и выгружает индекс-файл при наличии изменений. Возвращает описание результата
+func (w *watcher) publish(packs []string) (string, error) {
+	var index []string
+	for _, pack := range packs {
+		if w.r.PackIsActive(pack) {
+			index = append(index, pack)
+		}
+	}
+	committed, rolledBack, err := indexPacks(w.r, false, index)
+	if err != nil {
+		return "ошибка индексации", err
+	}
+	result := "изменений нет"
+	if len(committed) > 0 {
+		result = "изменены: " + strings.Join(committed, ", ")
+	}
+	if len(rolledBack) > 0 {
+		return result + "; отменены: " + strings.Join(rolledBack, ", "), &InternalError{
+			Text:   fmt.Sprintf("ошибка индексации пакетов: %d. Выгрузка не выполнена", len(rolledBack)),
+			Caller: "Watch::publish",
+		}
+	}
+	if empty := w.r.nullExecFilesList(); len(empty) > 0 {
+		if err = ExecFile(w.r, "check", empty); err != nil {
+			return result + "; выгрузка не выполнена", err
+		}
+	}
+	if err = w.r.checkEmptyExecFiles(); err != nil {
+		return result + "; выгрузка не выполнена", err
+	}
+	published, err := w.r.indexPublished()
+	if err != nil {
+		return result, err
+	}
+	if published {
+		return result + "; индекс-файл актуален", nil
+	}
+	if err = Populate(w.r, w.r.publishedFormat()); err != nil {
+		return result + "; ошибка выгрузки", err
+	}
+	return result + "; индекс-файл выгружен", nil
+}
+
+// parseWatchWindow разбирает окно регламента вида ЧЧ:ММ-ЧЧ:ММ. Пустая строка - без ограничений
+func parseWatchWindow(s string) (*watchWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	bounds := strings.Split(s, "-")
+	var offsets []time.Duration
+	for _, b := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(b))
+		if err != nil {
+			offsets = nil
+			break
+		}
+		offsets = append(offsets, time.Duration(t.Hour())*time.Hour+time.Duration(t.Minute())*time.Minute)
+	}
+	if len(bounds) != 2 || len(offsets) != 2 || offsets[0] == offsets[1] {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("неверное окно регламента %q. формат: ЧЧ:ММ-ЧЧ:ММ (22:00-06:00)", s),
+			Caller: "Watch::parseWindow",
+		}
+	}
+	return &watchWindow{from: offsets[0], to: offsets[1]}, nil
+}
+
+// contains проверяет, входит ли время t в окно регламента
+func (w *watchWindow) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.from < w.to {
+		return d >= w.from && d < w.to
+	}
+	return d >= w.from || d < w.to
+}
+
+// String возвращает описание окна регламента
+func (w *watchWindow) String() string {
+	if w == nil {
+		return "не ограничено"
+	}
+	hm := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return hm(w.from) + "-" + hm(w.to)
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWatchWindow(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantNil  bool
+		wantErr  bool
+		from, to time.Duration
+	}{
+		{in: "", wantNil: true},
+		{in: "22:00-06:00", from: 22 * time.Hour, to: 6 * time.Hour},
+		{in: "01:30-05:45", from: time.Hour + 30*time.Minute, to: 5*time.Hour + 45*time.Minute},
+		{in: " 09:00 - 18:00 ", from: 9 * time.Hour, to: 18 * time.Hour},
+		{in: "22:00", wantErr: true},
+		{in: "22:00-06:00-08:00", wantErr: true},
+		{in: "25:00-06:00", wantErr: true},
+		{in: "10:00-10:00", wantErr: true},
+		{in: "ночь", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			w, err := parseWatchWindow(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ошибка %v, ожидается ошибка: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (w == nil) != tt.wantNil {
+				t.Fatalf("окно %v, ожидается без ограничений: %v", w, tt.wantNil)
+			}
+			if w != nil && (w.from != tt.from || w.to != tt.to) {
+				t.Errorf("окно %v, ожидается %v-%v", w, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestWatchWindowContains(t *testing.T) {
+	at := func(h, m, s int) time.Time {
+		return time.Date(2026, 1, 1, h, m, s, 0, time.Local)
+	}
+	tests := []struct {
+		name   string
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"без ограничений", "", at(12, 0, 0), true},
+		{"внутри дневного окна", "09:00-18:00", at(12, 0, 0), true},
+		{"начало окна включается", "09:00-18:00", at(9, 0, 0), true},
+		{"конец окна не включается", "09:00-18:00", at(18, 0, 0), false},
+		{"до дневного окна", "09:00-18:00", at(8, 59, 59), false},
+		{"ночное окно вечером", "22:00-06:00", at(23, 30, 0), true},
+		{"ночное окно утром", "22:00-06:00", at(5, 59, 59), true},
+		{"вне ночного окна", "22:00-06:00", at(12, 0, 0), false},
+		{"конец ночного окна", "22:00-06:00", at(6, 0, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseWatchWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(tt.t); got != tt.want {
+				t.Errorf("окно %v, время %s: %v, ожидается %v", w, tt.t.Format("15:04:05"), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// разностные файлы индекса
+const (
+	// DefaultDeltas количество предыдущих выгрузок, от которых формируются разностные файлы
+	DefaultDeltas = 5
+	// DeltaDir каталог выгрузок и разностных файлов индекса в репозитории
+	DeltaDir = ".delta"
+	// DeltaManifest перечень разностных файлов
+	DeltaManifest = "deltas.json"
+	// DeltaManifestSig подпись перечня разностных файлов ключом подписи индекс-файла
+	DeltaManifestSig = DeltaManifest + ".sig"
+
+	deltaGenPrefix = "index-" // выгрузка индекс-файла: index-<stamp>.gz
+	deltaPrefix    = "delta-" // разностный файл: delta-<from>-<to>.gz
+)
+
+// indexDelta разностный файл: изменения индекс-файла между выгрузками from и to
+type indexDelta struct {
+	Meta    map[string]string     `json:"meta"`    // from, to, version, hash
+	Added   packages              `json:"added"`   // новые пакеты: полные данные
+	Changed map[string]*packDelta `json:"changed"` // измененные пакеты
+	Removed []string              `json:"removed"` // удаленные пакеты
+}
+
+// packDelta изменения пакета: данные пакета, новые и измененные файлы (files) и удаленные файлы
+type packDelta struct {
+	HashedPackData
+	RemovedFiles []string `json:"removed_files"`
+}
+
+// DeltaInfo данные разностного файла в перечне
+type DeltaInfo struct {
+	From string `json:"from"` // метка времени выгрузки, от которой сформирован файл
+	File string `json:"file"` // имя файла в каталоге DeltaDir
+	Size int64  `json:"size"` // размер файла
+	Hash string `json:"hash"` // контрольная сумма файла
+}
+
+// DeltaList перечень разностных файлов к текущему индекс-файлу
+type DeltaList struct {
+	Stamp  string      `json:"stamp"`         // метка времени выгрузки текущего индекс-файла
+	Hash   string      `json:"hash"`          // алгоритм контрольных сумм
+	Key    string      `json:"key,omitempty"` // отпечаток ключа подписи перечня
+	Deltas []DeltaInfo `json:"deltas"`        // разностные файлы от предыдущих выгрузок
+}
+
+// SetDeltas устанавливает количество предыдущих выгрузок, от которых формируются
+// разностные файлы индекса; 0 - разностные файлы не формируются
+func (r *Repo) SetDeltas(n int) {
+	if n >= 0 {
+		r.deltas = n
+	}
+}
+
+// updateDeltas сохраняет опубликованный индекс-файл в каталоге выгрузок и формирует разностные
+// файлы от каждой из последних r.deltas выгрузок к опубликованной, а также их перечень.
+// Выгрузки с меткой времени позже опубликованной (после восстановления предыдущей версии)
+// и старше хранимых удаляются. Разностные файлы формируются только для индекс-файла формата 2;
+// разностный файл не формируется, если его размер не меньше размера индекс-файла.
+// Перечень подписывается ключом подписи индекс-файла при его наличии: контрольные суммы разностных
+// файлов в подписанном перечне заверяют и сами разностные файлы
+func (r *Repo) updateDeltas() error {
+	dir := filepath.Join(r.path, DeltaDir)
+	if r.deltas == 0 {
+		return os.RemoveAll(dir)
+	}
+	fpIndex := filepath.Join(r.path, IndexGZ)
+	cur, err := readIndexData(fpIndex)
+	if err != nil {
+		return err
+	}
+	if cur.Meta["version"] == IndexFormatV1 {
+		// клиенты прежних версий не используют разностные файлы
+		for _, name := range []string{DeltaManifest, DeltaManifestSig} {
+			if err = os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return removeDeltaFiles(dir, nil)
+	}
+	stamp := cur.Meta["stamp"]
+	if _, err = strconv.ParseInt(stamp, 10, 64); err != nil {
+		return fmt.Errorf("неверная метка времени выгрузки %q", stamp)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// выгрузка в пределах одной секунды заменяет сохраненную
+	fpGen := filepath.Join(dir, deltaGenPrefix+stamp+".gz")
+	_ = os.Remove(fpGen)
+	if err = linkFile(fpIndex, fpGen); err != nil {
+		return err
+	}
+
+	// предыдущие выгрузки: последние r.deltas
+	var prev []string
+	for _, s := range deltaGenerations(dir) {
+		switch {
+		case s == stamp:
+		case stampLess(stamp, s):
+			_ = os.Remove(filepath.Join(dir, deltaGenPrefix+s+".gz"))
+		default:
+			prev = append(prev, s)
+		}
+	}
+	if len(prev) > r.deltas {
+		for _, s := range prev[:len(prev)-r.deltas] {
+			_ = os.Remove(filepath.Join(dir, deltaGenPrefix+s+".gz"))
+		}
+		prev = prev[len(prev)-r.deltas:]
+	}
+
+	fi, err := os.Stat(fpIndex)
+	if err != nil {
+		return err
+	}
+	key, err := signingKey(r.keyFile)
+	if err != nil {
+		return err
+	}
+	algo := r.hashAlgo()
+	list := DeltaList{Stamp: stamp, Hash: algo.name, Deltas: []DeltaInfo{}}
+	if key != nil {
+		list.Key = keyFingerprint(key.Public().(ed25519.PublicKey))
+	}
+	keep := map[string]bool{}
+	for i := len(prev) - 1; i >= 0; i-- {
+		from, err := readIndexData(filepath.Join(dir, deltaGenPrefix+prev[i]+".gz"))
+		if err != nil || from.Meta["version"] == IndexFormatV1 {
+			continue
+		}
+		name := deltaPrefix + prev[i] + "-" + stamp + ".gz"
+		jsonData, _ := json.MarshalIndent(newIndexDelta(from, cur), "", "    ")
+		fp := filepath.Join(dir, name)
+		if err = writeGzip(jsonData, fp); err != nil {
+			return err
+		}
+		dfi, err := os.Stat(fp)
+		if err != nil {
+			return err
+		}
+		if dfi.Size() >= fi.Size() {
+			_ = os.Remove(fp)
+			continue
+		}
+		hash, err := hashSumFile(algo, fp)
+		if err != nil {
+			return err
+		}
+		keep[name] = true
+		list.Deltas = append(list.Deltas, DeltaInfo{From: prev[i], File: name, Size: dfi.Size(), Hash: hash})
+	}
+
+	// перечень заменяется после записи разностных файлов, подпись - после перечня
+	jsonData, _ := json.MarshalIndent(list, "", "    ")
+	fpList := filepath.Join(dir, DeltaManifest)
+	fpSig := filepath.Join(dir, DeltaManifestSig)
+	if err = writeFileSync(fpList+suffixTmp, jsonData); err != nil {
+		return err
+	}
+	if key != nil {
+		if err = writeFileSync(fpSig+suffixTmp, signData(key, jsonData)); err != nil {
+			_ = os.Remove(fpList + suffixTmp)
+			return err
+		}
+	}
+	if err = os.Rename(fpList+suffixTmp, fpList); err != nil {
+		return err
+	}
+	if key != nil {
+		err = os.Rename(fpSig+suffixTmp, fpSig)
+	} else {
+		// подпись прежнего перечня не соответствует новому
+		err = os.Remove(fpSig)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeDeltaFiles(dir, keep)
+}
+
+// newIndexDelta возвращает изменения индекс-файла cur относительно индекс-файла from
+func newIndexDelta(from, cur *indexData) *indexDelta {
+	d := &indexDelta{
+		Meta: map[string]string{
+			"from":    from.Meta["stamp"],
+			"to":      cur.Meta["stamp"],
+			"version": cur.Meta["version"],
+			"hash":    cur.Meta["hash"],
+		},
+		Added:   packages{},
+		Changed: map[string]*packDelta{},
+		Removed: []string{},
+	}
+	for name, pack := range cur.Packs {
+		old, ok := from.Packs[name]
+		if !ok {
+			d.Added[name] = pack
+			continue
+		}
+		packOld, _ := json.Marshal(old)
+		packCur, _ := json.Marshal(pack)
+		if bytes.Equal(packOld, packCur) {
+			continue
+		}
+		pd := &packDelta{HashedPackData: pack, RemovedFiles: []string{}}
+		pd.Files = map[string]*IndexFile{}
+		for fp, f := range pack.Files {
+			if o, ok := old.Files[fp]; !ok || *o != *f {
+				pd.Files[fp] = f
+			}
+		}
+		for fp := range old.Files {
+			if _, ok := pack.Files[fp]; !ok {
+				pd.RemovedFiles = append(pd.RemovedFiles, fp)
+			}
+		}
+		sort.Strings(pd.RemovedFiles)
+		d.Changed[name] = pd
+	}
+	for name := range from.Packs {
+		if _, ok := cur.Packs[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Removed)
+	return d
+}
+
+// deltaGenerations возвращает упорядоченный список меток времени сохраненных выгрузок
+func deltaGenerations(dir string) []string {
+	var stamps []string
+	list, _ := filepath.Glob(filepath.Join(dir, deltaGenPrefix+"*.gz"))
+	for _, fp := range list {
+		s := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fp), deltaGenPrefix), ".gz")
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			stamps = append(stamps, s)
+		}
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stampLess(stamps[i], stamps[j]) })
+	return stamps
+}
+
+// stampLess сравнивает метки времени выгрузки
+func stampLess(a, b string) bool {
+	x, _ := strconv.ParseInt(a, 10, 64)
+	y, _ := strconv.ParseInt(b, 10, 64)
+	return x < y
+}
+
+// removeDeltaFiles удаляет разностные файлы, кроме указанных в keep
+func removeDeltaFiles(dir string, keep map[string]bool) error {
+	list, _ := filepath.Glob(filepath.Join(dir, deltaPrefix+"*.gz"))
+	for _, fp := range list {
+		if !keep[filepath.Base(fp)] {
+			if err := os.Remove(fp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readIndexData читает и распаковывает данные индекс-файла
+func readIndexData(fp string) (*indexData, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	index := new(indexData)
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err == nil {
+		err = json.NewDecoder(zr).Decode(index)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// removeDeltas удаляет каталог выгрузок и разностных файлов индекса: после замены индекс-файла
+// в обход выгрузки разностные файлы и перечень не соответствуют ему до следующей выгрузки
+func removeDeltas(repoPath string) error {
+	return os.RemoveAll(filepath.Join(repoPath, DeltaDir))
+}
+
+// publishDeltas обновляет разностные файлы индекса после публикации индекс-файла.
+// Ошибка не отменяет публикацию: клиенты загружают индекс-файл полностью
+func (r *Repo) publishDeltas() {
+	if err := r.updateDeltas(); err != nil {
+		fmt.Printf("! ошибка формирования разностных файлов индекса: %v\n", err)
+	}
+}
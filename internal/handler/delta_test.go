@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNewIndexDelta(t *testing.T) {
+	file := func(hash string) *IndexFile {
+		return &IndexFile{Hash: hash, Size: 1, MTime: 1792307277, Mode: 0644}
+	}
+	pack := func(hash string, files map[string]*IndexFile) HashedPackData {
+		return HashedPackData{Hash: hash, Files: files}
+	}
+	index := func(stamp string, packs packages) *indexData {
+		return &indexData{Packs: packs, Meta: map[string]string{"stamp": stamp, "version": IndexFormatV2, "hash": HashSHA256}}
+	}
+
+	tests := []struct {
+		name         string
+		from, cur    packages
+		added        []string
+		removed      []string
+		changed      map[string][]string // пакет - новые и измененные файлы
+		removedFiles map[string][]string
+	}{
+		{
+			name:    "без изменений",
+			from:    packages{"A": pack("a1", map[string]*IndexFile{"f": file("1")})},
+			cur:     packages{"A": pack("a1", map[string]*IndexFile{"f": file("1")})},
+			removed: []string{},
+		},
+		{
+			name:    "новый и удаленный пакеты",
+			from:    packages{"A": pack("a1", map[string]*IndexFile{"f": file("1")})},
+			cur:     packages{"B": pack("b1", map[string]*IndexFile{"f": file("1")})},
+			added:   []string{"B"},
+			removed: []string{"A"},
+		},
+		{
+			name: "изменения файлов пакета",
+			from: packages{"A": pack("a1", map[string]*IndexFile{
+				"same": file("1"), "upd": file("1"), "del": file("1"),
+			})},
+			cur: packages{"A": pack("a2", map[string]*IndexFile{
+				"same": file("1"), "upd": file("2"), "new": file("1"),
+			})},
+			removed:      []string{},
+			changed:      map[string][]string{"A": {"new", "upd"}},
+			removedFiles: map[string][]string{"A": {"del"}},
+		},
+		{
+			name:         "изменены только данные пакета",
+			from:         packages{"A": {Hash: "a1", Alias: "old", Files: map[string]*IndexFile{"f": file("1")}}},
+			cur:          packages{"A": {Hash: "a1", Alias: "new", Files: map[string]*IndexFile{"f": file("1")}}},
+			removed:      []string{},
+			changed:      map[string][]string{"A": nil},
+			removedFiles: map[string][]string{"A": nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newIndexDelta(index("1", tt.from), index("2", tt.cur))
+			if d.Meta["from"] != "1" || d.Meta["to"] != "2" || d.Meta["version"] != IndexFormatV2 {
+				t.Errorf("meta %v", d.Meta)
+			}
+			var added []string
+			for name := range d.Added {
+				added = append(added, name)
+			}
+			if !reflect.DeepEqual(added, tt.added) {
+				t.Errorf("новые пакеты %v, ожидается %v", added, tt.added)
+			}
+			if !reflect.DeepEqual(d.Removed, tt.removed) {
+				t.Errorf("удаленные пакеты %v, ожидается %v", d.Removed, tt.removed)
+			}
+			if len(d.Changed) != len(tt.changed) {
+				t.Fatalf("измененных пакетов %d, ожидается %d", len(d.Changed), len(tt.changed))
+			}
+			for name, want := range tt.changed {
+				pd, ok := d.Changed[name]
+				if !ok {
+					t.Fatalf("пакет %s не изменен", name)
+				}
+				files := sortedFileKeys(pd.Files)
+				if len(files) != 0 || len(want) != 0 {
+					if !reflect.DeepEqual(files, want) {
+						t.Errorf("пакет %s: файлы %v, ожидается %v", name, files, want)
+					}
+				}
+				if len(pd.RemovedFiles) != 0 || len(tt.removedFiles[name]) != 0 {
+					if !reflect.DeepEqual(pd.RemovedFiles, tt.removedFiles[name]) {
+						t.Errorf("пакет %s: удаленные файлы %v, ожидается %v", name, pd.RemovedFiles, tt.removedFiles[name])
+					}
+				}
+				if pd.Hash != tt.cur[name].Hash || pd.Alias != tt.cur[name].Alias {
+					t.Errorf("пакет %s: данные пакета %+v, ожидается %+v", name, pd.HashedPackData, tt.cur[name])
+				}
+			}
+		})
+	}
+}
+
+// sortedFileKeys возвращает упорядоченный список путей файлов
+func sortedFileKeys(files map[string]*IndexFile) []string {
+	var keys []string
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+)
+
+// алгоритмы подсчета контрольных сумм
+const (
+	// HashSHA1 алгоритм SHA-1, используется в репозиториях, созданных до версии БД 1.7
+	HashSHA1 = "sha1"
+	// HashSHA256 алгоритм SHA-256, используется по-умолчанию
+	HashSHA256 = "sha256"
+	// HashBLAKE2b алгоритм BLAKE2b-256
+	HashBLAKE2b = "blake2b"
+	// HashBLAKE2s алгоритм BLAKE2s-256
+	HashBLAKE2s = "blake2s"
+	// DefaultHashAlgo алгоритм для новых репозиториев
+	DefaultHashAlgo = HashSHA256
+)
+
+// hashAlgo алгоритм подсчета контрольных сумм
+type hashAlgo struct {
+	name string           // наименование алгоритма, хранится в БД и в индекс-файле
+	new  func() hash.Hash // конструктор хэш-функции
+}
+
+// hashAlgos зарегистрированные алгоритмы подсчета контрольных сумм
+var hashAlgos = map[string]*hashAlgo{
+	HashSHA1:    {name: HashSHA1, new: sha1.New},
+	HashSHA256:  {name: HashSHA256, new: sha256.New},
+	HashBLAKE2b: {name: HashBLAKE2b, new: mustHash(blake2b.New256)},
+	HashBLAKE2s: {name: HashBLAKE2s, new: mustHash(blake2s.New256)},
+}
+
+// mustHash приводит конструктор хэш-функции с ключом к конструктору без ключа
+func mustHash(fn func(key []byte) (hash.Hash, error)) func() hash.Hash {
+	return func() hash.Hash {
+		h, err := fn(nil)
+		if err != nil {
+			panic(err)
+		}
+		return h
+	}
+}
+
+// hashAlgoByName возвращает алгоритм подсчета контрольных сумм по наименованию
+func hashAlgoByName(name string) (*hashAlgo, error) {
+	algo, ok := hashAlgos[strings.ToLower(name)]
+	if !ok {
+		return nil, &InternalError{
+			Text: fmt.Sprintf("неизвестный алгоритм контрольной суммы %q. укажите один из [ %s ]",
+				name, strings.Join(HashAlgoNames(), " | ")),
+			Caller: "hashAlgoByName",
+		}
+	}
+	return algo, nil
+}
+
+// HashAlgoNames возвращает список наименований поддерживаемых алгоритмов
+func HashAlgoNames() []string {
+	names := make([]string, 0, len(hashAlgos))
+	for name := range hashAlgos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hashSum возвращает строку контрольной суммы переданной строки
+func hashSum(algo *hashAlgo, sd string) string {
+	r := strings.NewReader(sd)
+	h := algo.new()
+	_, _ = io.Copy(h, r)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// hashSumFile вычисляет контрольную сумму файла по указанному алгоритму
+func hashSumFile(algo *hashAlgo, fp string) (string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", &InternalError{
+			Text:   fmt.Sprintf("ошибка подсчета контрольной суммы файла %s", fp),
+			Caller: "HashSumFile",
+			Err:    err,
+		}
+	}
+	defer f.Close()
+	h := algo.new()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", &InternalError{
+			Text:   fmt.Sprintf("ошибка подсчета контрольной суммы файла %s", fp),
+			Caller: "HashSumFile",
+			Err:    err,
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashFileName возвращает имя файла с контрольной суммой индекс-файла для алгоритма
+func hashFileName(algo *hashAlgo) string {
+	return IndexGZ + "." + algo.name
+}
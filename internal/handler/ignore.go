@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fnIgnore имя файла с правилами исключения в корневой папке пакета
+const fnIgnore = ".indexignore"
+
+// ignoreRule правило исключения файлов пакета при индексации
+// в формате шаблонов .gitignore
+type ignoreRule struct {
+	segments []string // шаблон, разделенный на части пути
+	negate   bool     // '!шаблон' - отмена исключения
+	dirOnly  bool     // 'шаблон/' - правило применяется только к папкам
+	anchored bool     // шаблон содержит '/' - сопоставляется с путем от корня пакета
+}
+
+// ignoreList набор правил исключения; при совпадении нескольких правил
+// действует последнее
+type ignoreList []ignoreRule
+
+// validIgnorePattern проверяет синтаксис шаблона исключения
+func validIgnorePattern(pattern string) error {
+	p := strings.TrimPrefix(strings.TrimSpace(pattern), "!")
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return fmt.Errorf("пустой шаблон %q", pattern)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("неверный шаблон %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// parseIgnoreRules разбирает строки с шаблонами исключения;
+// пустые строки и строки, начинающиеся с '#', пропускаются
+func parseIgnoreRules(lines []string) ignoreList {
+	var rules ignoreList
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || validIgnorePattern(line) != nil {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		rule.segments = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// readIgnoreFile читает правила исключения из файла; отсутствие файла не является ошибкой
+func readIgnoreFile(fp string) ([]string, error) {
+	f, err := os.Open(fp)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения файла %s", fp),
+			Caller: "readIgnoreFile",
+			Err:    err,
+		}
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения файла %s", fp),
+			Caller: "readIgnoreFile::Scan",
+			Err:    err,
+		}
+	}
+	return lines, nil
+}
+
+// match проверяет, исключается ли файл или папка с путем rel относительно корня пакета
+func (l ignoreList) match(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+	if !isDir && rel == fnIgnore {
+		return true
+	}
+	name := strings.Split(rel, "/")
+	ignored := false
+	for _, rule := range l {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		var ok bool
+		if rule.anchored {
+			ok = matchSegments(rule.segments, name)
+		} else {
+			ok = matchSegments(rule.segments, name[len(name)-1:])
+		}
+		if ok {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// excluded проверяет, исключается ли файл с путем rel самим правилом
+// или в составе исключенной папки
+func (l ignoreList) excluded(rel string) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i < len(parts); i++ {
+		if l.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return l.match(rel, false)
+}
+
+// matchSegments сопоставляет части пути с частями шаблона;
+// '**' соответствует любому количеству папок
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"testing"
+)
+
+func TestIgnoreListMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		rel      string
+		isDir    bool
+		want     bool
+	}{
+		{"без правил", nil, "a.txt", false, false},
+		{"файл правил исключается", nil, fnIgnore, false, true},
+		{"файл правил во вложенной папке", nil, "sub/" + fnIgnore, false, false},
+		{"шаблон имени", []string{"*.bak"}, "a.bak", false, true},
+		{"шаблон имени во вложенной папке", []string{"*.bak"}, "sub/dir/a.bak", false, true},
+		{"шаблон имени не совпадает", []string{"*.bak"}, "a.txt", false, false},
+		{"класс символов", []string{"[Tt]humbs.db"}, "img/thumbs.db", false, true},
+		{"шаблон с префиксом", []string{"~*"}, "~$doc.docx", false, true},
+		{"отмена исключения", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"последнее правило действует", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"только папки: папка", []string{"tmp/"}, "tmp", true, true},
+		{"только папки: файл", []string{"tmp/"}, "tmp", false, false},
+		{"путь от корня", []string{"/build"}, "build", true, true},
+		{"путь от корня во вложенной папке", []string{"/build"}, "src/build", true, false},
+		{"путь с папкой", []string{"docs/*.pdf"}, "docs/a.pdf", false, true},
+		{"путь с папкой не от корня", []string{"docs/*.pdf"}, "x/docs/a.pdf", false, false},
+		{"комментарий", []string{"# *.txt"}, "a.txt", false, false},
+		{"неверный шаблон пропускается", []string{"[", "*.txt"}, "a.txt", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseIgnoreRules(tt.patterns).match(tt.rel, tt.isDir); got != tt.want {
+				t.Errorf("match(%q, %v) с правилами %q = %v, ожидается %v", tt.rel, tt.isDir, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
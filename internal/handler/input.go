@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInputRequired операция требует ввода оператора, недоступного в неинтерактивном режиме
+var ErrInputRequired = errors.New("требуется ввод оператора")
+
+// правила выбора исполняемого файла при нескольких найденных в пакете
+const (
+	ExecRuleAsk      = "ask"      // запрос оператору; в неинтерактивном режиме - ошибка
+	ExecRuleFirst    = "first"    // первый по алфавиту путь
+	ExecRuleShortest = "shortest" // ближайший к корню пакета, затем самый короткий путь
+	ExecRulePack     = "pack"     // файл с именем пакета; при отсутствии - ошибка
+	ExecRuleError    = "error"    // ошибка
+)
+
+var (
+	inputAccept = false       // подтверждать операции без запроса
+	inputNone   = false       // не читать stdin
+	execRule    = ExecRuleAsk // правило выбора исполняемого файла
+)
+
+// SetInputPolicy устанавливает политику неинтерактивного режима:
+// yes - подтверждение операций без запроса; noInput - запрет чтения stdin,
+// запросы подтверждения отклоняются, если не указан yes
+func SetInputPolicy(yes, noInput bool) {
+	inputAccept = yes
+	inputNone = noInput
+}
+
+// InputDisabled проверяет запрет чтения stdin
+func InputDisabled() bool {
+	return inputNone
+}
+
+// SetExecRule устанавливает правило выбора исполняемого файла
+func SetExecRule(rule string) error {
+	switch rule {
+	case "":
+		execRule = ExecRuleAsk
+	case ExecRuleAsk, ExecRuleFirst, ExecRuleShortest, ExecRulePack, ExecRuleError:
+		execRule = rule
+	default:
+		return &InternalError{
+			Text: fmt.Sprintf("неверное правило выбора исполняемого файла %q. укажите одно из [ %s ]",
+				rule, strings.Join(ExecRuleNames(), " | ")),
+			Caller: "SetExecRule",
+		}
+	}
+	return nil
+}
+
+// ExecRuleNames возвращает список правил выбора исполняемого файла
+func ExecRuleNames() []string {
+	return []string{ExecRuleAsk, ExecRuleFirst, ExecRuleShortest, ExecRulePack, ExecRuleError}
+}
+
+// userAccept проверяет ответ пользователя. При установленной политике неинтерактивного
+// режима ответ не запрашивается; при закрытом stdin операция отклоняется
+func userAccept(msg string) bool {
+	switch {
+	case inputAccept:
+		fmt.Println(msg + ". Продолжить? (y/N): y (-yes)")
+		return true
+	case inputNone:
+		fmt.Println(msg + ". Продолжить? (y/N): N (-no-input)")
+		return false
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for i := 0; i < 3; i++ {
+		fmt.Print(msg + ". Продолжить? (y/N): ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return false
+		}
+		txt := scanner.Text()
+		if len(txt) == 0 {
+			return false
+		} else if txt[0] == 'n' || txt[0] == 'N' {
+			return false
+		} else if txt[0] == 'y' || txt[0] == 'Y' {
+			return true
+		} else {
+			continue
+		}
+	}
+	return false
+}
+
+// selectExecFileByUser запрашивает у оператора выбор исполняемого файла из списка.
+// При закрытом stdin возвращает ErrInputRequired
+func selectExecFileByUser(fList []string) (string, error) {
+	scanner := bufio.NewScanner(os.Stdin)
+	count := len(fList)
+	for {
+		fmt.Printf("введите число от 1 до %d:\n", count)
+		for i := 0; i < count; i++ {
+			fmt.Printf("\t[%d]: '%v'\n", i+1, fList[i])
+		}
+		if !scanner.Scan() {
+			return "", ErrInputRequired
+		}
+		choice := scanner.Text()
+		choiceInt, err := strconv.Atoi(choice)
+		if err == nil && choiceInt > 0 && choiceInt <= count {
+			return fList[choiceInt-1], nil
+		}
+	}
+}
+
+// resolveExecFile выбирает исполняемый файл пакета из нескольких найденных по установленному правилу
+func resolveExecFile(pack string, fList []string) (string, error) {
+	list := append([]string{}, fList...)
+	sort.Strings(list)
+
+	var execFile string
+	switch execRule {
+	case ExecRuleFirst:
+		execFile = list[0]
+	case ExecRuleShortest:
+		sort.SliceStable(list, func(i, j int) bool {
+			di := strings.Count(filepath.ToSlash(list[i]), "/")
+			dj := strings.Count(filepath.ToSlash(list[j]), "/")
+			if di != dj {
+				return di < dj
+			}
+			return len(list[i]) < len(list[j])
+		})
+		execFile = list[0]
+	case ExecRulePack:
+		for _, fp := range list {
+			name := strings.TrimSuffix(filepath.Base(fp), filepath.Ext(fp))
+			if strings.EqualFold(name, pack) {
+				execFile = fp
+				break
+			}
+		}
+	case ExecRuleAsk:
+		if !inputNone {
+			fmt.Printf("Выберите исполняемый файл для пакета '%v'\n", pack)
+			fp, err := selectExecFileByUser(list)
+			if err == nil {
+				return fp, nil
+			}
+		}
+	}
+	if execFile == "" {
+		return "", &InternalError{
+			Text: fmt.Sprintf("для пакета '%s' найдено несколько исполняемых файлов: %s. "+
+				"укажите правило выбора флагом -exec-rule или выполните 'exec set %s' в интерактивном режиме",
+				pack, strings.Join(list, ", "), pack),
+			Caller: "resolveExecFile",
+			Err:    ErrInputRequired,
+		}
+	}
+	return execFile, nil
+}
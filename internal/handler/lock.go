@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReglamentLock данные блокировки репозитория в режиме регламента (файл __REGLAMENT__)
+type ReglamentLock struct {
+	Host     string     `json:"host"`               // имя компьютера инициатора работ
+	User     string     `json:"user"`               // пользователь ОС
+	PID      int        `json:"pid"`                // ID процесса, установившего блокировку
+	Started  time.Time  `json:"started"`            // время установки блокировки
+	Reason   string     `json:"reason,omitempty"`   // причина (описание работ)
+	Duration string     `json:"duration,omitempty"` // ожидаемая продолжительность работ
+	Expires  *time.Time `json:"expires,omitempty"`  // время, после которого блокировка считается просроченной
+	Stale    bool       `json:"stale,omitempty"`    // блокировка просрочена (не сохраняется в файле)
+	Legacy   string     `json:"legacy,omitempty"`   // содержимое файла блокировки прежнего формата
+}
+
+// newReglamentLock возвращает данные блокировки текущего пользователя.
+// ttl - ожидаемая продолжительность работ; 0 - без ограничения
+func newReglamentLock(reason string, ttl time.Duration) *ReglamentLock {
+	host, user := currentOwner()
+	lock := &ReglamentLock{
+		Host:    host,
+		User:    user,
+		PID:     os.Getpid(),
+		Started: time.Now().Truncate(time.Second),
+		Reason:  reason,
+	}
+	if ttl > 0 {
+		expires := lock.Started.Add(ttl)
+		lock.Duration = ttl.String()
+		lock.Expires = &expires
+	}
+	return lock
+}
+
+// currentOwner возвращает имя компьютера и пользователя ОС текущего процесса
+func currentOwner() (host, name string) {
+	host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	} else if name = os.Getenv("USER"); name == "" {
+		name = os.Getenv("USERNAME")
+	}
+	return host, name
+}
+
+// readReglamentLock читает данные блокировки репозитория. Если режим регламента
+// не установлен, возвращает nil. Файл прежнего формата (текст без структуры) читается
+// как блокировка без владельца
+func readReglamentLock(repoPath string) (*ReglamentLock, error) {
+	data, err := ioutil.ReadFile(filepath.Join(repoPath, fnReglament))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка чтения файла режима регламента",
+			Caller: "Reglament::readLock",
+			Err:    err,
+		}
+	}
+	lock := new(ReglamentLock)
+	if err = json.Unmarshal(data, lock); err != nil || lock.Started.IsZero() {
+		lock = &ReglamentLock{Legacy: strings.TrimSpace(string(data))}
+	}
+	lock.Stale = lock.Expires != nil && time.Now().After(*lock.Expires)
+	return lock, nil
+}
+
+// writeReglamentLock записывает данные блокировки; если файл блокировки уже существует,
+// возвращает ошибку, чтобы не перезаписать блокировку, установленную другим процессом
+func writeReglamentLock(repoPath string, lock *ReglamentLock) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка установки режима регламента",
+			Caller: "Reglament::writeLock::marshal",
+			Err:    err,
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(repoPath, fnReglament), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка установки режима регламента",
+			Caller: "Reglament::writeLock",
+			Err:    err,
+		}
+	}
+	if _, err = f.Write(append(data, '\n')); err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка установки режима регламента",
+			Caller: "Reglament::writeLock::write",
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// foreign проверяет, установлена ли блокировка другим пользователем или на другом компьютере.
+// Владелец блокировки прежнего формата не известен
+func (l *ReglamentLock) foreign() bool {
+	if l.Legacy != "" {
+		return false
+	}
+	host, user := currentOwner()
+	return !strings.EqualFold(l.Host, host) || l.User != user
+}
+
+// owner возвращает описание инициатора работ
+func (l *ReglamentLock) owner() string {
+	if l.Legacy != "" {
+		return l.Legacy
+	}
+	return fmt.Sprintf("%s@%s (PID %d)", l.User, l.Host, l.PID)
+}
+
+// print выводит данные блокировки
+func (l *ReglamentLock) print() {
+	const timeLayout = "2006-01-02 15:04:05"
+	template := "  %-20s%v\n"
+	if l.Legacy != "" {
+		fmt.Printf(template, "Установлен:", l.Legacy)
+		return
+	}
+	fmt.Printf(template, "Установлен:", l.owner())
+	fmt.Printf(template, "Начало работ:", l.Started.Local().Format(timeLayout))
+	if l.Reason != "" {
+		fmt.Printf(template, "Причина:", l.Reason)
+	}
+	if l.Expires != nil {
+		fmt.Printf(template, "Продолжительность:", fmt.Sprintf("%s (до %s)", l.Duration, l.Expires.Local().Format(timeLayout)))
+	}
+	if l.Stale {
+		fmt.Println("  ! срок блокировки истек: возможно, работы прерваны без снятия режима регламента")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 
@@ -24,6 +25,8 @@ func NewRepo(path string) (*Repo, error) {
 	}
 	repo := new(Repo)
 	repo.path = path
+	repo.workers = runtime.NumCPU()
+	repo.deltas = DefaultDeltas
 	return repo, nil
 }
 
@@ -32,6 +35,25 @@ func (r *Repo) Path() string {
 	return r.path
 }
 
+// SetWorkers устанавливает количество обработчиков для параллельного
+// подсчета контрольных сумм файлов при индексации
+func (r *Repo) SetWorkers(n int) {
+	if n > 0 {
+		r.workers = n
+	}
+}
+
+// SetKeyFile устанавливает путь к файлу закрытого ключа подписи индекс-файла
+func (r *Repo) SetKeyFile(fp string) {
+	r.keyFile = fp
+}
+
+// SetAllowUnsigned разрешает выгрузку неподписанного индекс-файла при отсутствии ключа подписи,
+// если опубликованный индекс-файл подписан
+func (r *Repo) SetAllowUnsigned(allow bool) {
+	r.unsigned = allow
+}
+
 // OpenDB открывает подключение к БД
 func (r *Repo) OpenDB() error {
 	fp := pathDB(r.path)
@@ -46,18 +68,7 @@ func (r *Repo) OpenDB() error {
 		return err
 	}
 	r.db = db
-	if err = r.checkDB(); err != nil {
-		return err
-	}
-	// инициализация поддержки первичных ключей в БД
-	if _, err := r.db.Exec("PRAGMA foreign_keys = ON;"); err != nil {
-		return &InternalError{
-			Text:   "Ошибка создания соединения с БД",
-			Caller: "Manager::OpenDB",
-			Err:    err,
-		}
-	}
-	return nil
+	return r.checkDB()
 }
 
 // Close закрывает db соединение
@@ -113,7 +124,17 @@ func (r *Repo) Clean() error {
 func (r *Repo) packageID(pack string) (int64, error) {
 	var id int64
 	// if err = r.db.QueryRow("SELECT id FROM packages WHERE name=?;", pack).Scan(&id); err == sql.ErrNoRows {
-	if err = r.db.QueryRow("SELECT id FROM packages WHERE name=?;", pack).Scan(&id); err != nil {
+	err = r.db.QueryRow("SELECT id FROM packages WHERE name=?;", pack).Scan(&id)
+	if err == sql.ErrNoRows && r.caseInsensitive() {
+		// пакет проиндексирован под именем в другом регистре
+		for _, name := range r.packages() {
+			if r.sameName(name, pack) {
+				err = r.db.QueryRow("SELECT id FROM packages WHERE name=?;", name).Scan(&id)
+				break
+			}
+		}
+	}
+	if err != nil {
 		return 0, &InternalError{
 			Text:   fmt.Sprintf("ошибка получения ID пакета %q", pack),
 			Caller: "Manager::PackageID",
@@ -124,8 +145,8 @@ func (r *Repo) packageID(pack string) (int64, error) {
 }
 
 // newPackage создает запись нового пакета и возвращает его ID
-func (r *Repo) newPackage(name string) (id int64, err error) {
-	res, err := r.db.Exec("INSERT INTO packages ('name', 'hash') VALUES (?, 0);", name)
+func (r *Repo) newPackage(db dbExecutor, name string) (id int64, err error) {
+	res, err := db.Exec("INSERT INTO packages ('name', 'hash') VALUES (?, 0);", name)
 	if err != nil {
 		return 0, &InternalError{
 			Text:   fmt.Sprintf("ошибка создания записи о пакете %q в БД", name),
@@ -139,15 +160,27 @@ func (r *Repo) newPackage(name string) (id int64, err error) {
 
 // alias возвращает псевдоним пакета при наличии
 func (r *Repo) alias(pack string) (alias string) {
-	_ = r.db.QueryRow("SELECT alias FROM aliases WHERE Name=?;", pack).Scan(&alias)
+	if err := r.db.QueryRow("SELECT alias FROM aliases WHERE Name=?;", pack).Scan(&alias); err == sql.ErrNoRows &&
+		r.caseInsensitive() {
+		for _, pair := range r.aliases() {
+			if r.sameName(pair[0], pack) {
+				return pair[1]
+			}
+		}
+	}
 	return
 }
 
 // aliases возвращает срез срезов (пар) псевдоним-пакет
 func (r *Repo) aliases() [][]string {
+	return r.queryAliases(r.db)
+}
+
+// queryAliases возвращает список пар (пакет, псевдоним), прочитанный через db
+func (r *Repo) queryAliases(db dbExecutor) [][]string {
 	var aliases [][]string
 	var alias, name string
-	rows, _ := r.db.Query("SELECT alias, Name FROM aliases ORDER BY alias;")
+	rows, _ := db.Query("SELECT alias, Name FROM aliases ORDER BY alias;")
 	defer rows.Close()
 	for rows.Next() {
 		var aliasPair []string
@@ -159,9 +192,9 @@ func (r *Repo) aliases() [][]string {
 }
 
 // setAlias устанавливает псевдоним для пакета при отсутствии уже установленного псевдонима
-// и при наличии актуального пакета
-func (r *Repo) setAlias(alias []string) error {
-	pck := strings.Trim(alias[0], "\"")
+// и при наличии актуального пакета; запросы выполняются через db
+func (r *Repo) setAlias(db dbExecutor, alias []string) error {
+	pck := r.packName(strings.Trim(alias[0], "\""))
 	als := strings.Trim(alias[1], "\"")
 	if !r.PackIsActive(pck) {
 		return &InternalError{
@@ -169,7 +202,18 @@ func (r *Repo) setAlias(alias []string) error {
 			Caller: "Manager::SetAlias",
 		}
 	}
-	if res, err := r.db.Exec("INSERT INTO aliases (name, alias) VALUES (?, ?);", pck, als); err != nil {
+	// уникальность имен в БД проверяется с учетом регистра
+	if r.caseInsensitive() {
+		for _, pair := range r.queryAliases(db) {
+			if r.sameName(pair[0], pck) {
+				return &InternalError{Text: fmt.Sprintf("Псевдоним для пакета %q уже задан", pck)}
+			}
+			if r.sameName(pair[1], als) {
+				return &InternalError{Text: fmt.Sprintf("Псевдоним %q уже задан для пакета %q", pair[1], pair[0])}
+			}
+		}
+	}
+	if res, err := db.Exec("INSERT INTO aliases (name, alias) VALUES (?, ?);", pck, als); err != nil {
 		switch err.(type) {
 		case sqlite3.Error:
 			if err.(sqlite3.Error).Code == sqlite3.ErrConstraint {
@@ -197,13 +241,25 @@ func (r *Repo) setAlias(alias []string) error {
 			Err:    err,
 		}
 	}
+	r.auditDB(db, auditAliasSet, pck, "", als)
 	fmt.Printf("Установлен псевдоним: [ %v ]=( %v )\n", pck, als)
 	return nil
 }
 
-// delAlias удалает псевдоним
-func (r *Repo) delAlias(alias string) error {
-	if res, err := r.db.Exec("DELETE FROM aliases WHERE alias=?;", strings.Trim(alias, "\"")); err != nil {
+// delAlias удалает псевдоним; запросы выполняются через db
+func (r *Repo) delAlias(db dbExecutor, alias string) error {
+	alias = strings.Trim(alias, "\"")
+	if r.caseInsensitive() {
+		for _, pair := range r.queryAliases(db) {
+			if r.sameName(pair[1], alias) {
+				alias = pair[1]
+				break
+			}
+		}
+	}
+	var pack string
+	_ = db.QueryRow("SELECT name FROM aliases WHERE alias=?;", alias).Scan(&pack)
+	if res, err := db.Exec("DELETE FROM aliases WHERE alias=?;", alias); err != nil {
 		return &InternalError{
 			Text:   "ошибка удаления псевдонима",
 			Caller: "Manager::DelAlias",
@@ -216,6 +272,7 @@ func (r *Repo) delAlias(alias string) error {
 			Err:    err,
 		}
 	}
+	r.auditDB(db, auditAliasDel, pack, alias, "")
 	fmt.Printf("Удален псевдоним: [ %v ]\n", alias)
 	return nil
 }
@@ -295,14 +352,17 @@ func (r *Repo) hashedPackages(packs chan HashedPackData) error {
 			}
 		}
 		pData.Alias = r.alias(pData.Name)
+		if pData.Manifest, err = r.packManifest(r.db, pData.ID); err != nil {
+			return err
+		}
 
 		if filesPackDB, err = r.filesPackDB(pData.ID); err != nil {
 			return err
 		}
-		files := map[string]string{}
+		files := map[string]*IndexFile{}
 
 		for _, fd := range filesPackDB {
-			files[fd.Path] = fd.Hash
+			files[fd.Path] = &IndexFile{Hash: fd.Hash, Size: fd.Size, MTime: fd.MDate / 1e9, Mode: fd.Mode}
 		}
 		pData.Files = files
 		packs <- pData
@@ -311,28 +371,126 @@ func (r *Repo) hashedPackages(packs chan HashedPackData) error {
 }
 
 // filesPackRepo возвращает список файлов указанного пакета в репозитории
-func (r *Repo) filesPackRepo(pack string) []*FileInfo {
+// за исключением файлов, попадающих под правила исключения,
+// упорядоченный по каноническому пути относительно корня пакета
+func (r *Repo) filesPackRepo(pack string) ([]*FileInfo, error) {
 	path := filepath.Join(r.path, pack)   // base Path repopath/packname
 	fInfoList := make([]*FileInfo, 0, 50) // reserve place for ~50 files
-	// unWanted, _ := regexp.Compile(`(.*[Tt]humb[s]?\.db)|(^~.*)`)
-	fInfoCh := dirWalk(path)
+	ign, err := r.ignoreRules(pack)
+	if err != nil {
+		return nil, err
+	}
+	fInfoCh, errCh := dirWalk(path, ign)
 	for fInfo := range fInfoCh {
 		fi := new(FileInfo)
 		*fi = fInfo
-
-		// if unWanted.MatchString(fp) {
-		// continue
-		// } else {
 		fInfoList = append(fInfoList, fi)
-		// }
 	}
-	sort.Slice(fInfoList, func(i, j int) bool { return fInfoList[i].Path < fInfoList[j].Path })
-	return fInfoList
+	if err = <-errCh; err != nil {
+		return nil, err
+	}
+	// порядок следования совпадает с сортировкой путей в БД
+	r.sortPaths(fInfoList, func(fi *FileInfo) string { return relPath(path, fi.Path) })
+	return fInfoList, nil
+}
+
+// ignoredFilesPackRepo возвращает список файлов пакета в репозитории,
+// исключенных из индексации, с путями относительно корня пакета
+func (r *Repo) ignoredFilesPackRepo(pack string) ([]string, error) {
+	root := filepath.Join(r.path, pack)
+	ign, err := r.ignoreRules(pack)
+	if err != nil {
+		return nil, err
+	}
+	var ignored []string
+	fInfoCh, errCh := dirWalk(root, nil)
+	for fInfo := range fInfoCh {
+		if rel := relPath(root, fInfo.Path); ign.excluded(rel) {
+			ignored = append(ignored, rel)
+		}
+	}
+	if err = <-errCh; err != nil {
+		return nil, err
+	}
+	sort.Strings(ignored)
+	return ignored, nil
+}
+
+// ignorePatterns возвращает список шаблонов исключения файлов репозитория
+func (r *Repo) ignorePatterns() []string {
+	var patterns []string
+	var pattern string
+	rows, err := r.db.Query("SELECT pattern FROM ignores ORDER BY rowid;")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		_ = rows.Scan(&pattern)
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// ignoreRules возвращает правила исключения файлов пакета:
+// шаблоны репозитория из БД и шаблоны из файла .indexignore в корне пакета
+func (r *Repo) ignoreRules(pack string) (ignoreList, error) {
+	lines, err := readIgnoreFile(filepath.Join(r.path, pack, fnIgnore))
+	if err != nil {
+		return nil, err
+	}
+	return parseIgnoreRules(append(r.ignorePatterns(), lines...)), nil
+}
+
+// addIgnore добавляет шаблон исключения файлов репозитория; запрос выполняется через db
+func (r *Repo) addIgnore(db dbExecutor, pattern string) error {
+	if err := validIgnorePattern(pattern); err != nil {
+		return &InternalError{
+			Text:   err.Error(),
+			Caller: "Manager::AddIgnore",
+		}
+	}
+	if _, err := db.Exec("INSERT INTO ignores (pattern) VALUES (?);", pattern); err != nil {
+		if e, ok := err.(sqlite3.Error); ok && e.Code == sqlite3.ErrConstraint {
+			return &InternalError{
+				Text:   fmt.Sprintf("шаблон %q уже задан", pattern),
+				Caller: "Manager::AddIgnore",
+				Err:    err,
+			}
+		}
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка добавления шаблона %q", pattern),
+			Caller: "Manager::AddIgnore",
+			Err:    err,
+		}
+	}
+	fmt.Printf("Добавлен шаблон исключения: [ %s ]\n", pattern)
+	return nil
+}
+
+// delIgnore удаляет шаблон исключения файлов репозитория; запрос выполняется через db
+func (r *Repo) delIgnore(db dbExecutor, pattern string) error {
+	res, err := db.Exec("DELETE FROM ignores WHERE pattern=?;", pattern)
+	if err != nil {
+		return &InternalError{
+			Text:   fmt.Sprintf("ошибка удаления шаблона %q", pattern),
+			Caller: "Manager::DelIgnore",
+			Err:    err,
+		}
+	}
+	if c, _ := res.RowsAffected(); c != 1 {
+		return &InternalError{
+			Text:   fmt.Sprintf("не найден шаблон %q", pattern),
+			Caller: "Manager::DelIgnore",
+		}
+	}
+	fmt.Printf("Удален шаблон исключения: [ %s ]\n", pattern)
+	return nil
 }
 
 // filesPackDB возвращает список файлов пакета имеющихся в БД
 func (r *Repo) filesPackDB(id int64) ([]*FileInfo, error) {
-	rows, err := r.db.Query("SELECT id, path, size, mdate, hash FROM files WHERE package_id=? ORDER BY path;", id)
+	rows, err := r.db.Query("SELECT id, path, size, mdate, mode, hash FROM files WHERE package_id=? ORDER BY path;", id)
 	if err != nil {
 		return nil, &InternalError{
 			Text:   "ошибка выборки файлов",
@@ -345,7 +503,7 @@ func (r *Repo) filesPackDB(id int64) ([]*FileInfo, error) {
 
 	for rows.Next() {
 		fd := new(FileInfo)
-		if err := rows.Scan(&fd.ID, &fd.Path, &fd.Size, &fd.MDate, &fd.Hash); err != nil {
+		if err := rows.Scan(&fd.ID, &fd.Path, &fd.Size, &fd.MDate, &fd.Mode, &fd.Hash); err != nil {
 			return nil, &InternalError{
 				Text:   "ошибка выборки файлов",
 				Caller: "Manager::FilesPackDB::Scan",
@@ -354,13 +512,105 @@ func (r *Repo) filesPackDB(id int64) ([]*FileInfo, error) {
 		}
 		pFileInfoList = append(pFileInfoList, fd)
 	}
+	// без учета регистра порядок следования отличается от сортировки SQLite
+	if r.caseInsensitive() {
+		r.sortPaths(pFileInfoList, func(fi *FileInfo) string { return fi.Path })
+	}
 	return pFileInfoList, nil
 }
 
+// packFileInfo возвращает имя пакета в БД и данные о файле незаблокированного пакета.
+// Без учета регистра (insensitive) при отсутствии точного совпадения имя пакета и путь файла
+// сопоставляются по ключам сравнения. Политика передается вызывающим: кэш Repo сбрасывается
+// операциями API, выполняемыми параллельно с передачей файлов. Если файл не найден, возвращает nil
+func (r *Repo) packFileInfo(pack, fp string, insensitive bool) (string, *FileInfo, error) {
+	key := func(name string) string {
+		if insensitive {
+			return strings.ToLower(name)
+		}
+		return name
+	}
+	fd := new(FileInfo)
+	err := r.db.QueryRow(`SELECT p.name, f.id, f.path, f.size, f.mdate, f.mode, f.hash
+		FROM files f JOIN packages p ON f.package_id = p.id
+		WHERE p.name=? AND f.path=?;`, pack, fp).Scan(
+		&pack, &fd.ID, &fd.Path, &fd.Size, &fd.MDate, &fd.Mode, &fd.Hash)
+	if err == sql.ErrNoRows && insensitive {
+		pack, fd, err = r.packFileInfoFold(key(pack), key(fp), key)
+	}
+	if err == sql.ErrNoRows {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, &InternalError{
+			Text:   "ошибка выборки данных файла",
+			Caller: "Manager::PackFileInfo",
+			Err:    err,
+		}
+	}
+
+	rows, err := r.db.Query("SELECT name FROM excludes;")
+	if err != nil {
+		return "", nil, &InternalError{
+			Text:   "ошибка выборки заблокированных пакетов",
+			Caller: "Manager::PackFileInfo::Excludes",
+			Err:    err,
+		}
+	}
+	defer rows.Close()
+	var name string
+	for rows.Next() {
+		if err = rows.Scan(&name); err != nil {
+			return "", nil, &InternalError{
+				Text:   "ошибка выборки заблокированных пакетов",
+				Caller: "Manager::PackFileInfo::Excludes",
+				Err:    err,
+			}
+		}
+		if key(name) == key(pack) {
+			return "", nil, nil
+		}
+	}
+	return pack, fd, rows.Err()
+}
+
+// packFileInfoFold ищет файл пакета по ключам сравнения имени пакета и пути файла.
+// Ключи вычисляются функцией key: сравнение SQLite без учета регистра ограничено символами ASCII
+func (r *Repo) packFileInfoFold(packKey, pathKey string, key func(string) string) (string, *FileInfo, error) {
+	var pack string
+	for _, name := range r.packages() {
+		if key(name) == packKey {
+			pack = name
+			break
+		}
+	}
+	if pack == "" {
+		return "", nil, sql.ErrNoRows
+	}
+	rows, err := r.db.Query(`SELECT f.id, f.path, f.size, f.mdate, f.mode, f.hash
+		FROM files f JOIN packages p ON f.package_id = p.id WHERE p.name=?;`, pack)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		fd := new(FileInfo)
+		if err = rows.Scan(&fd.ID, &fd.Path, &fd.Size, &fd.MDate, &fd.Mode, &fd.Hash); err != nil {
+			return "", nil, err
+		}
+		if key(fd.Path) == pathKey {
+			return pack, fd, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return "", nil, err
+	}
+	return "", nil, sql.ErrNoRows
+}
+
 // packIsIndexed определяет проиндексирован ли пакет
 func (r *Repo) packIsIndexed(name string) bool {
 	for _, fn := range r.packages() {
-		if name == fn {
+		if r.sameName(name, fn) {
 			return true
 		}
 	}
@@ -370,7 +620,7 @@ func (r *Repo) packIsIndexed(name string) bool {
 // packIsBlocked проверка пакета на блокировку
 func (r *Repo) packIsBlocked(name string) bool {
 	for _, fn := range r.disabledPacks() {
-		if name == fn {
+		if r.sameName(name, fn) {
 			return true
 		}
 	}
@@ -380,16 +630,34 @@ func (r *Repo) packIsBlocked(name string) bool {
 // PackIsActive проверка наличия пакета или отсутствия у пакета блокировки
 func (r *Repo) PackIsActive(pack string) bool {
 	for _, fp := range r.ActivePacks() {
-		if fp == pack {
+		if r.sameName(fp, pack) {
 			return true
 		}
 	}
 	return false
 }
 
+// beginPackTx начинает транзакцию индексации пакета с подготовленными запросами
+func (r *Repo) beginPackTx() (*packTx, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка начала транзакции",
+			Caller: "Manager::BeginPackTx",
+			Err:    err,
+		}
+	}
+	return &packTx{
+		Tx:          tx,
+		stmtAddFile: tx.Stmt(r.stmtAddFile),
+		stmtDelFile: tx.Stmt(r.stmtDelFile),
+		stmtUpdFile: tx.Stmt(r.stmtUpdFile),
+	}, nil
+}
+
 // addFileData добавляет данные файла пакета в БД при обнаружении в репозитории
-func (r *Repo) addFileData(fInfo *FileInfo) error {
-	if res, err := r.stmtAddFile.Exec(fInfo.ID, fInfo.Path, fInfo.Size, fInfo.MDate, fInfo.Hash); err != nil {
+func (r *Repo) addFileData(ptx *packTx, fInfo *FileInfo) error {
+	if res, err := ptx.stmtAddFile.Exec(fInfo.ID, fInfo.Path, fInfo.Size, fInfo.MDate, fInfo.Mode, fInfo.Hash); err != nil {
 		return &InternalError{
 			Text:   "ошибка добавления файла",
 			Caller: "Manager::AddFile::stmtAddFile",
@@ -406,8 +674,8 @@ func (r *Repo) addFileData(fInfo *FileInfo) error {
 }
 
 // updateFileData обновляет данные о файде в пакете при изменении в репозитории
-func (r *Repo) updateFileData(fd *FileInfo) error {
-	if res, err := r.stmtUpdFile.Exec(fd.Size, fd.MDate, fd.Hash, fd.ID); err != nil {
+func (r *Repo) updateFileData(ptx *packTx, fd *FileInfo) error {
+	if res, err := ptx.stmtUpdFile.Exec(fd.Path, fd.Size, fd.MDate, fd.Mode, fd.Hash, fd.ID); err != nil {
 		return &InternalError{
 			Text:   "ошибка обновления файла",
 			Caller: "Manager::UpdateFileData::stmtUpdFile",
@@ -424,8 +692,8 @@ func (r *Repo) updateFileData(fd *FileInfo) error {
 }
 
 // removeFileData удаляет данные о файле из БД при отсутствии в репозитории
-func (r *Repo) removeFileData(fInfo *FileInfo) error {
-	if res, err := r.stmtDelFile.Exec(fInfo.ID); err != nil {
+func (r *Repo) removeFileData(ptx *packTx, fInfo *FileInfo) error {
+	if res, err := ptx.stmtDelFile.Exec(fInfo.ID); err != nil {
 		return &InternalError{
 			Text:   "ошибка обновления файла",
 			Caller: "Manager::RemoveFile::stmtDelFile",
@@ -444,10 +712,7 @@ func (r *Repo) removeFileData(fInfo *FileInfo) error {
 // cleanPacks сбрасывает кэш с данными об активных, индексированных и блокированных пакетах
 // при команде об активации или блокировке
 func (r *Repo) cleanPacks() error {
-	// clean cached lists
-	r.actPacks = []string{}
-	r.disPacks = []string{}
-	r.indPacks = []string{}
+	r.resetCache()
 	for _, pack := range r.packages() { // проход по списку пакетов в БД
 		if !r.PackIsActive(pack) {
 			if err = r.removePack(pack); err != nil {
@@ -458,6 +723,16 @@ func (r *Repo) cleanPacks() error {
 	return nil
 }
 
+// resetCache сбрасывает кэшированные списки пакетов, алгоритм контрольных сумм и политику сравнения имен;
+// данные повторно читаются из БД и репозитория при следующем обращении
+func (r *Repo) resetCache() {
+	r.actPacks = []string{}
+	r.disPacks = []string{}
+	r.indPacks = []string{}
+	r.algo = nil
+	r.casePolicy = ""
+}
+
 // packages возвращает список проиндексированных пакетов
 func (r *Repo) packages() []string {
 	var packs []string
@@ -471,10 +746,9 @@ func (r *Repo) packages() []string {
 	return packs
 }
 
-// disablePack блокирует пакет
-func (r *Repo) disablePack(pack string) error {
-
-	res, err := r.db.Exec("INSERT INTO excludes VALUES (?);", pack)
+// disablePack блокирует пакет; запросы выполняются через db
+func (r *Repo) disablePack(db dbExecutor, pack string) error {
+	res, err := db.Exec("INSERT INTO excludes VALUES (?);", pack)
 	if err != nil {
 		return &InternalError{
 			Text:   fmt.Sprintf("ошибка деактивации пакета %q", pack),
@@ -489,13 +763,14 @@ func (r *Repo) disablePack(pack string) error {
 			Err:    err,
 		}
 	}
+	r.auditDB(db, auditDisable, pack, "активен", "заблокирован")
 	fmt.Printf("заблокирован: [ %s ]\n", pack)
 	return nil
 }
 
-// enablePack активирует пакет
-func (r *Repo) enablePack(pack string) error {
-	res, err := r.db.Exec("DELETE FROM excludes WHERE Name=?;", pack)
+// enablePack активирует пакет; запросы выполняются через db
+func (r *Repo) enablePack(db dbExecutor, pack string) error {
+	res, err := db.Exec("DELETE FROM excludes WHERE Name=?;", pack)
 	if err != nil {
 		return &InternalError{
 			Text:   fmt.Sprintf("ошибка активации пакета %q", pack),
@@ -510,10 +785,26 @@ func (r *Repo) enablePack(pack string) error {
 			Err:    err,
 		}
 	}
+	r.auditDB(db, auditEnable, pack, "заблокирован", "активен")
 	fmt.Printf("активирован: [ %s ]\n", pack)
 	return nil
 }
 
+// renamePack изменяет имя пакета в БД при изменении регистра символов имени каталога пакета.
+// Возвращает true, если имя изменено
+func (r *Repo) renamePack(db dbExecutor, id int64, name string) (bool, error) {
+	res, err := db.Exec("UPDATE packages SET name=? WHERE id=? AND name<>?;", name, id, name)
+	if err != nil {
+		return false, &InternalError{
+			Text:   fmt.Sprintf("ошибка переименования пакета %q", name),
+			Caller: "Manager::RenamePack",
+			Err:    err,
+		}
+	}
+	c, _ := res.RowsAffected()
+	return c > 0, nil
+}
+
 // removePack удаляет данные о пакете
 func (r *Repo) removePack(pack string) error {
 	res, err := r.db.Exec("DELETE FROM packages WHERE Name=?;", pack)
@@ -575,24 +866,31 @@ func (r *Repo) cleanStatusDB() error {
 }
 
 // updatePackData подсчет контрольной суммы пакета по основанию сумм файлов
-func (r *Repo) updatePackData(id int64) error {
+func (r *Repo) updatePackData(db dbExecutor, id int64) error {
 	var (
 		fHash, hashTotal          string
 		fCount, fSize, fSizeTotal int64
 	)
-	rows, _ := r.db.Query("SELECT hash, size FROM files WHERE package_id=?;", id)
-	defer rows.Close()
+	rows, err := db.Query("SELECT hash, size FROM files WHERE package_id=?;", id)
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка выборки файлов пакета",
+			Caller: "Manager::HashSumPack",
+			Err:    err,
+		}
+	}
 	for rows.Next() {
 		_ = rows.Scan(&fHash, &fSize)
 		hashTotal += fHash
 		fSizeTotal += fSize
 	}
-	row := r.db.QueryRow("SELECT COUNT(*) FROM files WHERE package_id=?;", id)
+	rows.Close()
+	row := db.QueryRow("SELECT COUNT(*) FROM files WHERE package_id=?;", id)
 	row.Scan(&fCount)
-	hashTotal = hashSum(hashTotal)
+	hashTotal = hashSum(r.hashAlgo(), hashTotal)
 
 	sqlString := "UPDATE packages SET hash=?,size=?,fcnt=? WHERE id=?;"
-	res, err := r.db.Exec(sqlString, hashTotal, fSizeTotal, fCount, id)
+	res, err := db.Exec(sqlString, hashTotal, fSizeTotal, fCount, id)
 	if err != nil {
 		return &InternalError{
 			Text:   "ошибка обновления данных пакета",
@@ -612,8 +910,12 @@ func (r *Repo) updatePackData(id int64) error {
 
 // setPrepare компилирует SQL шаблоны запросов для ускорения обработки данных
 func (r *Repo) setPrepare() error {
+	// запросы уже подготовлены при предыдущей индексации
+	if r.stmtAddFile != nil && r.stmtDelFile != nil && r.stmtUpdFile != nil {
+		return nil
+	}
 	//
-	sqlExpr := "INSERT INTO files ('package_id', 'path', 'size', 'mdate', 'hash') VALUES (?, ?, ?, ?, ?);"
+	sqlExpr := "INSERT INTO files ('package_id', 'path', 'size', 'mdate', 'mode', 'hash') VALUES (?, ?, ?, ?, ?, ?);"
 	r.stmtAddFile, err = r.db.Prepare(sqlExpr)
 	if err != nil {
 		return &InternalError{
@@ -632,7 +934,7 @@ func (r *Repo) setPrepare() error {
 		}
 	}
 	//
-	r.stmtUpdFile, err = r.db.Prepare("UPDATE files SET size=?, mdate=?, hash=? WHERE id=?;")
+	r.stmtUpdFile, err = r.db.Prepare("UPDATE files SET path=?, size=?, mdate=?, mode=?, hash=? WHERE id=?;")
 	if err != nil {
 		return &InternalError{
 			Text:   "ошибка подготовки данных запроса",
@@ -692,7 +994,13 @@ func (r *Repo) repoStatus() (*RepoStData, error) {
 	}
 
 	// данные индекс-хэш файла
-	fInfo, err = os.Stat(filepath.Join(r.Path(), IndexGZ+".sha1"))
+	data.HashAlgo = r.hashAlgo().name
+	data.HashFile = hashFileName(r.hashAlgo())
+	data.CasePolicy = CaseSensitive
+	if r.caseInsensitive() {
+		data.CasePolicy = CaseInsensitive
+	}
+	fInfo, err = os.Stat(filepath.Join(r.Path(), data.HashFile))
 	if err != nil {
 		data.HashSize = -1
 		data.HashMDate = time.Time{}
@@ -709,12 +1017,8 @@ func (r *Repo) listIndexedPacks(ch chan<- *ListData) {
 	go dirList(r.Path(), dir)
 	for name := range dir {
 		data := new(ListData)
-		alias := r.alias(name)
-		if alias != "" {
-			data.Name = fmt.Sprintf("%v (%v)", name, alias)
-		} else {
-			data.Name = name
-		}
+		data.Name = name
+		data.Alias = r.alias(name)
 		if r.packIsBlocked(name) {
 			// блок
 			data.Status = PackStatusBlocked
@@ -745,7 +1049,7 @@ func (r *Repo) checkDB() error {
 		err = rows.Scan(&res)
 		if res != "ok" || err != nil {
 			return &InternalError{
-				Text:   "ошибка целостности БД. Tребуется повторная инициализация",
+				Text:   "ошибка целостности БД. Tребуется повторная инициализация или восстановление командой 'recover-db'",
 				Caller: "Manager::checkDB",
 				Err:    err,
 			}
@@ -759,21 +1063,23 @@ func (r *Repo) checkDBVersion() error {
 	vmaj, vmin, err := r.versionDB()
 	if err != nil {
 		return err
-	} // todo - миграцию при поднятии версии программы
-	if DBVersionMajor > vmaj {
+	}
+	if vmaj > DBVersionMajor || (vmaj == DBVersionMajor && vmin > DBVersionMinor) {
+		msg := "\n\tверсия БД [%d.%d] старше требуемой[%d.%d]; возможно вы используете старую версию программы"
 		return &InternalError{
-			Text:   "\n\tУстаревшая версия репозитория. Требуется переиндексация",
+			Text:   fmt.Sprintf(msg, vmaj, vmin, DBVersionMajor, DBVersionMinor),
 			Caller: "Manager::CheckDBVersion",
 		}
-	} else if DBVersionMinor > vmin {
-		return &InternalError{
-			Text:   "\n\tТребуется миграция БД репозитория",
-			Caller: "Manager::CheckDBVersion",
+	} else if vmaj != DBVersionMajor || vmin != DBVersionMinor {
+		if _, err := migrationPlan(vmaj, vmin); err != nil {
+			return &InternalError{
+				Text:   "\n\tУстаревшая версия репозитория. Требуется повторная инициализация и переиндексация",
+				Caller: "Manager::CheckDBVersion",
+				Err:    err,
+			}
 		}
-	} else if vmaj > DBVersionMajor || vmin > DBVersionMinor {
-		msg := "\n\tверсия БД [%d.%d] старше требуемой[%d.%d]; возможно вы используете старую версию программы"
 		return &InternalError{
-			Text:   fmt.Sprintf(msg, vmaj, vmin, DBVersionMajor, DBVersionMinor),
+			Text:   "\n\tТребуется миграция БД репозитория командой 'migrate'",
 			Caller: "Manager::CheckDBVersion",
 		}
 	}
@@ -810,26 +1116,83 @@ func (r *Repo) versionDB() (int64, int64, error) {
 	return vmaj, vmin, nil
 }
 
+// hashAlgo кэширует и возвращает алгоритм подсчета контрольных сумм репозитория.
+// В БД версии ниже 1.7 алгоритм не хранится - используется SHA-1
+func (r *Repo) hashAlgo() *hashAlgo {
+	if r.algo == nil {
+		var name string
+		if err := r.db.QueryRow("SELECT hash_algo FROM info WHERE id=1;").Scan(&name); err != nil {
+			name = HashSHA1
+		}
+		algo, err := hashAlgoByName(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.algo = algo
+	}
+	return r.algo
+}
+
+// setHashAlgo сохраняет алгоритм подсчета контрольных сумм репозитория в БД
+// и снимает отметку о незавершенном пересчете
+func (r *Repo) setHashAlgo(algo *hashAlgo) error {
+	if _, err := r.db.Exec("UPDATE info SET hash_algo=?, hash_next='' WHERE id=1;", algo.name); err != nil {
+		return &InternalError{
+			Text:   "ошибка сохранения алгоритма контрольной суммы",
+			Caller: "Manager::SetHashAlgo",
+			Err:    err,
+		}
+	}
+	r.algo = algo
+	return nil
+}
+
+// hashNext возвращает алгоритм незавершенного пересчета контрольных сумм; пустая строка - пересчет не выполняется
+func (r *Repo) hashNext() string {
+	var name string
+	_ = r.db.QueryRow("SELECT hash_next FROM info WHERE id=1;").Scan(&name)
+	return name
+}
+
+// setHashNext отмечает в БД начало пересчета контрольных сумм по алгоритму algo
+func (r *Repo) setHashNext(algo *hashAlgo) error {
+	if _, err := r.db.Exec("UPDATE info SET hash_next=? WHERE id=1;", algo.name); err != nil {
+		return &InternalError{
+			Text:   "ошибка сохранения алгоритма контрольной суммы",
+			Caller: "Manager::SetHashNext",
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// checkRehash проверяет отсутствие незавершенного пересчета контрольных сумм: до его завершения
+// часть пакетов в БД содержит контрольные суммы нового алгоритма. Индексация в ходе пересчета
+// (алгоритм репозитория заменен на новый командой rehash) допускается
+func (r *Repo) checkRehash() error {
+	if next := r.hashNext(); next != "" && next != r.hashAlgo().name {
+		return &InternalError{
+			Text: fmt.Sprintf("пересчет контрольных сумм %s -> %s не завершен. Повторите команду 'rehash %s'",
+				r.hashAlgo().name, next, next),
+			Caller: "Manager::CheckRehash",
+		}
+	}
+	return nil
+}
+
 // execFileSet фиксирует имя исполняемого файла пакета
 func (r *Repo) execFileSet(pack string, force bool) error {
 	id, err := r.packageID(pack)
 	if err != nil {
 		return err
 	}
+	execInDB, err := r.execFileInfo(pack)
+	if err != nil {
+		return err
+	}
 
 	switch force { // force - принудительная замена
 	case false:
-		var execInDB string
-		if err := r.db.QueryRow(
-			"SELECT CASE WHEN exec IS null THEN '' ELSE exec END exec FROM packages WHERE id=?;", id).Scan(
-			&execInDB); err != nil {
-			//if err := r.db.QueryRow("SELECT exec FROM packages WHERE id=?;", id).Scan(&exec_db); err != nil {
-			return &InternalError{
-				Text:   "ошибка запроса данных в БД",
-				Caller: "Manager::ExecFileSet",
-				Err:    err,
-			}
-		}
 		if execInDB != "" {
 			fmt.Printf("\t%v: уже установлен, пропуск\n", pack)
 			return nil
@@ -855,6 +1218,9 @@ func (r *Repo) execFileSet(pack string, force bool) error {
 				Err:    err,
 			}
 		}
+		if execFile != execInDB {
+			r.audit(auditExecSet, pack, execInDB, execFile)
+		}
 		fmt.Printf("\t%v: установлен в [ %v ]\n", pack, execFile)
 	}
 	return nil
@@ -866,7 +1232,10 @@ func (r *Repo) execFileDel(pack string) error {
 	if err != nil {
 		return err
 	}
-	// CheckError(fmt.Sprintf("не найден пакет в БД: %v", pack), &err)
+	execInDB, err := r.execFileInfo(pack)
+	if err != nil {
+		return err
+	}
 	res, err := r.db.Exec("UPDATE packages SET exec='noexec' WHERE id=?;", id)
 	if err != nil {
 		return &InternalError{
@@ -882,6 +1251,7 @@ func (r *Repo) execFileDel(pack string) error {
 			Err:    err,
 		}
 	}
+	r.audit(auditExecDel, pack, execInDB, "noexec")
 	fmt.Printf("Исполняемый файл пакета '%v' установлен в 'noexec' \n", pack)
 	return nil
 }
@@ -908,6 +1278,58 @@ func (r *Repo) execFileInfo(pack string) (string, error) {
 	return execInDB, nil
 }
 
+// execFileValid проверяет, является ли значение исполняемым файлом пакета: 'noexec' или файл пакета в БД
+func (r *Repo) execFileValid(pack, execFile string) (bool, error) {
+	if execFile == "noexec" {
+		return true, nil
+	}
+	id, err := r.packageID(pack)
+	if err != nil {
+		return false, err
+	}
+	var c int
+	if err = r.db.QueryRow("SELECT count(*) FROM files WHERE package_id=? AND path=?;", id, execFile).Scan(&c); err != nil {
+		return false, &InternalError{
+			Text:   "ошибка запроса данных в БД",
+			Caller: "Manager::ExecFileValid",
+			Err:    err,
+		}
+	}
+	return c > 0, nil
+}
+
+// setExecFileValue устанавливает исполняемый файл пакета без поиска в файлах пакета.
+// Пустое значение снимает установку исполняемого файла; изменение записывается через db
+func (r *Repo) setExecFileValue(db dbExecutor, pack, execFile string) error {
+	id, err := r.packageID(pack)
+	if err != nil {
+		return err
+	}
+	execInDB, err := r.execFileInfo(pack)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if execFile != "" {
+		value = execFile
+	}
+	if _, err = db.Exec("UPDATE packages SET exec=? WHERE id=?;", value, id); err != nil {
+		return &InternalError{
+			Text:   "ошибка обновления данных в БД",
+			Caller: "Manager::SetExecFileValue",
+			Err:    err,
+		}
+	}
+	if execFile == "" {
+		r.auditDB(db, auditExecDel, pack, execInDB, "")
+		fmt.Printf("\t%v: исполняемый файл не установлен\n", pack)
+		return nil
+	}
+	r.auditDB(db, auditExecSet, pack, execInDB, execFile)
+	fmt.Printf("\t%v: установлен в [ %v ]\n", pack, execFile)
+	return nil
+}
+
 // checkEmptyExecFiles проверяет на наличие не установленных исполняемых файлах пакетов в репозитории
 func (r *Repo) checkEmptyExecFiles() error {
 	if len(r.nullExecFilesList()) > 0 {
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// fnManifest имя файла с описанием пакета в корневой папке пакета
+const fnManifest = "package.json"
+
+// manifestVersionRegEx допустимый формат версии пакета: 1.2.3[-beta][+build]
+var manifestVersionRegEx = regexp.MustCompile(`^\d+(\.\d+){0,3}([-+][0-9A-Za-z.+-]+)?$`)
+
+// readManifest читает и проверяет описание пакета; при отсутствии файла возвращает nil
+func readManifest(packRoot string, ign ignoreList) (*PackManifest, error) {
+	fp := filepath.Join(packRoot, fnManifest)
+	buf, err := ioutil.ReadFile(fp)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения файла %s", fp),
+			Caller: "readManifest",
+			Err:    err,
+		}
+	}
+	m := new(PackManifest)
+	if err = json.Unmarshal(buf, m); err == nil {
+		err = m.validate(packRoot, ign)
+	}
+	if err != nil {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("неверное описание пакета %s: %v", fp, err),
+			Caller: "readManifest",
+			Err:    err,
+		}
+	}
+	return m, nil
+}
+
+// validate проверяет данные описания пакета
+func (m *PackManifest) validate(packRoot string, ign ignoreList) error {
+	m.Version = strings.TrimSpace(m.Version)
+	m.Category = strings.TrimSpace(m.Category)
+	m.Publisher = strings.TrimSpace(m.Publisher)
+	if m.Version != "" && !manifestVersionRegEx.MatchString(m.Version) {
+		return fmt.Errorf("неверный формат версии %q", m.Version)
+	}
+	if m.Icon != "" {
+		icon := filepath.ToSlash(filepath.Clean(filepath.FromSlash(m.Icon)))
+		if filepath.IsAbs(icon) || icon == ".." || strings.HasPrefix(icon, "../") {
+			return fmt.Errorf("путь к значку %q должен быть относительным в пределах пакета", m.Icon)
+		}
+		info, err := os.Stat(filepath.Join(packRoot, filepath.FromSlash(icon)))
+		if err != nil || info.IsDir() || ign.excluded(icon) {
+			return fmt.Errorf("не найден файл значка %q", m.Icon)
+		}
+		m.Icon = icon
+	}
+	return nil
+}
+
+// equal сравнивает данные описаний пакета
+func (m *PackManifest) equal(o *PackManifest) bool {
+	if m == nil || o == nil {
+		return m == o
+	}
+	return *m == *o
+}
+
+// packManifest возвращает описание пакета из БД; при отсутствии возвращает nil
+func (r *Repo) packManifest(db dbExecutor, id int64) (*PackManifest, error) {
+	m := new(PackManifest)
+	err := db.QueryRow("SELECT version, description, publisher, category, icon, args "+
+		"FROM manifests WHERE package_id=?;", id).Scan(
+		&m.Version, &m.Description, &m.Publisher, &m.Category, &m.Icon, &m.Args)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка выборки описания пакета",
+			Caller: "Manager::PackManifest",
+			Err:    err,
+		}
+	}
+	return m, nil
+}
+
+// updatePackManifest сохраняет описание пакета в БД, при отсутствии описания удаляет данные
+func (r *Repo) updatePackManifest(db dbExecutor, id int64, m *PackManifest) error {
+	var err error
+	if m == nil {
+		_, err = db.Exec("DELETE FROM manifests WHERE package_id=?;", id)
+	} else {
+		_, err = db.Exec("INSERT OR REPLACE INTO manifests "+
+			"(package_id, version, description, publisher, category, icon, args) VALUES (?, ?, ?, ?, ?, ?, ?);",
+			id, m.Version, m.Description, m.Publisher, m.Category, m.Icon, m.Args)
+	}
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка обновления описания пакета",
+			Caller: "Manager::UpdatePackManifest",
+			Err:    err,
+		}
+	}
+	return nil
+}
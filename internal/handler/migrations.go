@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migration шаг миграции структуры БД с версии from на версию to
+type migration struct {
+	fromMaj, fromMin int64               // исходная версия БД
+	toMaj, toMin     int64               // версия БД после применения шага
+	descr            string              // описание изменений
+	sql              string              // SQL скрипт изменения структуры БД
+	fn               func(*sql.Tx) error // преобразование данных, выполняется после sql
+}
+
+// migrations упорядоченный список шагов миграции БД.
+// При изменении структуры БД в initSQL требуется поднять версию БД
+// и добавить в конец списка шаг миграции с предыдущей версии
+var migrations = []migration{
+	{
+		fromMaj: 1, fromMin: 6, toMaj: 1, toMin: 7,
+		descr: "алгоритм контрольных сумм репозитория (info.hash_algo)",
+		sql:   "ALTER TABLE info ADD COLUMN hash_algo VARCHAR NOT NULL DEFAULT 'sha1';",
+	},
+	{
+		fromMaj: 1, fromMin: 7, toMaj: 1, toMin: 8,
+		descr: "шаблоны исключения файлов (ignores)",
+		sql: "CREATE TABLE ignores (pattern VARCHAR NOT NULL UNIQUE);" +
+			"INSERT INTO ignores (pattern) VALUES ('[Tt]humbs.db'), ('~*');",
+	},
+	{
+		fromMaj: 1, fromMin: 8, toMaj: 1, toMin: 9,
+		descr: "описания пакетов (manifests)",
+		sql: "CREATE TABLE manifests (package_id INTEGER PRIMARY KEY," +
+			"version VARCHAR NOT NULL DEFAULT '', description VARCHAR NOT NULL DEFAULT ''," +
+			"publisher VARCHAR NOT NULL DEFAULT '', category VARCHAR NOT NULL DEFAULT ''," +
+			"icon VARCHAR NOT NULL DEFAULT '', args VARCHAR NOT NULL DEFAULT ''," +
+			"FOREIGN KEY (package_id) REFERENCES packages (id) ON DELETE CASCADE ON UPDATE CASCADE);",
+	},
+	{
+		fromMaj: 1, fromMin: 9, toMaj: 1, toMin: 10,
+		descr: "канонические пути файлов: разделитель '/', нормализация NFC (files.path, packages.exec)",
+		fn:    migrateCanonicalPaths,
+	},
+	{
+		fromMaj: 1, fromMin: 10, toMaj: 1, toMin: 11,
+		descr: "политика сравнения имен пакетов и путей файлов (info.case_policy)",
+		sql:   "ALTER TABLE info ADD COLUMN case_policy VARCHAR NOT NULL DEFAULT 'sensitive';",
+	},
+	{
+		fromMaj: 1, fromMin: 11, toMaj: 1, toMin: 12,
+		descr: "журнал операций с репозиторием (audit)",
+		sql: "CREATE TABLE audit (id INTEGER PRIMARY KEY AUTOINCREMENT, stamp INTEGER NOT NULL," +
+			"operator VARCHAR NOT NULL, host VARCHAR NOT NULL, command VARCHAR NOT NULL," +
+			"package VARCHAR NOT NULL DEFAULT '', old_value VARCHAR NOT NULL DEFAULT ''," +
+			"new_value VARCHAR NOT NULL DEFAULT '');" +
+			"CREATE INDEX idx_audit_stamp ON audit (stamp);",
+	},
+	{
+		fromMaj: 1, fromMin: 12, toMaj: 1, toMin: 13,
+		descr: "права доступа файлов (files.mode); заполняются при индексации без подсчета контрольных сумм",
+		sql:   "ALTER TABLE files ADD COLUMN mode INTEGER NOT NULL DEFAULT 0;",
+	},
+	{
+		fromMaj: 1, fromMin: 13, toMaj: 1, toMin: 14,
+		descr: "алгоритм незавершенного пересчета контрольных сумм (info.hash_next)",
+		sql:   "ALTER TABLE info ADD COLUMN hash_next VARCHAR NOT NULL DEFAULT '';",
+	},
+}
+
+// String возвращает описание шага миграции
+func (m migration) String() string {
+	return fmt.Sprintf("%d.%d -> %d.%d: %s", m.fromMaj, m.fromMin, m.toMaj, m.toMin, m.descr)
+}
+
+// migrationPlan возвращает последовательность шагов миграции БД
+// с указанной версии до версии программы
+func migrationPlan(vMaj, vMin int64) ([]migration, error) {
+	var plan []migration
+	for vMaj != DBVersionMajor || vMin != DBVersionMinor {
+		found := false
+		for _, m := range migrations {
+			if m.fromMaj == vMaj && m.fromMin == vMin {
+				plan = append(plan, m)
+				vMaj, vMin = m.toMaj, m.toMin
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &InternalError{
+				Text: fmt.Sprintf("нет шагов миграции с версии БД %d.%d на версию %d.%d",
+					vMaj, vMin, DBVersionMajor, DBVersionMinor),
+				Caller: "migrationPlan",
+			}
+		}
+	}
+	return plan, nil
+}
+
+// applyMigrations применяет шаги миграции в одной транзакции;
+// при ошибке любого шага изменения БД отменяются
+func (r *Repo) applyMigrations(plan []migration) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return &InternalError{
+			Text:   "ошибка начала транзакции миграции",
+			Caller: "Manager::ApplyMigrations::Begin",
+			Err:    err,
+		}
+	}
+	for _, m := range plan {
+		fmt.Printf("  %v: ", m)
+		if err = m.apply(tx); err != nil {
+			fmt.Println("ошибка")
+			_ = tx.Rollback()
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка миграции БД на версию %d.%d. Изменения отменены", m.toMaj, m.toMin),
+				Caller: "Manager::ApplyMigrations",
+				Err:    err,
+			}
+		}
+		fmt.Println("OK")
+	}
+	if err = tx.Commit(); err != nil {
+		return &InternalError{
+			Text:   "ошибка фиксации транзакции миграции",
+			Caller: "Manager::ApplyMigrations::Commit",
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// apply выполняет шаг миграции и фиксирует новую версию БД
+func (m migration) apply(tx *sql.Tx) error {
+	if m.sql != "" {
+		if _, err := tx.Exec(m.sql); err != nil {
+			return err
+		}
+	}
+	if m.fn != nil {
+		if err := m.fn(tx); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("UPDATE info SET vers_major=?, vers_minor=? WHERE id=1;", m.toMaj, m.toMin)
+	return err
+}
+
+// migrateCanonicalPaths приводит пути файлов и исполняемых файлов пакетов к каноническому виду.
+// Обратная косая черта заменяется независимо от ОС, на которой создана БД
+func migrateCanonicalPaths(tx *sql.Tx) error {
+	for _, q := range []struct{ sel, upd string }{
+		{"SELECT id, path FROM files;", "UPDATE files SET path=? WHERE id=?;"},
+		{"SELECT id, exec FROM packages WHERE exec IS NOT NULL;", "UPDATE packages SET exec=? WHERE id=?;"},
+	} {
+		rows, err := tx.Query(q.sel)
+		if err != nil {
+			return err
+		}
+		changed := map[int64]string{}
+		for rows.Next() {
+			var id int64
+			var fp string
+			if err = rows.Scan(&id, &fp); err != nil {
+				rows.Close()
+				return err
+			}
+			if cp := canonicalPath(strings.ReplaceAll(fp, `\`, "/")); cp != fp {
+				changed[id] = cp
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for id, fp := range changed {
+			if _, err = tx.Exec(q.upd, fp, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"testing"
+)
+
+func TestMigrationPlan(t *testing.T) {
+	tests := []struct {
+		name       string
+		maj, min   int64
+		steps      int
+		wantErr    bool
+		lastToVers [2]int64
+	}{
+		{name: "текущая версия", maj: DBVersionMajor, min: DBVersionMinor},
+		{name: "с версии 1.6", maj: 1, min: 6, steps: int(DBVersionMinor - 6), lastToVers: [2]int64{DBVersionMajor, DBVersionMinor}},
+		{name: "с предыдущей версии", maj: 1, min: DBVersionMinor - 1, steps: 1, lastToVers: [2]int64{DBVersionMajor, DBVersionMinor}},
+		{name: "версия без шагов миграции", maj: 1, min: 5, wantErr: true},
+		{name: "версия новее программы", maj: 2, min: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := migrationPlan(tt.maj, tt.min)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ошибка %v, ожидается ошибка: %v", err, tt.wantErr)
+			}
+			if len(plan) != tt.steps {
+				t.Fatalf("шагов %d, ожидается %d", len(plan), tt.steps)
+			}
+			if len(plan) == 0 {
+				return
+			}
+			if plan[0].fromMaj != tt.maj || plan[0].fromMin != tt.min {
+				t.Errorf("первый шаг %v, ожидается с версии %d.%d", plan[0], tt.maj, tt.min)
+			}
+			for i := 1; i < len(plan); i++ {
+				if plan[i].fromMaj != plan[i-1].toMaj || plan[i].fromMin != plan[i-1].toMin {
+					t.Errorf("шаг %v не продолжает шаг %v", plan[i], plan[i-1])
+				}
+			}
+			last := plan[len(plan)-1]
+			if last.toMaj != tt.lastToVers[0] || last.toMin != tt.lastToVers[1] {
+				t.Errorf("последний шаг %v, ожидается на версию %d.%d", last, tt.lastToVers[0], tt.lastToVers[1])
+			}
+		})
+	}
+}
+
+func TestApplyMigrations(t *testing.T) {
+	tests := []struct {
+		name      string
+		plan      []migration
+		wantErr   bool
+		wantTable bool
+		wantVers  [2]int64
+	}{
+		{
+			name: "шаги применены",
+			plan: []migration{
+				{fromMaj: 1, fromMin: 1, toMaj: 1, toMin: 2, descr: "t1", sql: "CREATE TABLE t1 (id INTEGER);"},
+				{fromMaj: 1, fromMin: 2, toMaj: 1, toMin: 3, descr: "t2", sql: "CREATE TABLE t2 (id INTEGER);"},
+			},
+			wantTable: true,
+			wantVers:  [2]int64{1, 3},
+		},
+		{
+			name: "ошибка шага отменяет все шаги",
+			plan: []migration{
+				{fromMaj: 1, fromMin: 1, toMaj: 1, toMin: 2, descr: "t1", sql: "CREATE TABLE t1 (id INTEGER);"},
+				{fromMaj: 1, fromMin: 2, toMaj: 1, toMin: 3, descr: "ошибка", sql: "ALTER TABLE missing ADD COLUMN x;"},
+			},
+			wantErr:  true,
+			wantVers: [2]int64{DBVersionMajor, DBVersionMinor},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRepo(t)
+			err := r.applyMigrations(tt.plan)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ошибка %v, ожидается ошибка: %v", err, tt.wantErr)
+			}
+			var n int
+			if err = r.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='t1';").Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if (n == 1) != tt.wantTable {
+				t.Errorf("таблица t1 создана: %v, ожидается %v", n == 1, tt.wantTable)
+			}
+			var maj, min int64
+			if err = r.db.QueryRow("SELECT vers_major, vers_minor FROM info WHERE id=1;").Scan(&maj, &min); err != nil {
+				t.Fatal(err)
+			}
+			if maj != tt.wantVers[0] || min != tt.wantVers[1] {
+				t.Errorf("версия БД %d.%d, ожидается %d.%d", maj, min, tt.wantVers[0], tt.wantVers[1])
+			}
+		})
+	}
+}
@@ -4,11 +4,14 @@ package handler
 
 const initSQL = `
 -- Скрипт инициализации БД
+DROP TABLE IF EXISTS manifests;
 DROP TABLE IF EXISTS files;
 DROP TABLE IF EXISTS info;
 DROP TABLE IF EXISTS packages;
 DROP TABLE IF EXISTS aliases;
 DROP TABLE IF EXISTS excludes;
+DROP TABLE IF EXISTS ignores;
+DROP TABLE IF EXISTS audit;
 
 -- Пакеты подсистем
 CREATE TABLE packages
@@ -31,6 +34,7 @@ CREATE TABLE files
     path       VARCHAR     NOT NULL,
     size       INTEGER     NOT NULL,
     mdate      INTEGER     NOT NULL,
+    mode       INTEGER     NOT NULL DEFAULT 0,
     hash       VARCHAR(40) NOT NULL,
     FOREIGN KEY (package_id) REFERENCES packages (id)
         ON DELETE CASCADE
@@ -42,9 +46,12 @@ CREATE INDEX idx_file_path
 -- информация о БД
 CREATE TABLE info
 (
-    id         INTEGER PRIMARY KEY,
-    vers_major INTEGER NOT NULL,
-    vers_minor INTEGER NOT NULL
+    id          INTEGER PRIMARY KEY,
+    vers_major  INTEGER NOT NULL,
+    vers_minor  INTEGER NOT NULL,
+    hash_algo   VARCHAR NOT NULL DEFAULT 'sha1',
+    case_policy VARCHAR NOT NULL DEFAULT 'sensitive',
+    hash_next   VARCHAR NOT NULL DEFAULT ''
 );
 
 -- псевдонимы пакетов подсистем
@@ -63,4 +70,41 @@ CREATE TABLE excludes
 );
 CREATE INDEX idx_excludes
     ON excludes (Name);
+
+-- шаблоны исключения файлов при индексации
+CREATE TABLE ignores
+(
+    pattern VARCHAR NOT NULL UNIQUE
+);
+INSERT INTO ignores (pattern) VALUES ('[Tt]humbs.db'), ('~*');
+
+-- описания пакетов из файла package.json
+CREATE TABLE manifests
+(
+    package_id  INTEGER PRIMARY KEY,
+    version     VARCHAR NOT NULL DEFAULT '',
+    description VARCHAR NOT NULL DEFAULT '',
+    publisher   VARCHAR NOT NULL DEFAULT '',
+    category    VARCHAR NOT NULL DEFAULT '',
+    icon        VARCHAR NOT NULL DEFAULT '',
+    args        VARCHAR NOT NULL DEFAULT '',
+    FOREIGN KEY (package_id) REFERENCES packages (id)
+        ON DELETE CASCADE
+        ON UPDATE CASCADE
+);
+
+-- журнал операций с репозиторием
+CREATE TABLE audit
+(
+    id        INTEGER PRIMARY KEY AUTOINCREMENT,
+    stamp     INTEGER NOT NULL,
+    operator  VARCHAR NOT NULL,
+    host      VARCHAR NOT NULL,
+    command   VARCHAR NOT NULL,
+    package   VARCHAR NOT NULL DEFAULT '',
+    old_value VARCHAR NOT NULL DEFAULT '',
+    new_value VARCHAR NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_audit_stamp
+    ON audit (stamp);
 `
@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// форматы вывода данных команд status, list, alias show, exec show
+const (
+	OutputTable = "table" // таблица для оператора
+	OutputJSON  = "json"  // документ JSON для автоматизации
+)
+
+var outputFormat = OutputTable
+
+// SetOutputFormat устанавливает формат вывода данных команд
+func SetOutputFormat(format string) error {
+	switch format {
+	case OutputTable, OutputJSON:
+		outputFormat = format
+	default:
+		return &InternalError{
+			Text:   fmt.Sprintf("неверный формат вывода %q. укажите один из [ 'table' | 'json' ]", format),
+			Caller: "SetOutputFormat",
+		}
+	}
+	return nil
+}
+
+// OutputIsJSON проверяет установку вывода в формате JSON
+func OutputIsJSON() bool {
+	return outputFormat == OutputJSON
+}
+
+// printJSON выводит документ в формате JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return &InternalError{
+			Text:   "ошибка вывода данных в формате JSON",
+			Caller: "printJSON",
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// StatusDocument документ с данными команды status
+type StatusDocument struct {
+	Reglament    bool           `json:"reglament"`                  // режим регламента
+	Lock         *ReglamentLock `json:"reglament_lock,omitempty"`   // данные блокировки режима регламента
+	HashAlgo     string         `json:"hash_algo"`                  // алгоритм контрольных сумм
+	CasePolicy   string         `json:"case_policy"`                // сравнение имен: sensitive | insensitive
+	IndexFormat  string         `json:"index_format,omitempty"`     // формат опубликованного индекс-файла: 1 | 2
+	Total        int            `json:"packages_total"`             // пакетов в репозитории
+	Indexed      int            `json:"packages_indexed"`           // проиндексировано
+	Blocked      int            `json:"packages_blocked"`           // заблокировано
+	NotIndexed   int            `json:"packages_not_indexed"`       // не проиндексировано
+	Removed      int            `json:"packages_removed"`           // удалено из репозитория после индексации
+	Files        []FileStatus   `json:"files"`                      // служебные файлы
+	DBVersion    string         `json:"db_version"`                 // версия БД репозитория
+	AppDBVersion string         `json:"app_db_version"`             // версия БД программы
+	DBVersionErr string         `json:"db_version_error,omitempty"` // несоответствие версий БД
+	EmptyExec    []string       `json:"empty_exec"`                 // пакеты без исполняемого файла
+}
+
+// ReglamentDocument документ команды regl
+type ReglamentDocument struct {
+	Reglament bool           `json:"reglament"`      // режим регламента
+	Lock      *ReglamentLock `json:"lock,omitempty"` // данные блокировки
+}
+
+// FileStatus данные служебного файла репозитория
+type FileStatus struct {
+	Name  string     `json:"name"`  // имя файла
+	Size  int64      `json:"size"`  // размер в байтах, -1 при отсутствии файла
+	MDate *time.Time `json:"mdate"` // дата изменения, null при отсутствии файла
+}
+
+// ListEntry данные пакета команды list
+type ListEntry struct {
+	Name   string `json:"name"`   // имя пакета
+	Alias  string `json:"alias"`  // псевдоним
+	Status string `json:"status"` // статус: active | blocked | notindexed
+}
+
+// AliasEntry данные псевдонима пакета
+type AliasEntry struct {
+	Package string `json:"package"`
+	Alias   string `json:"alias"`
+}
+
+// ExecEntry данные исполняемого файла пакета
+type ExecEntry struct {
+	Package string `json:"package"`
+	Exec    string `json:"exec"` // путь относительно корня пакета, 'noexec' или пусто, если не определен
+}
+
+// IndexDiffDocument документ команды index --dry-run: изменения, которые будут внесены индексацией
+type IndexDiffDocument struct {
+	MetaOnly bool       `json:"meta_only"`        // сверка без подсчета контрольных сумм
+	Packages []PackDiff `json:"packages"`         // пакеты с изменениями
+	Removed  []string   `json:"packages_removed"` // пакеты, данные которых будут удалены из БД
+}
+
+// PackDiff изменения файлов пакета
+type PackDiff struct {
+	Package     string   `json:"package"`
+	New         bool     `json:"new"`                    // пакет не проиндексирован
+	RenamedFrom string   `json:"renamed_from,omitempty"` // имя пакета в БД при изменении регистра символов
+	Added       []string `json:"added"`                  // новые файлы
+	Changed     []string `json:"changed"`                // измененные файлы
+	Touched     []string `json:"touched"`                // изменены только дата или права доступа, содержимое совпадает
+	Removed     []string `json:"removed"`                // удаленные файлы
+	Manifest    bool     `json:"manifest_changed"`       // изменено описание пакета
+	SizeBefore  int64    `json:"size_before"`
+	SizeAfter   int64    `json:"size_after"`
+	FcntBefore  int64    `json:"fcnt_before"`
+	FcntAfter   int64    `json:"fcnt_after"`
+	Error       string   `json:"error,omitempty"` // ошибка, при которой индексация пакета будет отменена
+}
+
+// VerifyDocument документ команды verify: результаты сверки файлов пакетов с данными БД
+type VerifyDocument struct {
+	Sample        string       `json:"sample"`        // параметр выборки, пусто - проверены все файлы
+	Files         int          `json:"files"`         // файлов в БД
+	Checked       int          `json:"checked"`       // проверено контрольных сумм
+	Discrepancies int          `json:"discrepancies"` // всего расхождений
+	Packages      []PackVerify `json:"packages"`
+}
+
+// PackVerify результаты сверки файлов пакета
+type PackVerify struct {
+	Package  string   `json:"package"`
+	Files    int      `json:"files"`    // файлов пакета в БД
+	Checked  int      `json:"checked"`  // проверено контрольных сумм
+	Corrupt  []string `json:"corrupt"`  // контрольная сумма не совпадает при неизменных размере и дате
+	Modified []string `json:"modified"` // изменены размер или дата после индексации
+	Missing  []string `json:"missing"`  // отсутствуют в репозитории
+	Extra    []string `json:"extra"`    // не проиндексированы
+}
+
+// packStatusNames наименования статусов пакета в документах
+var packStatusNames = map[int8]string{
+	PackStatusActive:     "active",
+	PackStatusBlocked:    "blocked",
+	PackStatusNotIndexed: "notindexed",
+}
+
+// newFileStatus возвращает данные служебного файла
+func newFileStatus(name string, size int64, mdate time.Time) FileStatus {
+	fs := FileStatus{Name: name, Size: size}
+	if size > -1 {
+		fs.MDate = &mdate
+	}
+	return fs
+}
+
+// StatusDoc возвращает документ с данными о состоянии репозитория
+func StatusDoc(r *Repo) (*StatusDocument, error) {
+	rData, err := r.repoStatus()
+	if err != nil {
+		return nil, err
+	}
+	vMaj, vMin, err := r.versionDB()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := readReglamentLock(r.path)
+	if err != nil {
+		return nil, err
+	}
+	doc := &StatusDocument{
+		Reglament:  lock != nil,
+		Lock:       lock,
+		HashAlgo:   rData.HashAlgo,
+		CasePolicy: rData.CasePolicy,
+		Total:      rData.TotalCnt,
+		Indexed:    rData.IndexedCnt,
+		Blocked:    rData.BlockedCnt,
+		Files: []FileStatus{
+			newFileStatus(fileDBName, rData.DBSize, rData.DBMDate),
+			newFileStatus(IndexGZ, rData.IndexSize, rData.IndexMDate),
+			newFileStatus(rData.HashFile, rData.HashSize, rData.HashMDate),
+		},
+		DBVersion:    fmt.Sprintf("%d.%d", vMaj, vMin),
+		AppDBVersion: fmt.Sprintf("%d.%d", DBVersionMajor, DBVersionMinor),
+		EmptyExec:    r.nullExecFilesList(),
+	}
+	if unIndexed := rData.TotalCnt - (rData.IndexedCnt + rData.BlockedCnt); unIndexed > 0 {
+		doc.NotIndexed = unIndexed
+	} else {
+		doc.Removed = -unIndexed
+	}
+	if err = r.checkDBVersion(); err != nil {
+		doc.DBVersionErr = err.(*InternalError).Text
+	}
+	if doc.EmptyExec == nil {
+		doc.EmptyExec = []string{}
+	}
+	if rData.IndexSize > -1 {
+		doc.IndexFormat = r.publishedFormat()
+	}
+	return doc, nil
+}
+
+// ReglamentDoc возвращает документ с режимом регламента и данными блокировки
+func ReglamentDoc(repoPath string) (*ReglamentDocument, error) {
+	lock, err := readReglamentLock(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	return &ReglamentDocument{Reglament: lock != nil, Lock: lock}, nil
+}
+
+// ListDoc возвращает документ со списком пакетов команды list:
+// all - []ListEntry; indexed, noindexed, blocked - []string; ignored - map[пакет][]файлы
+func ListDoc(r *Repo, cmd string, packs []string) (interface{}, error) {
+	switch cmd {
+	case "all":
+		list := []ListEntry{}
+		ch := make(chan *ListData)
+		go r.listIndexedPacks(ch)
+		for data := range ch {
+			list = append(list, ListEntry{Name: data.Name, Alias: data.Alias, Status: packStatusNames[data.Status]})
+		}
+		return list, nil
+	case "indexed":
+		return append([]string{}, r.packages()...), nil
+	case "noindexed":
+		return r.notIndexedPacks(), nil
+	case "blocked":
+		return append([]string{}, r.disabledPacks()...), nil
+	case "ignored":
+		if len(packs) == 0 {
+			return nil, &InternalError{
+				Text:   "укажите по крайней мере один пакет",
+				Caller: "List",
+			}
+		}
+		ignored := map[string][]string{}
+		for _, pack := range r.packNames(packs) {
+			if !r.PackIsActive(pack) {
+				return nil, &InternalError{
+					Text:   fmt.Sprintf("пакет %q не найден или заблокирован", pack),
+					Caller: "List",
+				}
+			}
+			files, err := r.ignoredFilesPackRepo(pack)
+			if err != nil {
+				return nil, err
+			}
+			ignored[pack] = append([]string{}, files...)
+		}
+		return ignored, nil
+	}
+	return nil, &InternalError{
+		Text:   fmt.Sprintf("неверно указана команда: %q", cmd),
+		Caller: "List",
+	}
+}
+
+// AliasDoc возвращает список псевдонимов пакетов
+func AliasDoc(r *Repo) []AliasEntry {
+	list := []AliasEntry{}
+	for _, aliasPair := range r.aliases() {
+		list = append(list, AliasEntry{Package: aliasPair[0], Alias: aliasPair[1]})
+	}
+	return list
+}
+
+// ExecDoc возвращает список исполняемых файлов пакетов; без указания пакетов - всех активных
+func ExecDoc(r *Repo, packs []string) ([]ExecEntry, error) {
+	if len(packs) == 0 {
+		packs = r.ActivePacks()
+	}
+	list := []ExecEntry{}
+	for _, pack := range r.packNames(packs) {
+		execFile, err := r.execFileInfo(pack)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ExecEntry{Package: pack, Exec: execFile})
+	}
+	return list, nil
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// IndexSig файл подписи индекс-файла
+const IndexSig = IndexGZ + ".sig"
+
+// suffixPub суффикс файла открытого ключа
+const suffixPub = ".pub"
+
+// keyFingerprint возвращает отпечаток открытого ключа
+func keyFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// generateKey создает пару ключей ed25519 и сохраняет их в файлы fp и fp.pub
+func generateKey(fp string) (ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка создания ключа",
+			Caller: "generateKey",
+			Err:    err,
+		}
+	}
+	privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+	if err = ioutil.WriteFile(fp, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err == nil {
+		err = ioutil.WriteFile(fp+suffixPub, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+	}
+	if err != nil {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка сохранения ключа %s", fp),
+			Caller: "generateKey",
+			Err:    err,
+		}
+	}
+	return pub, nil
+}
+
+// readPEM читает блок PEM указанного типа из файла
+func readPEM(fp, blockType string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("ошибка чтения ключа %s", fp),
+			Caller: "readPEM",
+			Err:    err,
+		}
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != blockType {
+		return nil, &InternalError{
+			Text:   fmt.Sprintf("неверный формат ключа %s", fp),
+			Caller: "readPEM",
+		}
+	}
+	return block.Bytes, nil
+}
+
+// readPrivateKey читает закрытый ключ ed25519 из файла
+func readPrivateKey(fp string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(fp, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if priv, ok := key.(ed25519.PrivateKey); err == nil && ok {
+		return priv, nil
+	}
+	return nil, &InternalError{
+		Text:   fmt.Sprintf("файл %s не содержит закрытый ключ ed25519", fp),
+		Caller: "readPrivateKey",
+		Err:    err,
+	}
+}
+
+// readPublicKey читает открытый ключ ed25519 из файла
+func readPublicKey(fp string) (ed25519.PublicKey, error) {
+	der, err := readPEM(fp, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if pub, ok := key.(ed25519.PublicKey); err == nil && ok {
+		return pub, nil
+	}
+	return nil, &InternalError{
+		Text:   fmt.Sprintf("файл %s не содержит открытый ключ ed25519", fp),
+		Caller: "readPublicKey",
+		Err:    err,
+	}
+}
+
+// signData возвращает подпись данных в кодировке base64
+func signData(priv ed25519.PrivateKey, data []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)))
+}
+
+// verifySignature проверяет подпись данных в кодировке base64
+func verifySignature(pub ed25519.PublicKey, data, sig []byte) bool {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, data, raw)
+}
+
+// signingKey возвращает закрытый ключ подписи индекс-файла при наличии файла ключа
+func signingKey(fp string) (ed25519.PrivateKey, error) {
+	if fp == "" || !fileExists(fp) {
+		return nil, nil
+	}
+	return readPrivateKey(fp)
+}
+
+// rotateKeyFile сохраняет текущую пару ключей с суффиксом .old
+func rotateKeyFile(fp string) error {
+	for _, f := range []string{fp, fp + suffixPub} {
+		if !fileExists(f) {
+			continue
+		}
+		if err := os.Rename(f, f+".old"); err != nil {
+			return &InternalError{
+				Text:   fmt.Sprintf("ошибка сохранения ключа %s", f),
+				Caller: "rotateKeyFile",
+				Err:    err,
+			}
+		}
+	}
+	return nil
+}
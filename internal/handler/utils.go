@@ -1,17 +1,15 @@
 package handler
 
 import (
-	"bufio"
-	"crypto/sha1"
 	"database/sql"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // fileExists проверяет наличие файла на диске
@@ -20,40 +18,61 @@ func fileExists(fp string) bool {
 	return err == nil
 }
 
-// taskOwnerInfo возвращает данные IP,.. инициатора работ в репозитории
-func taskOwnerInfo() []byte {
-	return []byte("127.0.0.1") // TODO: добавить информацию о подключении
+// canonicalPath приводит путь файла относительно корня пакета к виду, в котором он хранится
+// в БД и индекс-файле независимо от ОС: разделитель '/', нормализация Unicode NFC
+func canonicalPath(rel string) string {
+	return norm.NFC.String(filepath.ToSlash(rel))
 }
 
-// hashSum возвращает строку контрольной суммы переданной строки
-func hashSum(sd string) string {
-	r := strings.NewReader(sd)
-	h := sha1.New()
-	_, _ = io.Copy(h, r)
-	return fmt.Sprintf("%x", h.Sum(nil))
+// relPath возвращает канонический путь файла fp относительно корня пакета root
+func relPath(root, fp string) string {
+	rel, _ := filepath.Rel(root, fp)
+	return canonicalPath(rel)
 }
 
-// hashSumFile вычисляет контрольную сумму файла по алгоритму SHA1
-func hashSumFile(fp string) (string, error) {
-	// errMsg := "file hash sum calc error: %v"
-	f, err := os.Open(fp)
-	if err != nil {
-		return "", &InternalError{
-			Text:   fmt.Sprintf("ошибка подсчета контрольной суммы файла %s", fp),
-			Caller: "HashSumFile",
-			Err:    err,
-		}
+// hashFiles подсчитывает контрольные суммы файлов пулом из workers обработчиков.
+// Возвращает канал, из которого результаты читаются в порядке следования путей в fpList;
+// количество одновременно обрабатываемых файлов ограничено размером буфера канала.
+// Закрытие канала done прекращает передачу файлов на обработку
+func hashFiles(algo *hashAlgo, fpList []string, workers int, done <-chan struct{}) <-chan chan hashResult {
+	if workers < 1 {
+		workers = 1
 	}
-	defer f.Close()
-	h := sha1.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", &InternalError{
-			Text:   fmt.Sprintf("ошибка подсчета контрольной суммы файла %s", fp),
-			Caller: "HashSumFile",
-			Err:    err,
-		}
+	type hashJob struct {
+		fp  string
+		res chan hashResult
 	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	jobs := make(chan hashJob)
+	results := make(chan chan hashResult, workers*2)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				hash, err := hashSumFile(algo, job.fp)
+				job.res <- hashResult{hash: hash, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(results)
+		defer close(jobs)
+		for _, fp := range fpList {
+			job := hashJob{fp: fp, res: make(chan hashResult, 1)}
+			// очередность результатов фиксируется до передачи файла обработчикам
+			select {
+			case results <- job.res:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return results
 }
 
 // dirList передает в канал наименования папок в указанной директории
@@ -67,6 +86,10 @@ func dirList(fp string, dirs chan<- string) {
 		})
 	}
 	for _, d := range fList {
+		// служебные каталоги репозитория (.delta) не являются пакетами
+		if strings.HasPrefix(filepath.Base(d), ".") {
+			continue
+		}
 		res, err := os.Stat(d)
 		if err != nil {
 			log.Fatal(&InternalError{
@@ -82,26 +105,6 @@ func dirList(fp string, dirs chan<- string) {
 	close(dirs)
 }
 
-// userAccept проверяет ответ пользователя
-func userAccept(msg string) bool {
-	scanner := bufio.NewScanner(os.Stdin)
-	for i := 0; i < 3; i++ {
-		fmt.Print(msg + ". Продолжить? (y/N): ")
-		scanner.Scan()
-		txt := scanner.Text()
-		if len(txt) == 0 {
-			return false
-		} else if txt[0] == 'n' || txt[0] == 'N' {
-			return false
-		} else if txt[0] == 'y' || txt[0] == 'Y' {
-			return true
-		} else {
-			continue
-		}
-	}
-	return false
-}
-
 // ReadFromJSONFile читает данные из JSON файла
 // func ReadFromJSONFile(fp string, v *interface{}) error {
 // 	buf, err := ioutil.ReadFile(fp)
@@ -115,39 +118,18 @@ func userAccept(msg string) bool {
 // 	return json.Unmarshal(buf, v)
 // }
 
-func searchExecFile(root string, regExp *regexp.Regexp) ([]string, error) {
+func searchExecFile(root string, ign ignoreList, regExp *regexp.Regexp) ([]string, error) {
 	execFilesList := []string{}
-	for fInfo := range dirWalk(root) {
+	fInfoCh, errCh := dirWalk(root, ign)
+	for fInfo := range fInfoCh {
 		if regExp.MatchString(fInfo.Path) {
-			fp, err := filepath.Rel(root, fInfo.Path)
-			if err != nil {
-				return nil, &InternalError{
-					Text:   "ошибка приведения относительного пути",
-					Caller: "searchExecFile::Rel",
-					Err:    err,
-				}
-			}
-			execFilesList = append(execFilesList, fp)
+			execFilesList = append(execFilesList, relPath(root, fInfo.Path))
 		}
 	}
-	return execFilesList, nil
-}
-
-func selectExecFileByUser(fList []string) string {
-	scanner := bufio.NewScanner(os.Stdin)
-	count := len(fList)
-	for {
-		fmt.Printf("введите число от 1 до %d:\n", count)
-		for i := 0; i < count; i++ {
-			fmt.Printf("\t[%d]: '%v'\n", i+1, fList[i])
-		}
-		scanner.Scan()
-		choice := scanner.Text()
-		choiceInt, err := strconv.Atoi(choice)
-		if err == nil && choiceInt != 0 && choiceInt <= count {
-			return fList[choiceInt-1]
-		}
+	if err := <-errCh; err != nil {
+		return nil, err
 	}
+	return execFilesList, nil
 }
 
 func defineExecFile(r *Repo, pack string) (string, error) {
@@ -156,8 +138,12 @@ func defineExecFile(r *Repo, pack string) (string, error) {
 		execFile      string
 	)
 	packRoot := filepath.Join(r.Path(), pack)
+	ign, err := r.ignoreRules(pack)
+	if err != nil {
+		return "", err
+	}
 	execRegEx, _ := regexp.Compile(`^.+\.exe$`)
-	if execFilesList, err = searchExecFile(packRoot, execRegEx); err != nil {
+	if execFilesList, err = searchExecFile(packRoot, ign, execRegEx); err != nil {
 		return "", err
 	}
 
@@ -167,8 +153,7 @@ func defineExecFile(r *Repo, pack string) (string, error) {
 	case 1:
 		execFile = execFilesList[0]
 	default:
-		fmt.Printf("Выберите исполняемый файл для пакета '%v'\n", pack)
-		execFile = selectExecFileByUser(execFilesList)
+		return resolveExecFile(pack, execFilesList)
 	}
 	return execFile, nil
 }
@@ -185,36 +170,54 @@ func showEmptyExecFiles(r *Repo) {
 	}
 }
 
+// showFormatHint выводит на консоль предложение перейти на формат индекс-файла 2,
+// если опубликован индекс-файл формата 1: формат сохраняется при выгрузке, в том числе после миграции БД
+func showFormatHint(r *Repo) {
+	if r.publishedFormat() == IndexFormatV1 {
+		fmt.Print(doFormatMsg)
+	}
+}
+
 // dirWalk Рекурсивно обходит указанную папку и возвращает канал
-// с данными о файлах
-func dirWalk(root string) chan FileInfo {
+// с данными о файлах, пропуская файлы и папки по правилам исключения ign.
+// Ошибка обхода передается в канал ошибок после закрытия канала данных
+func dirWalk(root string, ign ignoreList) (chan FileInfo, chan error) {
 	fInfoCh := make(chan FileInfo)
+	errCh := make(chan error, 1)
 	fInfo := FileInfo{}
 
 	go func() {
+		defer close(errCh)
 		err := filepath.Walk(root, func(fp string, info os.FileInfo, er error) error {
 			if er != nil {
 				return fmt.Errorf("не найден пакет: %q", filepath.Base(fp))
 			}
+			if rel, _ := filepath.Rel(root, fp); rel != "." && ign.match(rel, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 			if info.IsDir() { // skip directory
 				return nil
 			}
 			fInfo.Path = fp
 			fInfo.Size = info.Size()
 			fInfo.MDate = info.ModTime().UnixNano()
+			fInfo.Mode = uint32(info.Mode().Perm())
 			fInfoCh <- fInfo
 			return nil
 		})
+		close(fInfoCh)
 		if err != nil {
-			log.Fatal(&InternalError{
-				Text:   "ошибка обхода директории",
+			errCh <- &InternalError{
+				Text:   fmt.Sprintf("ошибка обхода директории: %v", err),
 				Caller: "dirWalk::goroutine",
 				Err:    err,
-			})
+			}
 		}
-		close(fInfoCh)
 	}()
-	return fInfoCh
+	return fInfoCh, errCh
 }
 
 // InitDB инициализирует файл db
@@ -226,6 +229,15 @@ func InitDB(path string) error {
 			Caller: "InitDB",
 		}
 	}
+	if err := createDB(fp, DefaultHashAlgo); err != nil {
+		return err
+	}
+	fmt.Println("Репозиторий инициализирован")
+	return nil
+}
+
+// createDB создает файл БД текущей версии с указанным алгоритмом контрольных сумм
+func createDB(fp, algo string) error {
 	db, err := newConnection(fp)
 	if err != nil {
 		return err
@@ -240,35 +252,21 @@ func InitDB(path string) error {
 			Err:    err,
 		}
 	}
-	if _, err := db.Exec("INSERT INTO info (id, vers_major, vers_minor) VALUES (?, ?, ?);",
-		1, DBVersionMajor, DBVersionMinor); err != nil {
+	if _, err := db.Exec("INSERT INTO info (id, vers_major, vers_minor, hash_algo) VALUES (?, ?, ?, ?);",
+		1, DBVersionMajor, DBVersionMinor, algo); err != nil {
 		return &InternalError{
 			Text:   "ошибка инициализации репозитория",
 			Caller: "InitDB::db.Exec::SQL::insert",
 			Err:    err,
 		}
 	}
-	fmt.Println("Репозиторий инициализирован")
-	return nil
-}
-
-// cleanForMigrate удаляет файлы БД, индекса
-func cleanForMigrate(repo *Repo) error {
-	for _, fp := range []string{fileDBName, IndexGZ, IndexGZ + ".sha1"} {
-		fp = filepath.Join(repo.path, fp)
-		if err = os.Remove(fp); err != nil {
-			return &InternalError{
-				Text:   "ошибка удаления файла",
-				Caller: "CleanForMigrate",
-				Err:    err,
-			}
-		}
-	}
 	return nil
 }
 
+// newConnection открывает подключение к БД. Поддержка внешних ключей включается параметром
+// подключения: пул соединений database/sql создает новые соединения по мере необходимости
 func newConnection(fp string) (conn *sql.DB, err error) {
-	if conn, err = sql.Open("sqlite3", fp); err != nil {
+	if conn, err = sql.Open("sqlite3", fp+"?_foreign_keys=on"); err != nil {
 		return conn, &InternalError{
 			Text:   "ошибка открытия файла БД",
 			Caller: "newConnection",
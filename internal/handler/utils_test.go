@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestRepo создает во временном каталоге репозиторий с БД текущей версии
+// и установленным режимом регламента
+func newTestRepo(t *testing.T) *Repo {
+	t.Helper()
+	dir := t.TempDir()
+	fpDB := pathDB(dir)
+	if err := createDB(fpDB, DefaultHashAlgo); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.db, err = newConnection(fpDB); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = r.db.Close() })
+	if err = ioutil.WriteFile(filepath.Join(dir, fnReglament), []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.deltas = 0
+	return r
+}
+
+// writeTestFiles создает в каталоге dir n файлов с различным содержимым и возвращает их пути
+func writeTestFiles(t *testing.T, dir string, n int) []string {
+	t.Helper()
+	fpList := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		fp := filepath.Join(dir, fmt.Sprintf("file%03d", i))
+		if err := ioutil.WriteFile(fp, []byte(fmt.Sprintf("content %d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fpList = append(fpList, fp)
+	}
+	return fpList
+}
+
+func TestHashFilesOrder(t *testing.T) {
+	algo := hashAlgos[HashSHA256]
+	fpList := writeTestFiles(t, t.TempDir(), 50)
+	for _, workers := range []int{0, 1, 4, 16} {
+		done := make(chan struct{})
+		i := 0
+		for res := range hashFiles(algo, fpList, workers, done) {
+			r := <-res
+			if r.err != nil {
+				t.Fatalf("workers=%d: %v", workers, r.err)
+			}
+			want, _ := hashSumFile(algo, fpList[i])
+			if r.hash != want {
+				t.Errorf("workers=%d: файл %d: хэш %s, ожидается %s", workers, i, r.hash, want)
+			}
+			i++
+		}
+		close(done)
+		if i != len(fpList) {
+			t.Errorf("workers=%d: получено результатов %d, ожидается %d", workers, i, len(fpList))
+		}
+	}
+}
+
+func TestHashFilesMissing(t *testing.T) {
+	dir := t.TempDir()
+	fpList := append(writeTestFiles(t, dir, 2), filepath.Join(dir, "missing"))
+	done := make(chan struct{})
+	defer close(done)
+	var errs int
+	for res := range hashFiles(hashAlgos[HashSHA256], fpList, 2, done) {
+		if r := <-res; r.err != nil {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("ошибок %d, ожидается 1", errs)
+	}
+}
+
+func TestHashFilesCancel(t *testing.T) {
+	fpList := writeTestFiles(t, t.TempDir(), 200)
+	done := make(chan struct{})
+	results := hashFiles(hashAlgos[HashSHA256], fpList, 2, done)
+	<-<-results
+	close(done)
+
+	// после отмены канал результатов закрывается, не передав все файлы
+	received := 1
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				if received >= len(fpList) {
+					t.Errorf("получено результатов %d: отмена не прекратила обработку", received)
+				}
+				return
+			}
+			received++
+		case <-timeout:
+			t.Fatal("канал результатов не закрыт после отмены")
+		}
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"простой путь", "bin/app.exe", "bin/app.exe"},
+		{"имя файла", "app.exe", "app.exe"},
+		{"кириллица", "док/файл.txt", "док/файл.txt"},
+		{"NFD в NFC", "cafe\u0301.txt", "caf\u00e9.txt"},
+		{"NFC без изменений", "caf\u00e9.txt", "caf\u00e9.txt"},
+		{"разделитель ОС", filepath.Join("a", "b", "c.txt"), "a/b/c.txt"},
+		{"пустой путь", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canonicalPath(tt.in); got != tt.want {
+				t.Errorf("canonicalPath(%q) = %q, ожидается %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 )
 
@@ -16,6 +17,11 @@ func (e *InternalError) Error() string {
 	return e.Text
 }
 
+// Unwrap возвращает оригинальную ошибку для errors.Is и errors.As
+func (e *InternalError) Unwrap() error {
+	return e.Err
+}
+
 var err error
 
 const (
@@ -25,17 +31,43 @@ const (
 	// DBVersionMajor major ver DB
 	DBVersionMajor int64 = 1
 	// DBVersionMinor minor ver DB
-	DBVersionMinor int64 = 6
+	DBVersionMinor int64 = 14
 	// IndexFileFormatVersion index file format version for client info
-	IndexFileFormatVersion = "1"
+	IndexFileFormatVersion = IndexFormatV2
+)
+
+// форматы индекс-файла
+const (
+	// IndexFormatV1 файлы пакета: путь - контрольная сумма
+	IndexFormatV1 = "1"
+	// IndexFormatV2 файлы пакета: путь - контрольная сумма, размер, дата изменения, права доступа
+	IndexFormatV2 = "2"
 )
 
+// indexMinClient минимальная версия клиента, поддерживающая формат индекс-файла
+var indexMinClient = map[string]string{
+	IndexFormatV1: "1.0",
+	IndexFormatV2: "2.0",
+}
+
 // general
 const (
 	fnReglament = "__REGLAMENT__"
+	suffixTmp   = ".tmp"  // суффикс временного файла при выгрузке индекса
+	suffixPrev  = ".prev" // суффикс предыдущей версии опубликованного файла
+	suffixOrig  = ".orig" // суффикс копии файла, заменяемого при восстановлении из резервной копии
 	doPopMsg    = "\n\tВыгрузите данные в индекс-файл командой 'pop'\n"
 	doIndexMsg  = "\n\tПроиндексируйте пакеты командой 'index [...pacnames]'\n"
 	noChangeMsg = "Изменений нет\n"
+	doFormatMsg = "\n\tИндекс-файл опубликован в формате 1: разностные файлы, размер, дата и права доступа файлов не выгружаются." +
+		"\n\tПосле обновления клиентов выполните 'pop -format v2'\n"
+)
+
+// операции с файлами пакета при индексации (выводятся на консоль)
+const (
+	opFileAdd byte = '+' // добавление
+	opFileUpd byte = '.' // обновление
+	opFileDel byte = '-' // удаление
 )
 
 // статусы пакета
@@ -47,14 +79,44 @@ const (
 
 // HashedPackData структура для репрезентации данных о пакете в БД
 type HashedPackData struct {
-	ID    int64             `json:"-"`
-	Name  string            `json:"-"`
-	Alias string            `json:"alias"`
-	Hash  string            `json:"phash"`
-	Size  int64             `json:"size"`
-	Fcnt  int64             `json:"fcnt"`
-	Exec  string            `json:"execf"`
-	Files map[string]string `json:"files"`
+	ID    int64                 `json:"-"`
+	Name  string                `json:"-"`
+	Alias string                `json:"alias"`
+	Hash  string                `json:"phash"`
+	Size  int64                 `json:"size"`
+	Fcnt  int64                 `json:"fcnt"`
+	Exec  string                `json:"execf"`
+	Files map[string]*IndexFile `json:"files"`
+	// описание пакета из файла package.json
+	Manifest *PackManifest `json:"manifest,omitempty"`
+}
+
+// IndexFile данные файла пакета в индекс-файле
+type IndexFile struct {
+	Hash  string `json:"hash"`  // контрольная сумма
+	Size  int64  `json:"size"`  // размер
+	MTime int64  `json:"mtime"` // дата изменения, Unix время в секундах
+	Mode  uint32 `json:"mode"`  // права доступа
+}
+
+// UnmarshalJSON читает данные файла формата 2 и контрольную сумму файла формата 1
+func (f *IndexFile) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*f = IndexFile{}
+		return json.Unmarshal(data, &f.Hash)
+	}
+	type indexFile IndexFile // без метода UnmarshalJSON
+	return json.Unmarshal(data, (*indexFile)(f))
+}
+
+// PackManifest описание пакета из файла package.json в корне пакета
+type PackManifest struct {
+	Version     string `json:"version,omitempty"`     // версия
+	Description string `json:"description,omitempty"` // описание
+	Publisher   string `json:"publisher,omitempty"`   // разработчик
+	Category    string `json:"category,omitempty"`    // категория
+	Icon        string `json:"icon,omitempty"`        // путь к значку относительно корня пакета
+	Args        string `json:"args,omitempty"`        // аргументы запуска для ярлыка
 }
 
 // RepoStData структура для сбора данных по команде status
@@ -64,6 +126,9 @@ type RepoStData struct {
 	BlockedCnt int       // количество заблокированных
 	IndexSize  int64     // размер индекс-файла в байтах
 	DBSize     int64     // размер файла БД в байтах
+	HashAlgo   string    // алгоритм подсчета контрольных сумм
+	CasePolicy string    // политика сравнения имен пакетов и путей файлов
+	HashFile   string    // имя хэш-файла
 	HashSize   int64     // размер хэш-файла в байтах
 	IndexMDate time.Time // дата изменения индекс-файла
 	DBMDate    time.Time // дата изменения файла БД
@@ -74,25 +139,63 @@ type RepoStData struct {
 type ListData struct {
 	Status int8
 	Name   string
+	Alias  string
 }
 
 // Repo объект репозитория с БД
 type Repo struct {
 	path        string
-	disPacks    []string // список заблокированных пакетов
-	actPacks    []string // список активных (актуальных) пакетов
-	indPacks    []string // список проиндексированных пакетов
+	workers     int       // количество обработчиков для подсчета контрольных сумм файлов
+	algo        *hashAlgo // алгоритм подсчета контрольных сумм репозитория
+	keyFile     string    // путь к файлу закрытого ключа подписи индекс-файла
+	unsigned    bool      // разрешена выгрузка неподписанного индекс-файла вместо подписанного
+	deltas      int       // количество предыдущих выгрузок для разностных файлов индекса
+	casePolicy  string    // политика сравнения имен пакетов и путей файлов
+	disPacks    []string  // список заблокированных пакетов
+	actPacks    []string  // список активных (актуальных) пакетов
+	indPacks    []string  // список проиндексированных пакетов
 	db          *sql.DB
 	stmtAddFile *sql.Stmt // предустановка запроса на добавление данных файла пакета в БД
 	stmtDelFile *sql.Stmt // предустановка запроса на удаление данных файла пакетав БД
 	stmtUpdFile *sql.Stmt // предустановка запроса на изменение данных файла пакета в БД
 }
 
+// dbExecutor общий интерфейс *sql.DB и *sql.Tx для выполнения запросов
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// packTx транзакция индексации пакета с привязанными к ней подготовленными запросами
+type packTx struct {
+	*sql.Tx
+	stmtAddFile *sql.Stmt
+	stmtDelFile *sql.Stmt
+	stmtUpdFile *sql.Stmt
+}
+
 // FileInfo структура с данными о файле пакета в БД
 type FileInfo struct {
 	ID    int64  // package ID
 	Path  string // путь файла относительно корневой папки пакета
 	Size  int64  // размер файла
 	MDate int64  // дата изменения
+	Mode  uint32 // права доступа
 	Hash  string // контрольная сумма
 }
+
+// indexTask операция с данными файла пакета в БД при индексации
+type indexTask struct {
+	op    byte      // тип операции: opFileAdd, opFileUpd, opFileDel
+	fInfo *FileInfo // данные о файле для записи в БД
+	fPath string    // полный путь к файлу в репозитории для подсчета контрольной суммы
+	prev  *FileInfo // данные о файле в БД до изменения (opFileUpd)
+	attr  bool      // изменены только права доступа: контрольная сумма не подсчитывается (opFileUpd)
+}
+
+// hashResult результат подсчета контрольной суммы файла
+type hashResult struct {
+	hash string
+	err  error
+}
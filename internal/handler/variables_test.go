@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIndexFileUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    IndexFile
+		wantErr bool
+	}{
+		{"формат 1: контрольная сумма", `"87428f"`, IndexFile{Hash: "87428f"}, false},
+		{"формат 2: данные файла", `{"hash": "87428f", "size": 1024, "mtime": 1792307277, "mode": 420}`,
+			IndexFile{Hash: "87428f", Size: 1024, MTime: 1792307277, Mode: 420}, false},
+		{"формат 2: неполные данные", `{"hash": "87428f"}`, IndexFile{Hash: "87428f"}, false},
+		{"неверный тип", `1024`, IndexFile{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got IndexFile
+			err := json.Unmarshal([]byte(tt.in), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ошибка %v, ожидается ошибка: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("%+v, ожидается %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+//go:build linux
+// +build linux
+
+package handler
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// notifyMask события файловой системы, означающие изменение файлов пакета
+const notifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF
+
+// notifier отслеживает изменения файлов репозитория с помощью inotify
+type notifier struct {
+	fd   int
+	root string
+	dirs map[int32]string // каталоги по дескрипторам наблюдения
+}
+
+// newNotifier устанавливает наблюдение за каталогами репозитория и возвращает канал,
+// в который передаются имена пакетов при изменении их файлов
+func newNotifier(root string) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, &InternalError{
+			Text:   "ошибка инициализации уведомлений файловой системы",
+			Caller: "Watch::notifier",
+			Err:    err,
+		}
+	}
+	n := &notifier{fd: fd, root: root, dirs: map[int32]string{}}
+	if err = n.addTree(root); err != nil {
+		_ = syscall.Close(fd)
+		return nil, &InternalError{
+			Text:   "ошибка установки наблюдения за каталогами репозитория",
+			Caller: "Watch::notifier",
+			Err:    err,
+		}
+	}
+	events := make(chan string, 64)
+	go n.run(events)
+	return events, nil
+}
+
+// addTree устанавливает наблюдение за каталогом и вложенными каталогами
+func (n *notifier) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// каталог удален в процессе обхода
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(n.fd, path, notifyMask)
+		if err != nil {
+			return err
+		}
+		n.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+// run читает события файловой системы и передает в канал имена измененных пакетов
+func (n *notifier) run(events chan<- string) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		c, err := syscall.Read(n.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || c <= 0 {
+			log.Printf("уведомления файловой системы прекращены: %v", err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= c; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(ev.Len)]
+			offset += syscall.SizeofInotifyEvent + int(ev.Len)
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			if pack := n.handle(ev, name); pack != "" {
+				events <- pack
+			}
+		}
+	}
+}
+
+// handle обрабатывает событие и возвращает имя пакета, файлы которого изменены
+func (n *notifier) handle(ev *syscall.InotifyEvent, name string) string {
+	dir, ok := n.dirs[ev.Wd]
+	if !ok {
+		return ""
+	}
+	if ev.Mask&syscall.IN_IGNORED != 0 {
+		delete(n.dirs, ev.Wd)
+		return ""
+	}
+	isDir := ev.Mask&syscall.IN_ISDIR != 0
+	path := filepath.Join(dir, name)
+	if isDir && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		if err := n.addTree(path); err != nil {
+			log.Printf("ошибка установки наблюдения за каталогом %q: %v", path, err)
+		}
+	}
+	rel, err := filepath.Rel(n.root, path)
+	if err != nil || rel == "." {
+		return ""
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+	// файлы в корне репозитория (БД, индекс-файл, режим регламента) не относятся к пакетам
+	if len(parts) == 1 && !isDir {
+		return ""
+	}
+	return parts[0]
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package handler
+
+// newNotifier уведомления файловой системы поддерживаются только в Linux
+func newNotifier(string) (<-chan string, error) {
+	return nil, &InternalError{
+		Text:   "уведомления файловой системы не поддерживаются в данной ОС. Используйте опрос (без -notify)",
+		Caller: "Watch::notifier",
+	}
+}